@@ -18,10 +18,20 @@ package ifs
 
 import (
 	"go.uber.org/zap"
+	"os"
+	"path"
+	"path/filepath"
 	"sync"
+	"syscall"
 )
 
 type agent struct {
+	// Directories the agent serves, everything when empty
+	exports   []string
+	exportsMu sync.RWMutex
+
+	// Bounds the file data held by requests being served
+	memory *byteLimiter
 }
 
 var (
@@ -31,17 +41,161 @@ var (
 
 func Agent() *agent {
 	agentOnce.Do(func() {
-		agentInstance = &agent{}
+		agentInstance = &agent{
+			memory: newByteLimiter(megabytes(DefaultAgentMemoryLimit)),
+		}
 	})
 
 	return agentInstance
 }
 
+// Sets the directories served, each with its symlinks resolved so that
+// requested paths can be compared to where it really is
+func (a *agent) SetExports(exports []string) {
+	var cleaned []string
+
+	for _, export := range exports {
+		resolved, err := resolvePath(path.Clean(export))
+
+		if err != nil {
+			resolved = path.Clean(export)
+		}
+
+		cleaned = append(cleaned, resolved)
+	}
+
+	a.exportsMu.Lock()
+	a.exports = cleaned
+	a.exportsMu.Unlock()
+}
+
+// Sets the memory ceiling in megabytes, 0 keeps the current one
+func (a *agent) SetMemoryLimit(mb uint64) {
+	if mb > 0 {
+		a.memory.setLimit(megabytes(mb))
+	}
+}
+
+// Bytes of file data serving req holds, a fetch holds the whole file
+func (a *agent) requestBytes(req *Packet) int64 {
+
+	if req.Op == FetchFileRequest {
+		if info, err := os.Stat(req.Data.(*RemotePath).Path); err == nil {
+			return info.Size()
+		}
+	}
+
+	return requestBytes(req.Op, req.Data)
+}
+
+// Resolves the symlinks in p. The part of p that does not exist yet, like
+// the name of a file being created, is joined back onto its deepest existing
+// directory. A dangling symlink cannot be resolved and is an error.
+func resolvePath(p string) (string, error) {
+
+	var missing []string
+
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// Something is there, so it is a link to nowhere
+		if _, lerr := os.Lstat(p); lerr == nil {
+			return "", err
+		}
+
+		parent := filepath.Dir(p)
+
+		if parent == p {
+			return "", err
+		}
+
+		missing = append([]string{filepath.Base(p)}, missing...)
+		p = parent
+	}
+}
+
+// Checks that every path a request touches lies in an export
+func (a *agent) isExported(req *Packet) bool {
+
+	a.exportsMu.RLock()
+	defer a.exportsMu.RUnlock()
+
+	if len(a.exports) == 0 {
+		return true
+	}
+
+	for _, p := range requestPaths(req.Data) {
+
+		// A symlink inside an export can point anywhere, so the check is
+		// made on the path it leads to
+		resolved, err := resolvePath(path.Clean(p))
+
+		if err != nil {
+			return false
+		}
+
+		exported := false
+		remotePath := &RemotePath{Path: resolved}
+
+		for _, export := range a.exports {
+			if (&RemotePath{Path: export}).Contains(remotePath) {
+				exported = true
+				break
+			}
+		}
+
+		if !exported {
+			return false
+		}
+	}
+
+	return true
+}
+
+func requestPaths(data Payload) []string {
+	switch info := data.(type) {
+	case *RemotePath:
+		return []string{info.Path}
+	case *ReadDirInfo:
+		return []string{info.Path}
+	case *ReadInfo:
+		return []string{info.Path}
+	case *WriteInfo:
+		return []string{info.Path}
+	case *AttrInfo:
+		return []string{info.Path}
+	case *CreateInfo:
+		return []string{path.Join(info.BaseDir, info.Name)}
+	case *RenameInfo:
+		return []string{info.Path, info.DestPath}
+	case *CopyInfo:
+		return []string{info.Path, info.DestPath}
+	case *AllocateInfo:
+		return []string{info.Path}
+	case *OpenInfo:
+		return []string{info.Path}
+	case *CloseInfo:
+		return []string{info.Path}
+	}
+
+	return nil
+}
+
 func populateResponse(resp *Packet, data Payload, err error) {
 
 	if err == nil {
 		resp.Data = data
 	} else {
+		// Callers decode by op code so failures always travel as errors
+		resp.Op = ErrorResponse
 		resp.Data = &Error{
 			Err: err,
 		}
@@ -50,7 +204,13 @@ func populateResponse(resp *Packet, data Payload, err error) {
 	resp.Flags = 1
 }
 
-func (a *agent) ProcessRequest(req *Packet) {
+// Handles req and answers on conn, the connection it arrived on
+func (a *agent) ProcessRequest(index uint8, conn Conn, req *Packet) {
+	AgentTalker().SendPacket(index, conn, a.handle(req))
+}
+
+// Serves req and returns the response to it
+func (a *agent) handle(req *Packet) *Packet {
 
 	resp := &Packet{
 		Id:     req.Id,
@@ -61,6 +221,20 @@ func (a *agent) ProcessRequest(req *Packet) {
 	var data Payload
 	var err error
 
+	if !a.isExported(req) {
+		zap.L().Warn("Request Outside Exports",
+			zap.String("op", ConvertOpCodeToString(req.Op)),
+			zap.Strings("paths", requestPaths(req.Data)),
+		)
+
+		populateResponse(resp, nil, syscall.EACCES)
+		return resp
+	}
+
+	// File data waits under the memory ceiling, metadata is served at once
+	taken := a.memory.acquire(a.requestBytes(req))
+	defer a.memory.release(taken)
+
 	switch req.Op {
 
 	case AttrRequest:
@@ -107,21 +281,78 @@ func (a *agent) ProcessRequest(req *Packet) {
 	case CloseRequest:
 		resp.Op = ErrorResponse
 		err = AgentFileHandler().CloseFile(req)
+	case CopyRequest:
+		resp.Op = ErrorResponse
+		err = AgentFileHandler().CopyFile(req)
+	case AllocateRequest:
+		resp.Op = ErrorResponse
+		err = AgentFileHandler().Allocate(req)
+	case StatfsRequest:
+		resp.Op = FsStatResponse
+		data, err = AgentFileHandler().Statfs(req)
+	case BatchRequest:
+		resp.Op = BatchResponse
+		data = a.batch(req.Data.(*Batch))
+	default:
+		// Ops this agent does not know
+		err = syscall.ENOSYS
 	}
 
 	populateResponse(resp, data, err)
 
-	AgentTalker().SendPacket(resp)
+	return resp
+}
+
+// Serves the requests of b one after the other, a later request may rely
+// on what an earlier one did
+func (a *agent) batch(b *Batch) *Batch {
+
+	resps := &Batch{
+		Packets: make([]*Packet, 0, len(b.Packets)),
+	}
+
+	for _, req := range b.Packets {
 
+		// Hellos only open a connection
+		if req.Op == HelloRequest || !req.IsRequest() {
+			resp := &Packet{
+				Id:     req.Id,
+				ConnId: req.ConnId,
+			}
+
+			populateResponse(resp, nil, syscall.EINVAL)
+			resps.Packets = append(resps.Packets, resp)
+			continue
+		}
+
+		resps.Packets = append(resps.Packets, a.handle(req))
+	}
+
+	return resps
 }
 
 func StartAgent(address string, port uint16) {
+	ServeAgent(&AgentConfig{
+		Address: address,
+		Port:    port,
+	})
+}
+
+func ServeAgent(cfg *AgentConfig) {
 
 	zap.L().Info("Starting Agent",
-		zap.String("address", address),
-		zap.Uint16("port", port),
+		zap.String("address", cfg.Address),
+		zap.Uint16("port", cfg.Port),
+		zap.String("transport", cfg.Transport),
+		zap.Strings("exports", cfg.Exports),
+		zap.Bool("tls", cfg.TLS != nil),
 	)
 
-	AgentTalker().Startup(address, port)
+	agentConfig = cfg
+	reloadOnHangup(ReloadAgentConfig)
+
+	Agent().SetExports(cfg.Exports)
+	Agent().SetMemoryLimit(cfg.MemoryLimit)
+	AgentTalker().Startup(cfg)
 
 }
@@ -26,6 +26,7 @@ import (
 	"path"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -75,12 +76,7 @@ func (fh *agentFileHandler) Attr(request *Packet) (*Stat, error) {
 	info, err := os.Lstat(filePath)
 
 	if err == nil {
-		s := &Stat{}
-		s.Name = info.Name()
-		s.Size = info.Size()
-		s.Mode = info.Mode()
-		s.ModTime = info.ModTime().UnixNano()
-		s.IsDir = info.IsDir()
+		s := convertFileInfo(info)
 
 		zap.L().Debug("Attr Response",
 			zap.String("op", "attr"),
@@ -111,6 +107,27 @@ func (fh *agentFileHandler) Attr(request *Packet) (*Stat, error) {
 
 }
 
+func convertFileInfo(info os.FileInfo) *Stat {
+	s := &Stat{}
+
+	s.Name = info.Name()
+	s.Size = info.Size()
+	s.Mode = info.Mode()
+	s.ModTime = info.ModTime().UnixNano()
+	s.IsDir = info.IsDir()
+
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		s.Dev = uint64(sys.Dev)
+		s.Ino = uint64(sys.Ino)
+		s.ATime, s.CTime, s.CrTime = statTimes(sys)
+	} else {
+		s.ATime = s.ModTime
+		s.CTime = s.ModTime
+	}
+
+	return s
+}
+
 func (fh *agentFileHandler) convertReadDirOutput(files []os.FileInfo, err error) (*DirInfo, error) {
 	if err == nil {
 
@@ -118,17 +135,7 @@ func (fh *agentFileHandler) convertReadDirOutput(files []os.FileInfo, err error)
 		dirInfo := &DirInfo{}
 
 		for _, file := range files {
-
-			s := &Stat{}
-
-			s.Name = file.Name()
-			s.Size = file.Size()
-			s.Mode = file.Mode()
-			s.ModTime = file.ModTime().UnixNano()
-			s.IsDir = file.IsDir()
-
-			stats = append(stats, s)
-
+			stats = append(stats, convertFileInfo(file))
 		}
 
 		dirInfo.Stats = stats
@@ -251,25 +258,19 @@ func (fh *agentFileHandler) FetchFile(request *Packet) (*FileChunk, error) {
 		zap.String("path", filePath),
 	)
 
-	data, err := ioutil.ReadFile(filePath)
+	fileChunk, err := fh.fetchSparse(filePath)
 
 	if err == nil {
 
-		fileChunk := &FileChunk{
-			Chunk: data,
-			Size:  len(data),
-		}
-
-		//fileChunk.Compress()
-
 		zap.L().Debug("Fetch Response",
 			zap.String("op", "fetch"),
 			zap.Uint8("conn_id", request.ConnId),
 			zap.Bool("request", request.IsRequest()),
 			zap.Uint64("id", request.Id),
 			zap.String("path", filePath),
-			zap.Int("size", len(data)),
-			zap.Int("compressed_size", len(fileChunk.Chunk)),
+			zap.Int("size", fileChunk.Size),
+			zap.Int("extents", len(fileChunk.Extents)),
+			zap.Int("data_size", len(fileChunk.Chunk)),
 		)
 
 		return fileChunk, err
@@ -291,6 +292,25 @@ func (fh *agentFileHandler) FetchFile(request *Packet) (*FileChunk, error) {
 	return nil, err
 }
 
+func (fh *agentFileHandler) fetchSparse(filePath string) (*FileChunk, error) {
+
+	f, err := os.Open(filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return readSparse(f, info.Size())
+}
+
 func (fh *agentFileHandler) ReadFile(request *Packet) (*FileChunk, error) {
 	readInfo := request.Data.(*ReadInfo)
 	filePath := readInfo.Path
@@ -321,8 +341,6 @@ func (fh *agentFileHandler) ReadFile(request *Packet) (*FileChunk, error) {
 				Size:  n,
 			}
 
-			//fileChunk.Compress()
-
 			zap.L().Debug("Read Response",
 				zap.String("op", "read"),
 				zap.Uint8("conn_id", request.ConnId),
@@ -333,7 +351,6 @@ func (fh *agentFileHandler) ReadFile(request *Packet) (*FileChunk, error) {
 				zap.Int("size", readInfo.Size),
 				zap.Int64("offset", readInfo.Offset),
 				zap.Int("chunk_size", n),
-				zap.Int("compressed_size", len(fileChunk.Chunk)),
 			)
 
 			return fileChunk, nil
@@ -397,11 +414,14 @@ func (fh *agentFileHandler) WriteFile(request *Packet) (*WriteResult, error) {
 
 		if err == nil {
 
-			s, _ := os.Lstat(filePath)
+			info, _ := f.Stat()
+			s := convertFileInfo(info)
 
 			result := &WriteResult{
 				Size:     n,
-				FileSize: s.Size(),
+				FileSize: s.Size,
+				ModTime:  s.ModTime,
+				CTime:    s.CTime,
 			}
 
 			zap.L().Debug("Write Response",
@@ -414,7 +434,7 @@ func (fh *agentFileHandler) WriteFile(request *Packet) (*WriteResult, error) {
 				zap.Int64("offset", writeInfo.Offset),
 				zap.Int("size", len(writeInfo.Data)),
 				zap.Int("written", n),
-				zap.Int64("file_size", s.Size()),
+				zap.Int64("file_size", s.Size),
 			)
 
 			return result, nil
@@ -474,13 +494,13 @@ func (fh *agentFileHandler) SetAttr(request *Packet) error {
 		err = os.Truncate(filePath, int64(attrInfo.Size))
 	}
 
-	if attrInfo.Valid.Mode() {
+	if err == nil && attrInfo.Valid.Mode() {
 		err = os.Chmod(filePath, attrInfo.Mode)
 	}
 
-	// Assuming both are set at same time
-	if attrInfo.Valid.Atime() || attrInfo.Valid.Mtime() {
-		err = os.Chtimes(filePath, time.Unix(0, attrInfo.ATime), time.Unix(0, attrInfo.MTime))
+	if err == nil && (attrInfo.Valid.Atime() || attrInfo.Valid.Mtime() ||
+		attrInfo.Valid.AtimeNow() || attrInfo.Valid.MtimeNow()) {
+		err = setTimes(filePath, attrInfo)
 	}
 
 	if err != nil {
@@ -505,6 +525,36 @@ func (fh *agentFileHandler) SetAttr(request *Packet) error {
 	return err
 }
 
+// Applies the times marked valid, keeping the other as it is on disk (UTIME_OMIT)
+// and using this host's clock for UTIME_NOW
+func setTimes(filePath string, attrInfo *AttrInfo) error {
+
+	info, err := os.Lstat(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	s := convertFileInfo(info)
+	atime := time.Unix(0, s.ATime)
+	mtime := time.Unix(0, s.ModTime)
+	now := time.Now()
+
+	if attrInfo.Valid.AtimeNow() {
+		atime = now
+	} else if attrInfo.Valid.Atime() {
+		atime = time.Unix(0, attrInfo.ATime)
+	}
+
+	if attrInfo.Valid.MtimeNow() {
+		mtime = now
+	} else if attrInfo.Valid.Mtime() {
+		mtime = time.Unix(0, attrInfo.MTime)
+	}
+
+	return os.Chtimes(filePath, atime, mtime)
+}
+
 func (fh *agentFileHandler) CreateFile(request *Packet) error {
 	createInfo := request.Data.(*CreateInfo)
 	filePath := path.Join(createInfo.BaseDir, createInfo.Name)
@@ -696,3 +746,187 @@ func (fh *agentFileHandler) CloseFile(request *Packet) error {
 
 	return os.ErrInvalid
 }
+
+func (fh *agentFileHandler) CopyFile(request *Packet) error {
+	copyInfo := request.Data.(*CopyInfo)
+
+	zap.L().Debug("Processing Copy Request",
+		zap.String("op", "copy"),
+		zap.Uint8("conn_id", request.ConnId),
+		zap.Bool("request", request.IsRequest()),
+		zap.Uint64("id", request.Id),
+		zap.String("path", copyInfo.Path),
+		zap.String("dest_path", copyInfo.DestPath),
+	)
+
+	reflinked, err := copyFile(copyInfo.Path, copyInfo.DestPath)
+
+	if err != nil {
+		err = ConvertErr(err)
+
+		zap.L().Warn("Copy Error Response",
+			zap.String("op", "copy"),
+			zap.Uint8("conn_id", request.ConnId),
+			zap.Bool("request", request.IsRequest()),
+			zap.Uint64("id", request.Id),
+			zap.String("path", copyInfo.Path),
+			zap.String("dest_path", copyInfo.DestPath),
+			zap.Error(err),
+		)
+
+		return err
+	}
+
+	zap.L().Debug("Copy Response",
+		zap.String("op", "copy"),
+		zap.Uint8("conn_id", request.ConnId),
+		zap.Bool("request", request.IsRequest()),
+		zap.Uint64("id", request.Id),
+		zap.String("path", copyInfo.Path),
+		zap.String("dest_path", copyInfo.DestPath),
+		zap.Bool("reflink", reflinked),
+	)
+
+	return nil
+}
+
+// Copies src to dest on the local disk, sharing extents with a reflink when
+// the filesystem supports it and falling back to a regular copy otherwise.
+// The copy is written beside dest and renamed over it once complete so that
+// a failure leaves an existing dest as it was.
+func copyFile(src string, dest string) (bool, error) {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if info.IsDir() {
+		return false, syscall.EISDIR
+	}
+
+	// Copying a file onto itself, through another name or not
+	if destInfo, err := os.Stat(dest); err == nil && os.SameFile(info, destInfo) {
+		return false, syscall.EINVAL
+	}
+
+	out, err := ioutil.TempFile(path.Dir(dest), "."+path.Base(dest)+".ifs-")
+	if err != nil {
+		return false, err
+	}
+
+	reflinked := true
+	err = reflink(out, in)
+
+	if err != nil {
+		// io.Copy uses copy_file_range where the kernel has it
+		reflinked = false
+		_, err = io.Copy(out, in)
+	}
+
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(out.Name(), dest)
+	}
+
+	if err != nil {
+		os.Remove(out.Name())
+		return false, err
+	}
+
+	return reflinked, nil
+}
+
+func (fh *agentFileHandler) Allocate(request *Packet) error {
+	allocateInfo := request.Data.(*AllocateInfo)
+
+	zap.L().Debug("Processing Allocate Request",
+		zap.String("op", "allocate"),
+		zap.Uint8("conn_id", request.ConnId),
+		zap.Bool("request", request.IsRequest()),
+		zap.Uint64("id", request.Id),
+		zap.String("path", allocateInfo.Path),
+		zap.Uint64("fd", allocateInfo.FileDescriptor),
+		zap.Uint32("mode", allocateInfo.Mode),
+		zap.Int64("offset", allocateInfo.Offset),
+		zap.Int64("length", allocateInfo.Length),
+	)
+
+	err := os.ErrInvalid
+
+	if val, ok := fh.Opened.Get(strconv.FormatUint(allocateInfo.FileDescriptor, 10)); ok {
+		f := val.(*os.File)
+		err = fallocate(f, allocateInfo.Mode, allocateInfo.Offset, allocateInfo.Length)
+	}
+
+	if err != nil {
+		err = ConvertErr(err)
+
+		zap.L().Warn("Allocate Error Response",
+			zap.String("op", "allocate"),
+			zap.Uint8("conn_id", request.ConnId),
+			zap.Bool("request", request.IsRequest()),
+			zap.Uint64("id", request.Id),
+			zap.String("path", allocateInfo.Path),
+			zap.Uint64("fd", allocateInfo.FileDescriptor),
+			zap.Uint32("mode", allocateInfo.Mode),
+			zap.Int64("offset", allocateInfo.Offset),
+			zap.Int64("length", allocateInfo.Length),
+			zap.Error(err),
+		)
+	}
+
+	return err
+}
+
+func (fh *agentFileHandler) Statfs(request *Packet) (*FsStat, error) {
+	remotePath := request.Data.(*RemotePath)
+
+	zap.L().Debug("Processing Statfs Request",
+		zap.String("op", "statfs"),
+		zap.Uint8("conn_id", request.ConnId),
+		zap.Bool("request", request.IsRequest()),
+		zap.Uint64("id", request.Id),
+		zap.String("path", remotePath.Path),
+	)
+
+	var st syscall.Statfs_t
+	err := syscall.Statfs(remotePath.Path, &st)
+
+	if err != nil {
+		err = ConvertErr(err)
+
+		zap.L().Warn("Statfs Error Response",
+			zap.String("op", "statfs"),
+			zap.Uint8("conn_id", request.ConnId),
+			zap.Bool("request", request.IsRequest()),
+			zap.Uint64("id", request.Id),
+			zap.String("path", remotePath.Path),
+			zap.Error(err),
+		)
+
+		return nil, err
+	}
+
+	// Field types differ between platforms
+	bsize := uint64(st.Bsize)
+
+	return &FsStat{
+		Total: uint64(st.Blocks) * bsize,
+		Free:  uint64(st.Bfree) * bsize,
+		Avail: uint64(st.Bavail) * bsize,
+	}, nil
+}
@@ -19,9 +19,16 @@ limitations under the License.
 package ifs_test
 
 import (
+	"bazil.org/fuse"
 	"github.com/chemistry-sourabh/ifs"
 	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // TODO Check for specific errors
@@ -49,6 +56,10 @@ func TestAttr(t *testing.T) {
 		t.Error("Got Wrong Stats", s)
 	}
 
+	if s.Ino == 0 {
+		t.Error("Got No Inode", s)
+	}
+
 }
 
 func TestAttr2(t *testing.T) {
@@ -483,3 +494,316 @@ func TestReadFile5(t *testing.T) {
 
 	fh.CloseFile(pkt)
 }
+
+func TestCopyFile(t *testing.T) {
+
+	CreateTempFile("file1")
+	defer RemoveTempFile("file1")
+	defer RemoveTempFile("file2")
+
+	data := WriteDummyData("file1", 1000)
+
+	payload := &ifs.CopyInfo{
+		Path:     "/tmp/file1",
+		DestPath: "/tmp/file2",
+	}
+
+	pkt := CreatePacket(ifs.CopyRequest, payload)
+
+	fh := ifs.AgentFileHandler()
+	err := fh.CopyFile(pkt)
+
+	Ok(t, err)
+
+	copied, err := ioutil.ReadFile("/tmp/file2")
+
+	Ok(t, err)
+	Compare(t, copied, data)
+}
+
+func TestCopyFile2(t *testing.T) {
+
+	payload := &ifs.CopyInfo{
+		Path:     "/tmp/file1",
+		DestPath: "/tmp/file2",
+	}
+
+	pkt := CreatePacket(ifs.CopyRequest, payload)
+
+	fh := ifs.AgentFileHandler()
+	err := fh.CopyFile(pkt)
+
+	Err(t, err)
+
+	_, err = os.Stat("/tmp/file2")
+
+	Err(t, err)
+}
+
+func TestFetchFile3(t *testing.T) {
+
+	CreateTempFile("file1")
+	defer RemoveTempFile("file1")
+
+	size := 2 * 1024 * 1024
+	data := make([]byte, size)
+	copy(data, "head")
+	copy(data[size/2:], "middle")
+
+	f, _ := os.OpenFile("/tmp/file1", os.O_WRONLY, 0666)
+	f.Truncate(int64(size))
+	f.WriteAt([]byte("head"), 0)
+	f.WriteAt([]byte("middle"), int64(size/2))
+	f.Close()
+
+	payload := &ifs.RemotePath{
+		Hostname: "localhost",
+		Port:     11211,
+		Path:     "/tmp/file1",
+	}
+
+	pkt := CreatePacket(ifs.FetchFileRequest, payload)
+
+	fh := ifs.AgentFileHandler()
+	chunk, err := fh.FetchFile(pkt)
+
+	Ok(t, err)
+	Compare(t, chunk.Size, size)
+
+	// Filesystems without SEEK_DATA send the whole file
+	got := chunk.Chunk
+	if chunk.Extents != nil {
+		got = make([]byte, chunk.Size)
+		start := int64(0)
+		for _, extent := range chunk.Extents {
+			copy(got[extent.Offset:], chunk.Chunk[start:start+extent.Length])
+			start += extent.Length
+		}
+	}
+
+	Compare(t, got, data)
+}
+
+// A file that is only a hole keeps its size on the way to the cache
+func TestFetchFile4(t *testing.T) {
+
+	CreateTempFile("file1")
+	defer RemoveTempFile("file1")
+	defer RemoveTempFile("file2")
+
+	size := 1024 * 1024
+	Ok(t, os.Truncate("/tmp/file1", int64(size)))
+
+	pkt := CreatePacket(ifs.FetchFileRequest, &ifs.RemotePath{
+		Hostname: "localhost",
+		Port:     11211,
+		Path:     "/tmp/file1",
+	})
+
+	chunk, err := ifs.AgentFileHandler().FetchFile(pkt)
+
+	Ok(t, err)
+	Compare(t, chunk.Size, size)
+
+	// Empty extents do not survive the wire
+	data, err := CreatePacket(ifs.FileDataResponse, chunk).Marshal()
+	Ok(t, err)
+
+	got := &ifs.Packet{}
+	Ok(t, got.Unmarshal(data))
+
+	Ok(t, ifs.WriteSparse("/tmp/file2", got.Data.(*ifs.FileChunk)))
+
+	written, err := ioutil.ReadFile("/tmp/file2")
+	Ok(t, err)
+	Compare(t, written, make([]byte, size))
+}
+
+// Extents that do not describe the chunk are refused before the file is
+// touched
+func TestWriteSparse_Invalid(t *testing.T) {
+
+	defer RemoveTempFile("file2")
+
+	chunks := []*ifs.FileChunk{
+		{Chunk: []byte("data"), Size: -1},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: -4, Length: 4}}},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: 0, Length: -4}, {Offset: 4, Length: 8}}},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: 8, Length: 2}, {Offset: 0, Length: 2}}},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: 0, Length: 3}, {Offset: 2, Length: 1}}},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: 14, Length: 4}}},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: 0, Length: 2}}},
+		{Chunk: []byte("data"), Size: 16, Extents: []*ifs.Extent{{Offset: 0, Length: 8}}},
+	}
+
+	for _, chunk := range chunks {
+		Ok(t, ioutil.WriteFile("/tmp/file2", []byte("cached"), 0644))
+
+		err := ifs.WriteSparse("/tmp/file2", chunk)
+		Compare(t, err == syscall.EIO, true)
+
+		written, _ := ioutil.ReadFile("/tmp/file2")
+		Compare(t, string(written), "cached")
+	}
+
+	Ok(t, ifs.WriteSparse("/tmp/file2", &ifs.FileChunk{
+		Chunk:   []byte("data"),
+		Size:    16,
+		Extents: []*ifs.Extent{{Offset: 2, Length: 2}, {Offset: 12, Length: 2}},
+	}))
+
+	written, err := ioutil.ReadFile("/tmp/file2")
+	Ok(t, err)
+	Compare(t, string(written), "\x00\x00da\x00\x00\x00\x00\x00\x00\x00\x00ta\x00\x00")
+}
+
+func TestAllocate(t *testing.T) {
+
+	CreateTempFile("file1")
+	defer RemoveTempFile("file1")
+
+	fh := ifs.AgentFileHandler()
+
+	openInfo := &ifs.OpenInfo{
+		Path:           "/tmp/file1",
+		FileDescriptor: 1,
+		Flags:          fuse.OpenReadWrite,
+	}
+
+	fh.OpenFile(CreatePacket(ifs.OpenRequest, openInfo))
+
+	allocateInfo := &ifs.AllocateInfo{
+		Path:           "/tmp/file1",
+		FileDescriptor: 1,
+		Offset:         0,
+		Length:         8192,
+	}
+
+	err := fh.Allocate(CreatePacket(ifs.AllocateRequest, allocateInfo))
+
+	Ok(t, err)
+
+	info, _ := os.Stat("/tmp/file1")
+	Compare(t, info.Size(), int64(8192))
+
+	closeInfo := &ifs.CloseInfo{
+		Path:           "/tmp/file1",
+		FileDescriptor: 1,
+	}
+
+	fh.CloseFile(CreatePacket(ifs.CloseRequest, closeInfo))
+}
+
+func TestAllocate2(t *testing.T) {
+
+	allocateInfo := &ifs.AllocateInfo{
+		Path:           "/tmp/file1",
+		FileDescriptor: 1,
+		Length:         8192,
+	}
+
+	fh := ifs.AgentFileHandler()
+	err := fh.Allocate(CreatePacket(ifs.AllocateRequest, allocateInfo))
+
+	Err(t, err)
+}
+
+func TestStatfs(t *testing.T) {
+
+	fh := ifs.AgentFileHandler()
+	st, err := fh.Statfs(CreatePacket(ifs.StatfsRequest, &ifs.RemotePath{Path: "/tmp"}))
+
+	Ok(t, err)
+	Compare(t, st.Total > 0, true)
+	Compare(t, st.Avail <= st.Total, true)
+
+	_, err = fh.Statfs(CreatePacket(ifs.StatfsRequest, &ifs.RemotePath{Path: "/tmp/missing"}))
+	Err(t, err)
+}
+
+func TestSetAttrTimes(t *testing.T) {
+
+	CreateTempFile("file1")
+	defer RemoveTempFile("file1")
+
+	atime := time.Unix(1000, 500)
+	mtime := time.Unix(2000, 700)
+	os.Chtimes("/tmp/file1", atime, mtime)
+
+	// Only mtime is set, atime must be left alone
+	newMtime := time.Unix(3000, 900)
+
+	payload := &ifs.AttrInfo{
+		Path:  "/tmp/file1",
+		Valid: fuse.SetattrMtime,
+		MTime: newMtime.UnixNano(),
+	}
+
+	fh := ifs.AgentFileHandler()
+	err := fh.SetAttr(CreatePacket(ifs.SetAttrRequest, payload))
+
+	Ok(t, err)
+
+	s, err := fh.Attr(CreatePacket(ifs.AttrRequest, &ifs.RemotePath{Path: "/tmp/file1"}))
+
+	Ok(t, err)
+	Compare(t, s.ModTime, newMtime.UnixNano())
+	Compare(t, s.ATime, atime.UnixNano())
+
+	if s.CTime == 0 {
+		t.Error("Got No Ctime", s)
+	}
+}
+
+// A copy onto the source itself must not truncate it
+func TestCopyFile3(t *testing.T) {
+
+	CreateTempFile("file1")
+	defer RemoveTempFile("file1")
+	defer os.Remove("/tmp/file1_link")
+
+	data := WriteDummyData("file1", 1000)
+	Ok(t, os.Link("/tmp/file1", "/tmp/file1_link"))
+
+	for _, dest := range []string{"/tmp/file1", "/tmp/file1_link"} {
+
+		pkt := CreatePacket(ifs.CopyRequest, &ifs.CopyInfo{
+			Path:     "/tmp/file1",
+			DestPath: dest,
+		})
+
+		Err(t, ifs.AgentFileHandler().CopyFile(pkt))
+
+		got, err := ioutil.ReadFile("/tmp/file1")
+		Ok(t, err)
+		Compare(t, got, data)
+	}
+}
+
+// A copy failing part way leaves an existing destination alone
+func TestCopyFile4(t *testing.T) {
+
+	// Opens as a regular file and fails on the first read
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc/self/mem")
+	}
+
+	defer RemoveTempFile("file2")
+
+	data := WriteDummyData("file2", 100)
+
+	pkt := CreatePacket(ifs.CopyRequest, &ifs.CopyInfo{
+		Path:     "/proc/self/mem",
+		DestPath: "/tmp/file2",
+	})
+
+	Err(t, ifs.AgentFileHandler().CopyFile(pkt))
+
+	got, err := ioutil.ReadFile("/tmp/file2")
+	Ok(t, err)
+	Compare(t, got, data)
+
+	// Nothing left behind beside the destination
+	matches, _ := filepath.Glob("/tmp/.file2.ifs-*")
+	Compare(t, len(matches), 0)
+}
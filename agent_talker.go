@@ -17,18 +17,23 @@ limitations under the License.
 package ifs
 
 import (
-	"github.com/gorilla/websocket"
+	"crypto/tls"
+	"fmt"
 	"go.uber.org/zap"
-	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 )
 
 type agentTalker struct {
 	IdCounter uint64
 	Pool      *AgentConnectionPool
+
+	// Holds a *tls.Certificate that can be swapped while serving
+	certificate atomic.Value
 }
 
 var (
@@ -46,49 +51,163 @@ func AgentTalker() *agentTalker {
 	return agentTalkerInstance
 }
 
-func (t *agentTalker) Startup(address string, port uint16) {
+func (t *agentTalker) Startup(cfg *AgentConfig) {
+
+	transport, ok := GetTransport(cfg.Transport)
+
+	if !ok {
+		zap.L().Fatal("Unknown Transport",
+			zap.String("transport", cfg.Transport),
+		)
+	}
+
+	var tlsConfig *tls.Config
+	var err error
+
+	if cfg.TLS != nil {
+		err = t.LoadCertificate(cfg.TLS)
+		tlsConfig = &tls.Config{
+			GetCertificate: t.getCertificate,
+		}
+	}
+
+	// A socket left behind by an agent that crashed
+	if err == nil && transport.Name() == TransportUnix {
+		err = removeStaleSocket(cfg.ListenAddress())
+	}
 
-	http.HandleFunc("/", t.HandleRequests)
-	err := http.ListenAndServe(address+":"+strconv.FormatInt(int64(port), 10), nil)
+	var listener Listener
+
+	if err == nil {
+		listener, err = transport.Listen(cfg.ListenAddress(), tlsConfig)
+	}
 
 	if err != nil {
-		zap.L().Fatal("Listen and Serve Failed",
+		zap.L().Fatal("Listen Failed",
 			zap.Error(err),
 		)
 	}
 
+	zap.L().Info("Agent Listening",
+		zap.String("transport", transport.Name()),
+		zap.String("address", listener.Addr().String()),
+	)
+
+	t.Serve(listener)
+}
+
+// Removes the socket at socketPath so that it can be listened on again,
+// anything else there is left alone and fails the startup
+func removeStaleSocket(socketPath string) error {
+
+	info, err := os.Lstat(socketPath)
+
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", socketPath)
+	}
+
+	return os.Remove(socketPath)
 }
 
-func (t *agentTalker) processSendingChannel(index uint8) {
+// Accepts connections until listener is closed
+func (t *agentTalker) Serve(listener Listener) {
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			zap.L().Info("Stopped Accepting Connections",
+				zap.Error(err),
+			)
+			return
+		}
+
+		t.HandleConn(conn)
+	}
+}
+
+// Loads the key pair used for new TLS connections
+func (t *agentTalker) LoadCertificate(tlsCfg *TLSConfig) error {
+
+	cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+
+	if err == nil {
+		t.certificate.Store(&cert)
+	}
+
+	return err
+}
+
+func (t *agentTalker) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return t.certificate.Load().(*tls.Certificate), nil
+}
+
+// Writes the packets queued for conn until its slot is freed
+func (t *agentTalker) processSendingChannel(index uint8, conn Conn, pktChan chan *Packet, done chan struct{}) {
 
 	zap.L().Debug("Starting Egress Processor",
 		zap.Uint8("index", index),
 	)
 
-	val, _ := t.Pool.SendingChannels.Get(strconv.FormatUint(uint64(index), 10))
-	pktChan := val.(chan *Packet)
-	for pkt := range pktChan {
+	for {
+
+		var pkt *Packet
+
+		select {
+		case pkt = <-pktChan:
+		case <-done:
+			return
+		}
 
 		if pkt.IsRequest() {
 			pkt.Id = atomic.AddUint64(&t.IdCounter, 1)
 			pkt.ConnId = index
 		}
 
+		// File data is only compressed here, so this is where its size on
+		// the wire is known
+		saved := pkt.Compress(t.Pool.Compressor(index))
+		data, _ := pkt.Encode(t.Pool.Codec(index))
+
 		zap.L().Debug("Sending Packet",
 			zap.Uint8("index", index),
 			zap.String("op", strings.ToLower(ConvertOpCodeToString(pkt.Op))),
 			zap.Uint8("conn_id", pkt.ConnId),
 			zap.Bool("request", pkt.IsRequest()),
 			zap.Uint64("id", pkt.Id),
+			zap.Int("frame_size", len(data)),
+			zap.Int64("compression_saved", saved),
 		)
 
-		data, _ := pkt.Marshal()
-		val, _ := t.Pool.Connections.Get(strconv.FormatUint(uint64(index), 10))
-		conn := val.(*websocket.Conn)
-		err := conn.WriteMessage(websocket.BinaryMessage, data)
+		err := conn.WriteFrame(data)
 
+		// A response too big for a frame is answered with an error in its
+		// place, the client would wait for it forever otherwise
+		if err == ErrFrameTooLarge && !pkt.IsRequest() {
+			zap.L().Warn("Response Too Large",
+				zap.Uint8("index", index),
+				zap.String("op", strings.ToLower(ConvertOpCodeToString(pkt.Op))),
+				zap.Uint64("id", pkt.Id),
+				zap.Int("size", len(data)),
+			)
+
+			resp := &Packet{Id: pkt.Id, ConnId: pkt.ConnId}
+			populateResponse(resp, nil, syscall.EFBIG)
+
+			data, _ = resp.Encode(t.Pool.Codec(index))
+			err = conn.WriteFrame(data)
+		}
+
+		// The client fails requests on a connection that went away
 		if err != nil {
-			zap.L().Fatal("Write Message Failed",
+			zap.L().Warn("Write Message Failed",
+				zap.Uint8("index", index),
 				zap.Error(err),
 			)
 		}
@@ -96,10 +215,7 @@ func (t *agentTalker) processSendingChannel(index uint8) {
 	}
 }
 
-func (t *agentTalker) Listen(index uint8) {
-
-	val, _ := t.Pool.Connections.Get(strconv.FormatUint(uint64(index), 10))
-	conn := val.(*websocket.Conn)
+func (t *agentTalker) Listen(index uint8, conn Conn) {
 
 	for {
 
@@ -109,7 +225,7 @@ func (t *agentTalker) Listen(index uint8) {
 			zap.String("address", conn.RemoteAddr().String()),
 		)
 
-		typ, data, err := conn.ReadMessage()
+		data, err := conn.ReadFrame()
 
 		if err != nil {
 			zap.L().Warn("Read Message Failed",
@@ -118,55 +234,156 @@ func (t *agentTalker) Listen(index uint8) {
 			break
 		}
 
-		if typ == websocket.BinaryMessage {
-			req.Unmarshal(data)
+		err = req.Decode(t.Pool.Codec(index), data)
 
-			zap.L().Debug("Received Packet",
+		if err == ErrShortPacket {
+			// Framing is lost, the client has to reconnect
+			zap.L().Warn("Dropping Connection",
 				zap.Uint8("index", index),
-				zap.String("op", strings.ToLower(ConvertOpCodeToString(req.Op))),
-				zap.Uint8("conn_id", req.ConnId),
-				zap.Bool("request", req.IsRequest()),
-				zap.Uint64("id", req.Id),
+				zap.String("address", conn.RemoteAddr().String()),
+				zap.Error(err),
 			)
+			break
+		}
+
+		// File data is restored before anything looks at it
+		if err == nil {
+			_, err = req.Decompress()
+		}
+
+		if err != nil {
+			t.reject(index, conn, req, err)
+			continue
+		}
 
-			go Agent().ProcessRequest(req)
+		zap.L().Debug("Received Packet",
+			zap.Uint8("index", index),
+			zap.String("op", strings.ToLower(ConvertOpCodeToString(req.Op))),
+			zap.Uint8("conn_id", req.ConnId),
+			zap.Bool("request", req.IsRequest()),
+			zap.Uint64("id", req.Id),
+		)
+
+		if req.Op == HelloRequest {
+			t.hello(index, conn, req)
+			continue
 		}
 
+		go Agent().ProcessRequest(index, conn, req)
+
 	}
 
+	conn.Close()
 	t.Pool.Remove(index)
 	AgentFileHandler().CloseAll()
 
 }
 
-func (t *agentTalker) HandleRequests(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
-	upgrader.EnableCompression = true
-	conn, _ := upgrader.Upgrade(w, r, nil)
+// Answers the hello of a client with the one of the agent, both sides then
+// keep to what they have in common
+func (t *agentTalker) hello(index uint8, conn Conn, req *Packet) {
+
+	resp := &Packet{
+		Id:     req.Id,
+		ConnId: req.ConnId,
+		Op:     HelloResponse,
+	}
+
+	common, err := LocalHello().Common(req.Data.(*Hello))
+
+	if err == nil {
+		t.Pool.SetPeer(index, common)
+
+		zap.L().Debug("Handshake Done",
+			zap.Uint8("index", index),
+			zap.Uint16("version", common.Version),
+			zap.Strings("features", common.Features),
+			zap.String("codec", common.Codec().Name()),
+			zap.Strings("compressors", common.Compressors),
+		)
+	} else {
+		zap.L().Warn("Handshake Failed",
+			zap.Uint8("index", index),
+			zap.Error(err),
+		)
+	}
+
+	populateResponse(resp, LocalHello(), err)
+	t.SendPacket(index, conn, resp)
+}
+
+// Answers a request that could not be decoded so that the client is not
+// left waiting, the connection keeps serving
+func (t *agentTalker) reject(index uint8, conn Conn, req *Packet, err error) {
+
+	zap.L().Warn("Rejecting Packet",
+		zap.Uint8("index", index),
+		zap.Uint64("id", req.Id),
+		zap.Uint8("op", req.Op),
+		zap.Error(err),
+	)
+
+	// Responses are never answered, a client does not wait on them
+	if !req.IsRequest() {
+		return
+	}
+
+	var reason error = syscall.EPROTO
+
+	if err == ErrUnknownOp {
+		reason = syscall.ENOSYS
+	}
+
+	resp := &Packet{
+		Id:     req.Id,
+		ConnId: req.ConnId,
+	}
+
+	populateResponse(resp, nil, reason)
+	t.SendPacket(index, conn, resp)
+}
+
+// Takes conn into the pool and starts serving it
+func (t *agentTalker) HandleConn(conn Conn) {
 
 	zap.L().Debug("Got New Connection",
 		zap.String("address", conn.RemoteAddr().String()),
 	)
 
-	i := uint8(t.Pool.Connections.Count())
-
-	conn.SetPingHandler(func(appData string) error {
+	i, ok := t.Pool.Add(conn)
 
-		zap.L().Debug("Got Ping",
-			zap.String("msg", appData),
-			zap.Uint8("index", i),
+	if !ok {
+		zap.L().Warn("Too Many Connections",
+			zap.String("address", conn.RemoteAddr().String()),
 		)
 
-		return nil
-	})
+		conn.Close()
+		return
+	}
 
-	t.Pool.Set(i, conn)
+	val, _ := t.Pool.SendingChannels.Get(strconv.FormatUint(uint64(i), 10))
+	done := t.Pool.Done(i)
 
-	go t.Listen(i)
-	go t.processSendingChannel(i)
+	go t.Listen(i, conn)
+	go t.processSendingChannel(i, conn, val.(chan *Packet), done)
 }
 
-func (t *agentTalker) SendPacket(pkt *Packet) {
-	val, _ := t.Pool.SendingChannels.Get(strconv.FormatUint(uint64(GetRandomIndex(t.Pool.Connections.Count())), 10))
-	val.(chan *Packet) <- pkt
+// Sends pkt on conn through the slot index it holds, dropped when conn is
+// gone so that a late response never reaches another client
+func (t *agentTalker) SendPacket(index uint8, conn Conn, pkt *Packet) {
+
+	err := t.Pool.Send(index, conn, pkt)
+
+	if err == ErrConnStalled {
+		zap.L().Warn("Client Stopped Reading, Dropping Connection",
+			zap.Uint8("index", index),
+			zap.String("address", conn.RemoteAddr().String()),
+		)
+	} else if err != nil {
+		zap.L().Debug("Connection Gone, Dropping Packet",
+			zap.Uint8("index", index),
+			zap.String("op", strings.ToLower(ConvertOpCodeToString(pkt.Op))),
+			zap.Uint64("id", pkt.Id),
+		)
+	}
 }
@@ -0,0 +1,74 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+// Paths are checked against the exports where they lead, not how they read
+func TestAgent_IsExported(t *testing.T) {
+
+	root := path.Join(os.TempDir(), "ifs_exports_"+strconv.Itoa(os.Getpid()))
+	export := path.Join(root, "export")
+	outside := path.Join(root, "outside")
+
+	Ok(t, os.MkdirAll(export, 0755))
+	Ok(t, os.MkdirAll(outside, 0755))
+	defer os.RemoveAll(root)
+
+	WriteDummyDataToPath(path.Join(export, "file"), 1)
+	WriteDummyDataToPath(path.Join(outside, "secret"), 1)
+	Ok(t, os.Symlink(outside, path.Join(export, "escape")))
+	Ok(t, os.Symlink(path.Join(outside, "missing"), path.Join(export, "dangling")))
+	Ok(t, os.Symlink(export, path.Join(root, "alias")))
+
+	ifs.Agent().SetExports([]string{path.Join(root, "alias")})
+	defer ifs.Agent().SetExports(nil)
+
+	paths := map[string]bool{
+		path.Join(export, "file"):              true,
+		path.Join(export, "new", "deeper"):     true,
+		path.Join(root, "alias", "file"):       true,
+		path.Join(export, "escape"):            false,
+		path.Join(export, "escape", "secret"):  false,
+		path.Join(export, "escape", "created"): false,
+		path.Join(export, "dangling"):          false,
+		path.Join(export, "..", "outside"):     false,
+	}
+
+	for p, want := range paths {
+		req := CreatePacket(ifs.AttrRequest, &ifs.RemotePath{Path: p})
+
+		if got := ifs.Agent().IsExported(req); got != want {
+			PrintTestError(t, "wrong export check for "+p, got, want)
+		}
+	}
+
+	// A rename into the link is refused even though its source is exported
+	req := CreatePacket(ifs.RenameRequest, &ifs.RenameInfo{
+		Path:     path.Join(export, "file"),
+		DestPath: path.Join(export, "escape", "file"),
+	})
+	Compare(t, ifs.Agent().IsExported(req), false)
+}
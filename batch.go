@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A batch inside a batch, decoding it would recurse without bound
+var ErrNestedBatch = errors.New("batch inside a batch")
+
+// Requests that travel in one packet, or the responses to them. The agent
+// serves the requests in order and answers each at the same position, an
+// item that fails does not stop the ones after it. Meant for metadata, file
+// data in a batch is not compressed.
+type Batch struct {
+	Packets []*Packet
+}
+
+// Batch as it is sent, every item is a whole packet encoded with the codec
+// of the connection so that it keeps its own op and payload type
+type batchFrames struct {
+	Frames [][]byte `cbor:"1,keyasint,omitempty"`
+}
+
+func isBatch(op uint8) bool {
+	return op == BatchRequest || op == BatchResponse
+}
+
+func (b *Batch) encode(codec Codec) (*batchFrames, error) {
+
+	wire := &batchFrames{
+		Frames: make([][]byte, 0, len(b.Packets)),
+	}
+
+	for _, pkt := range b.Packets {
+
+		if isBatch(pkt.Op) {
+			return nil, ErrNestedBatch
+		}
+
+		frame, err := pkt.Encode(codec)
+
+		if err != nil {
+			return nil, err
+		}
+
+		wire.Frames = append(wire.Frames, frame)
+	}
+
+	return wire, nil
+}
+
+func (wire *batchFrames) decode(codec Codec) (*Batch, error) {
+
+	b := &Batch{
+		Packets: make([]*Packet, 0, len(wire.Frames)),
+	}
+
+	for i, frame := range wire.Frames {
+
+		if len(frame) >= PacketHeaderLength && isBatch(frame[8]) {
+			return nil, ErrNestedBatch
+		}
+
+		pkt := &Packet{}
+
+		if err := pkt.Decode(codec, frame); err != nil {
+			return nil, fmt.Errorf("batch item %d, %s", i, err)
+		}
+
+		b.Packets = append(b.Packets, pkt)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,164 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestBatch_Encode(t *testing.T) {
+
+	batch := &ifs.Batch{
+		Packets: []*ifs.Packet{
+			CreatePacket(ifs.AttrRequest, &ifs.RemotePath{Hostname: "h", Port: 1, Path: "/a"}),
+			CreatePacket(ifs.CreateRequest, &ifs.CreateInfo{BaseDir: "/a", Name: "b", IsDir: true}),
+			CreatePacket(ifs.ReadDirAllRequest, &ifs.RemotePath{Hostname: "h", Port: 1, Path: "/a/b"}),
+		},
+	}
+
+	for _, name := range []string{ifs.CodecMsgpack, ifs.CodecCBOR} {
+
+		codec, _ := ifs.GetCodec(name)
+
+		data, err := CreatePacket(ifs.BatchRequest, batch).Encode(codec)
+		Ok(t, err)
+
+		got := &ifs.Packet{}
+		Ok(t, got.Decode(codec, data))
+
+		Compare(t, got.Data, batch)
+	}
+}
+
+func TestBatch_EncodeResponses(t *testing.T) {
+
+	codec, _ := ifs.GetCodec(ifs.CodecCBOR)
+
+	stat := &ifs.Stat{Name: "a", Size: 10, Ino: 3}
+
+	data, err := CreatePacket(ifs.BatchResponse, &ifs.Batch{
+		Packets: []*ifs.Packet{
+			{Id: 0, Flags: 1, Op: ifs.StatResponse, Data: stat},
+			{Id: 1, Flags: 1, Op: ifs.ErrorResponse, Data: &ifs.Error{Err: syscall.ENOENT}},
+		},
+	}).Encode(codec)
+	Ok(t, err)
+
+	got := &ifs.Packet{}
+	Ok(t, got.Decode(codec, data))
+
+	resps := got.Data.(*ifs.Batch).Packets
+	Compare(t, len(resps), 2)
+	Compare(t, resps[0].Data, stat)
+	Compare(t, resps[1].Id, uint64(1))
+	Compare(t, resps[1].Err().Error(), syscall.ENOENT.Error())
+}
+
+func TestBatch_Nested(t *testing.T) {
+
+	inner := CreatePacket(ifs.BatchRequest, &ifs.Batch{})
+
+	_, err := CreatePacket(ifs.BatchRequest, &ifs.Batch{Packets: []*ifs.Packet{inner}}).Encode(ifs.MsgpackCodec)
+
+	if err != ifs.ErrNestedBatch {
+		PrintTestError(t, "nested batch encoded", err, ifs.ErrNestedBatch)
+	}
+
+	// Built by hand the way a broken peer would send it
+	frame, err := inner.Marshal()
+	Ok(t, err)
+
+	payload, err := ifs.MsgpackCodec.Marshal(struct{ Frames [][]byte }{[][]byte{frame}})
+	Ok(t, err)
+
+	data, err := CreatePacket(ifs.BatchRequest, nil).Marshal()
+	Ok(t, err)
+
+	data = append(data[:ifs.PacketHeaderLength], payload...)
+
+	if err := (&ifs.Packet{}).Unmarshal(data); err != ifs.ErrNestedBatch {
+		PrintTestError(t, "nested batch decoded", err, ifs.ErrNestedBatch)
+	}
+}
+
+// More paths than fit in one batch, the answers come back in order
+func TestBatch_Agent(t *testing.T) {
+
+	dir := path.Join(os.TempDir(), "ifs_batch_"+strconv.Itoa(os.Getpid()))
+	Ok(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	socket := dir + ".sock"
+	defer os.Remove(socket)
+
+	transport, _ := ifs.GetTransport(ifs.TransportUnix)
+
+	listener, err := transport.Listen(socket, nil)
+	Ok(t, err)
+	defer listener.Close()
+
+	go ifs.AgentTalker().Serve(listener)
+
+	ifs.Talker().Startup([]*ifs.RemoteRoot{
+		{
+			Hostname:  "batch",
+			Transport: ifs.TransportUnix,
+			Socket:    socket,
+		},
+	}, 1)
+
+	var remotePaths []*ifs.RemotePath
+
+	for i := 0; i < ifs.BatchMaxOps+2; i++ {
+
+		name := strconv.Itoa(i)
+
+		// Every third file is missing
+		if i%3 != 0 {
+			WriteDummyDataToPath(path.Join(dir, name), i)
+		}
+
+		remotePaths = append(remotePaths, &ifs.RemotePath{
+			Hostname: "batch",
+			Path:     path.Join(dir, name),
+		})
+	}
+
+	resps := ifs.Talker().SendBatched(ifs.AttrRequest, remotePaths)
+	Compare(t, len(resps), len(remotePaths))
+
+	for i, resp := range resps {
+
+		if i%3 == 0 {
+			if resp.Err() == nil || resp.Err().Error() != syscall.ENOENT.Error() {
+				PrintTestError(t, "missing file "+strconv.Itoa(i), resp.Err(), syscall.ENOENT)
+			}
+
+			continue
+		}
+
+		Ok(t, resp.Err())
+		Compare(t, resp.Data.(*ifs.Stat).Size, int64(i))
+	}
+}
@@ -17,28 +17,233 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/chemistry-sourabh/ifs"
+	_ "go.uber.org/automaxprocs"
+	"gopkg.in/urfave/cli.v1"
 	"os"
 )
 
-import _ "go.uber.org/automaxprocs"
+// Flags that override the config file
+var configFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "a, address",
+		Usage: "Address to Listen on",
+	},
+	cli.UintFlag{
+		Name:  "p, port",
+		Usage: "Port to Listen on",
+	},
+	cli.StringSliceFlag{
+		Name:  "export",
+		Usage: "Directory to Serve, can be Repeated",
+	},
+	cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "TLS Certificate File",
+	},
+	cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "TLS Key File",
+	},
+	cli.StringFlag{
+		Name:  "log-level",
+		Usage: "One of off, info or debug",
+	},
+	cli.Uint64Flag{
+		Name:  "memory-limit",
+		Usage: "Megabytes of File Data held by Requests being Served",
+	},
+	cli.StringFlag{
+		Name:  "transport",
+		Usage: "One of websocket, tcp or unix",
+	},
+	cli.StringFlag{
+		Name:  "socket",
+		Usage: "Unix Socket to Listen on",
+	},
+}
 
 func main() {
 
-	cfgPath := "./agent.json"
-	args := os.Args[1:]
+	app := cli.NewApp()
+	app.EnableBashCompletion = true
+	app.Version = "0.1.0"
+	app.Name = "agent"
+	app.HelpName = "agent"
+	app.Usage = "Serves Local Paths to IFS Mounts"
+	app.Flags = append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "c, config",
+			Usage: "Specify the Config File",
+			Value: "./agent.json",
+		},
+	}, configFlags...)
+
+	// Serving is the default so that agent [config] keeps working
+	app.ArgsUsage = "[config]"
+	app.Action = func(c *cli.Context) error {
+		if c.NArg() > 1 {
+			return fmt.Errorf("usage: agent [options] [config]")
+		}
+
+		if c.NArg() == 1 {
+			c.Set("config", c.Args().First())
+		}
+
+		return serve(c)
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "serve",
+			Usage:  "Start the Agent",
+			Flags:  configFlags,
+			Action: serve,
+		},
+		{
+			Name:  "check-config",
+			Usage: "Validate the Config and Print the Effective Config",
+			Flags: configFlags,
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+
+				data, err := json.MarshalIndent(cfg, "", "  ")
+				if err != nil {
+					return err
+				}
+
+				fmt.Println(string(data))
+				return nil
+			},
+		},
+		{
+			Name:  "exports",
+			Usage: "List the Exported Directories",
+			Flags: configFlags,
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+
+				if len(cfg.Exports) == 0 {
+					fmt.Println("/ (no exports configured, everything is served)")
+				}
+
+				for _, export := range cfg.Exports {
+					fmt.Println(export)
+				}
+
+				return nil
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
 
-	if len(args) > 1 {
-		fmt.Printf("usage: agent [config]")
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
-	} else if len(args) == 1 {
-		cfgPath = args[0]
+	}
+}
+
+func serve(c *cli.Context) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
 	}
 
-	cfg := ifs.AgentConfig{}
-	cfg.Load(cfgPath)
+	ifs.SetAgentConfigLoader(func() (*ifs.AgentConfig, error) {
+		return loadConfig(c)
+	})
 
 	ifs.SetupLogger(cfg.Log)
-	ifs.StartAgent(cfg.Address, cfg.Port)
+	ifs.ServeAgent(cfg)
+	return nil
+}
+
+// Loads the config file, applies the flags on top and validates the result.
+// A missing default config file is fine when the flags say enough.
+func loadConfig(c *cli.Context) (*ifs.AgentConfig, error) {
+
+	cfg := &ifs.AgentConfig{}
+	path := c.GlobalString("config")
+
+	err := cfg.Load(path)
+
+	if os.IsNotExist(err) && !c.GlobalIsSet("config") {
+		err = cfg.LoadEnv()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := flagContext(c, "address"); ok {
+		cfg.Address = f.String("address")
+	}
+
+	if f, ok := flagContext(c, "port"); ok {
+		cfg.Port = uint16(f.Uint("port"))
+	}
+
+	if f, ok := flagContext(c, "export"); ok {
+		cfg.Exports = f.StringSlice("export")
+	}
+
+	cert, certSet := flagContext(c, "tls-cert")
+	key, keySet := flagContext(c, "tls-key")
+
+	if certSet || keySet {
+		cfg.TLS = &ifs.TLSConfig{
+			CertFile: cert.String("tls-cert"),
+			KeyFile:  key.String("tls-key"),
+		}
+	}
+
+	if f, ok := flagContext(c, "memory-limit"); ok {
+		cfg.MemoryLimit = f.Uint64("memory-limit")
+	}
+
+	if f, ok := flagContext(c, "transport"); ok {
+		cfg.Transport = f.String("transport")
+	}
+
+	if f, ok := flagContext(c, "socket"); ok {
+		cfg.Socket = f.String("socket")
+	}
+
+	if f, ok := flagContext(c, "log-level"); ok {
+		if cfg.Log == nil {
+			cfg.Log = &ifs.LogConfig{
+				Console: true,
+			}
+		}
+
+		err = cfg.Log.SetLevel(f.String("log-level"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Context the flag called name was given in and whether it was given at all.
+// The config flags can come before or after the subcommand, the one closest
+// to the subcommand wins. Unset flags read from c and get their defaults.
+func flagContext(c *cli.Context, name string) (*cli.Context, bool) {
+
+	for ctx := c; ctx != nil; ctx = ctx.Parent() {
+		if ctx.IsSet(name) {
+			return ctx, true
+		}
+	}
+
+	return c, false
 }
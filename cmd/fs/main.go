@@ -17,11 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/chemistry-sourabh/ifs"
 	_ "go.uber.org/automaxprocs"
 	"gopkg.in/urfave/cli.v1"
 	"os"
+	"text/tabwriter"
 )
 
 //TODO Remove Logs for automaxprocs
@@ -47,51 +49,275 @@ func main() {
 			Aliases: []string{"mnt"},
 			Usage:   "Mount the Filesystem",
 			Action: func(c *cli.Context) error {
-				cfg := &ifs.FsConfig{}
-				path := c.GlobalString("config")
-				err := cfg.Load(path)
+				cfg, err := loadConfig(c)
 
 				if err != nil {
 					return err
 				}
 
+				ifs.SetConfigLoader(func() (*ifs.FsConfig, error) {
+					return loadConfig(c)
+				})
+
 				ifs.SetupLogger(cfg.Log)
 				ifs.MountRemoteRoots(cfg)
 				return nil
 			},
 		},
 		{
-			Name:    "umount",
-			Aliases: []string{"umnt"},
-			Usage:   "Unmount the Filesystem",
+			Name:      "umount",
+			Aliases:   []string{"umnt"},
+			Usage:     "Unmount the Filesystem",
+			ArgsUsage: "[mount_point]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "l, lazy",
+					Usage: "Detach the Filesystem even if it is Busy",
+				},
+				cli.BoolFlag{
+					Name:  "f, force",
+					Usage: "Force Unmount, Aborting Open Files",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				fmt.Println("Unimplemented")
-				return nil
+				mountPoint := c.Args().First()
+
+				if mountPoint == "" {
+					cfg, err := loadConfig(c)
+
+					if err != nil {
+						return err
+					}
+
+					mountPoint = cfg.MountPoint
+				}
+
+				return ifs.Unmount(mountPoint, c.Bool("lazy"), c.Bool("force"))
 			},
 		},
 		{
-			Name:  "add",
-			Usage: "Add a New Path to Mount",
+			Name:      "add",
+			Usage:     "Add a New Path to Mount",
+			ArgsUsage: "hostname:port@/path",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "tls",
+					Usage: "Connect to a New Host over TLS",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "Top Level Directory for a New Host, Defaults to its Hostname",
+				},
+				cli.StringFlag{
+					Name:  "as",
+					Usage: "Local Path below the Top Level Directory, Defaults to the Remote Path",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				fmt.Println("Unimplemented")
-				return nil
+				return controlRemotePath(c, func(socketPath string, remotePath *ifs.RemotePath) (string, error) {
+					entry := remotePath.Path
+
+					if c.String("as") != "" {
+						entry = c.String("as") + "=" + entry
+					}
+
+					return ifs.AddRemoteRoot(socketPath, &ifs.RemoteRoot{
+						Name:     c.String("name"),
+						Hostname: remotePath.Hostname,
+						Port:     remotePath.Port,
+						Paths:    []string{entry},
+						TLS:      c.Bool("tls"),
+					})
+				})
+			},
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"rm"},
+			Usage:     "Remove a Mounted Path",
+			ArgsUsage: "hostname:port@/path",
+			Action: func(c *cli.Context) error {
+				return controlRemotePath(c, ifs.RemoveRemotePath)
 			},
 		},
 		{
-			Name:    "remove",
-			Aliases: []string{"rm"},
-			Usage:   "Remove a Mounted Path",
+			Name:      "copy",
+			Aliases:   []string{"cp"},
+			Usage:     "Copy a File on a Remote Host without Transferring it",
+			ArgsUsage: "hostname:port@/src hostname:port@/dest",
 			Action: func(c *cli.Context) error {
-				fmt.Println("Unimplemented")
+				if c.NArg() != 2 {
+					return cli.NewExitError("copy needs a source and a destination", 1)
+				}
+
+				src, err := ifs.ParseRemotePath(c.Args().Get(0))
+				if err != nil {
+					return err
+				}
+
+				dest, err := ifs.ParseRemotePath(c.Args().Get(1))
+				if err != nil {
+					return err
+				}
+
+				// The config says how to reach the host, without one it is
+				// dialed over the default transport
+				cfg, err := loadConfig(c)
+
+				if err == nil {
+					ifs.SetupLogger(cfg.Log)
+				} else if c.GlobalIsSet("config") {
+					return err
+				}
+
+				return ifs.CopyRemotePath(cfg, src, dest)
+			},
+		},
+		{
+			Name:  "reload",
+			Usage: "Reload the Config of the Running Mount",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the Result as JSON",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+
+				result, err := ifs.ReloadMount(cfg.ControlSocketPath())
+				if err != nil {
+					return err
+				}
+
+				if c.Bool("json") {
+					return printJson(result)
+				}
+
+				for _, change := range result.Applied {
+					fmt.Println("applied:", change)
+				}
+
+				for _, change := range result.RestartRequired {
+					fmt.Println("needs restart:", change)
+				}
+
+				for _, msg := range result.Errors {
+					fmt.Println("failed:", msg)
+				}
+
+				if len(result.Errors) > 0 {
+					return cli.NewExitError("reload finished with errors", 1)
+				}
+
 				return nil
 			},
 		},
+		{
+			Name:  "config",
+			Usage: "Work with the Config File",
+			Subcommands: []cli.Command{
+				{
+					Name:  "check",
+					Usage: "Validate the Config and Print the Effective Config",
+					Action: func(c *cli.Context) error {
+						cfg, err := loadConfig(c)
+						if err != nil {
+							return err
+						}
+
+						return printJson(cfg)
+					},
+				},
+			},
+		},
 		{
 			Name:    "list",
 			Aliases: []string{"ls"},
 			Usage:   "List Mounted Paths",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the Listing as JSON",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				fmt.Println("Unimplemented")
+				status, err := mountStatus(c, true)
+				if err != nil {
+					return err
+				}
+
+				if c.Bool("json") {
+					return printJson(status)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+				for _, host := range status.Hosts {
+					fmt.Fprintf(w, "%s\t%s\tlatency %s\tin flight %d\n", host.Address, hostState(host.Up), host.Latency, host.InFlight)
+
+					if host.Compression != "" {
+						fmt.Fprintf(w, "  %s\tsaved %d bytes\n", host.Compression, host.BytesSaved)
+					}
+
+					for _, conn := range host.Connections {
+						fmt.Fprintf(w, "  conn %d\t%s\t%d bytes\tin flight %d\n", conn.Index, hostState(conn.Up), conn.BytesInFlight, conn.InFlight)
+					}
+
+					for _, p := range host.Paths {
+						fmt.Fprintf(w, "  %s\t%s\tcached %d bytes\topen %d\n", p.RemotePath, p.LocalPath, p.CachedBytes, p.OpenHandles)
+					}
+				}
+
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "Summarise the Health of every Host, Fails if any is Down",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the Status as JSON",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				status, err := mountStatus(c, false)
+				if err != nil {
+					return err
+				}
+
+				if c.Bool("json") {
+					err = printJson(status)
+				} else {
+					for _, host := range status.Hosts {
+						up := 0
+						for _, conn := range host.Connections {
+							if conn.Up {
+								up++
+							}
+						}
+
+						fmt.Printf("%s %s, %d/%d connections up, latency %s, %d in flight\n",
+							host.Address, hostState(host.Up), up, len(host.Connections), host.Latency, host.InFlight)
+					}
+				}
+
+				if err != nil {
+					return err
+				}
+
+				if down := len(status.Down()); down > 0 {
+					return cli.NewExitError(fmt.Sprintf("%d of %d hosts down", down, len(status.Hosts)), 1)
+				}
+
+				if !c.Bool("json") {
+					fmt.Printf("all %d hosts up\n", len(status.Hosts))
+				}
+
 				return nil
 			},
 		},
@@ -104,3 +330,78 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// Sends the remote path given as argument to the running mount
+func controlRemotePath(c *cli.Context, call func(string, *ifs.RemotePath) (string, error)) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError(c.Command.Name+" needs a remote path", 1)
+	}
+
+	remotePath, err := ifs.ParseRemotePath(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(c)
+
+	if err != nil {
+		return err
+	}
+
+	msg, err := call(cfg.ControlSocketPath(), remotePath)
+
+	if err == nil {
+		fmt.Println(msg)
+	}
+
+	return err
+}
+
+// Loads and validates the config file given by the global flag
+func loadConfig(c *cli.Context) (*ifs.FsConfig, error) {
+	cfg := &ifs.FsConfig{}
+	err := cfg.Load(c.GlobalString("config"))
+
+	// Without the default file the environment can still configure a mount
+	if os.IsNotExist(err) && !c.GlobalIsSet("config") {
+		err = cfg.LoadEnv()
+	}
+
+	if err == nil {
+		err = cfg.Validate()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func mountStatus(c *cli.Context, verbose bool) (*ifs.MountStatus, error) {
+	cfg, err := loadConfig(c)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ifs.GetMountStatus(cfg.ControlSocketPath(), verbose)
+}
+
+func hostState(up bool) string {
+	if up {
+		return "up"
+	}
+
+	return "down"
+}
+
+func printJson(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+
+	if err == nil {
+		fmt.Println(string(data))
+	}
+
+	return err
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Encoding of packet payloads, agreed on per connection in the hello
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codecs this build speaks, when both sides have more than one in common
+// the first in this order is used
+var codecs = []Codec{
+	msgpackCodec{},
+	newCborCodec(),
+}
+
+// Default codec and the one every hello is encoded with, so that a peer
+// can be understood before anything else is agreed on
+var MsgpackCodec Codec = codecs[0]
+
+func GetCodec(name string) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+
+	return nil, false
+}
+
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+
+	return names
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return CodecMsgpack
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// CBOR with the integer keys given by the cbor tags of each payload, fields
+// keep their key forever so that clients in other languages can rely on them
+// and new fields can be added without breaking old peers
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCborCodec() *cborCodec {
+	enc, err := cbor.CoreDetEncOptions().EncMode()
+
+	if err != nil {
+		panic(err)
+	}
+
+	dec, err := cbor.DecOptions{}.DecMode()
+
+	if err != nil {
+		panic(err)
+	}
+
+	return &cborCodec{
+		enc: enc,
+		dec: dec,
+	}
+}
+
+func (c *cborCodec) Name() string {
+	return CodecCBOR
+}
+
+func (c *cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.enc.Marshal(v)
+}
+
+func (c *cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.dec.Unmarshal(data, v)
+}
+
+// Errors travel as their message, the same as with msgpack
+type cborError struct {
+	Message string `cbor:"1,keyasint,omitempty"`
+}
+
+func (e Error) MarshalCBOR() ([]byte, error) {
+	wire := cborError{}
+
+	if e.Err != nil {
+		wire.Message = e.Err.Error()
+	}
+
+	return cbor.Marshal(wire)
+}
+
+func (e *Error) UnmarshalCBOR(data []byte) error {
+	wire := cborError{}
+
+	if err := cbor.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+
+	e.Err = nil
+
+	if wire.Message != "" {
+		e.Err = errors.New(wire.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"io"
+	"io/ioutil"
+)
+
+// Compression of the file data inside a payload. Each message records the
+// algorithm it used so a peer can always decode it, the handshake only
+// decides which one a side sends with.
+type Compressor interface {
+	Name() string
+	Id() uint8
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Compressors this build speaks, when both sides have more than one in
+// common the first in this order is used
+var compressors = []Compressor{
+	newZstdCompressor(),
+	lz4Compressor{},
+}
+
+func GetCompressor(name string) (Compressor, bool) {
+	for _, compressor := range compressors {
+		if compressor.Name() == name {
+			return compressor, true
+		}
+	}
+
+	return nil, false
+}
+
+func compressorById(id uint8) (Compressor, bool) {
+	for _, compressor := range compressors {
+		if compressor.Id() == id {
+			return compressor, true
+		}
+	}
+
+	return nil, false
+}
+
+func compressorNames() []string {
+	names := make([]string, 0, len(compressors))
+
+	for _, compressor := range compressors {
+		names = append(names, compressor.Name())
+	}
+
+	return names
+}
+
+// Compresses data unless it is too small or does not shrink. Content that
+// is already compressed is caught on a sample before paying for all of it.
+func compressData(c Compressor, data []byte) ([]byte, bool) {
+
+	if c == nil || len(data) < CompressionMinSize {
+		return data, false
+	}
+
+	if len(data) > CompressionSampleSize {
+
+		// The middle of a file says more than its headers
+		start := (len(data) - CompressionSampleSize) / 2
+		sample, err := c.Compress(data[start : start+CompressionSampleSize])
+
+		if err != nil || float64(len(sample)) > CompressionMaxRatio*CompressionSampleSize {
+			return data, false
+		}
+	}
+
+	out, err := c.Compress(data)
+
+	if err != nil || float64(len(out)) > CompressionMaxRatio*float64(len(data)) {
+		return data, false
+	}
+
+	return out, true
+}
+
+// Compresses the file data of pkt with c and returns the bytes saved. The
+// payload is copied so that a caller retrying it elsewhere keeps the original.
+func (pkt *Packet) Compress(c Compressor) int64 {
+
+	switch payload := pkt.Data.(type) {
+	case *WriteInfo:
+		if data, ok := compressData(c, payload.Data); ok {
+			compressed := *payload
+			compressed.Data = data
+			compressed.Compression = c.Id()
+			pkt.Data = &compressed
+
+			return int64(len(payload.Data) - len(data))
+		}
+	case *FileChunk:
+		if data, ok := compressData(c, payload.Chunk); ok {
+			compressed := *payload
+			compressed.Chunk = data
+			compressed.Compression = c.Id()
+			pkt.Data = &compressed
+
+			return int64(len(payload.Chunk) - len(data))
+		}
+	}
+
+	return 0
+}
+
+// Restores file data compressed by the peer and returns the bytes it saved
+func (pkt *Packet) Decompress() (int64, error) {
+
+	var data *[]byte
+	var id *uint8
+
+	switch payload := pkt.Data.(type) {
+	case *WriteInfo:
+		data, id = &payload.Data, &payload.Compression
+	case *FileChunk:
+		data, id = &payload.Chunk, &payload.Compression
+	default:
+		return 0, nil
+	}
+
+	if *id == CompressionNone {
+		return 0, nil
+	}
+
+	c, ok := compressorById(*id)
+
+	if !ok {
+		return 0, fmt.Errorf("unknown compression %d", *id)
+	}
+
+	out, err := c.Decompress(*data)
+
+	if err != nil {
+		return 0, fmt.Errorf("%s decompression failed, %s", c.Name(), err)
+	}
+
+	saved := int64(len(out) - len(*data))
+	*data, *id = out, CompressionNone
+
+	return saved, nil
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+
+	// Both are safe for concurrent use through EncodeAll and DecodeAll
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+
+	if err != nil {
+		panic(err)
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+
+	if err != nil {
+		panic(err)
+	}
+
+	return &zstdCompressor{
+		enc: enc,
+		dec: dec,
+	}
+}
+
+func (c *zstdCompressor) Name() string {
+	return CompressionZstd
+}
+
+func (c *zstdCompressor) Id() uint8 {
+	return CompressionZstdId
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return c.dec.DecodeAll(data, nil)
+}
+
+type lz4Compressor struct{}
+
+func (lz4Compressor) Name() string {
+	return CompressionLz4
+}
+
+func (lz4Compressor) Id() uint8 {
+	return CompressionLz4Id
+}
+
+func (lz4Compressor) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := lz4.NewWriter(&b)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (lz4Compressor) Decompress(data []byte) ([]byte, error) {
+	r := lz4.NewReader(bytes.NewReader(data))
+
+	// A peer must not be able to make this side allocate without bound
+	out, err := ioutil.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+
+	if err == nil && len(out) > MaxFrameSize {
+		err = fmt.Errorf("data is over the limit of %d bytes", MaxFrameSize)
+	}
+
+	return out, err
+}
@@ -0,0 +1,98 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/chemistry-sourabh/ifs"
+	"testing"
+)
+
+func TestPacket_CompressLz4(t *testing.T) {
+
+	lz4, _ := ifs.GetCompressor(ifs.CompressionLz4)
+
+	info := &ifs.WriteInfo{
+		Path: "/tmp/file1",
+		Data: bytes.Repeat([]byte{'a'}, 64*1024),
+	}
+
+	pkt := CreatePacket(ifs.WriteFileRequest, info)
+
+	if pkt.Compress(lz4) <= 0 {
+		PrintTestError(t, "nothing saved", pkt.Data, "compressed data")
+	}
+
+	Compare(t, pkt.Data.(*ifs.WriteInfo).Compression, ifs.CompressionLz4Id)
+
+	_, err := pkt.Decompress()
+	Ok(t, err)
+
+	Compare(t, pkt.Data, info)
+}
+
+func TestPacket_CompressSkips(t *testing.T) {
+
+	zstd, _ := ifs.GetCompressor(ifs.CompressionZstd)
+
+	random := make([]byte, 256*1024)
+	rand.Read(random)
+
+	cases := map[string][]byte{
+		"small":  bytes.Repeat([]byte{'a'}, ifs.CompressionMinSize-1),
+		"random": random,
+	}
+
+	for name, data := range cases {
+		info := &ifs.WriteInfo{Data: data}
+		pkt := CreatePacket(ifs.WriteFileRequest, info)
+
+		if saved := pkt.Compress(zstd); saved != 0 {
+			t.Errorf("%s: compressed, saved %d bytes", name, saved)
+		}
+
+		if pkt.Data != info {
+			t.Errorf("%s: payload was replaced", name)
+		}
+	}
+
+	// Without a compressor nothing is done
+	pkt := CreatePacket(ifs.WriteFileRequest, &ifs.WriteInfo{Data: bytes.Repeat([]byte{'a'}, 64*1024)})
+	Compare(t, pkt.Compress(nil), int64(0))
+}
+
+func TestPacket_DecompressErrors(t *testing.T) {
+
+	pkt := CreatePacket(ifs.FileDataResponse, &ifs.FileChunk{
+		Chunk:       []byte("not compressed"),
+		Compression: 99,
+	})
+
+	_, err := pkt.Decompress()
+	Err(t, err)
+
+	pkt = CreatePacket(ifs.FileDataResponse, &ifs.FileChunk{
+		Chunk:       []byte("not compressed"),
+		Compression: ifs.CompressionZstdId,
+	})
+
+	_, err = pkt.Decompress()
+	Err(t, err)
+}
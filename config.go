@@ -17,9 +17,16 @@ limitations under the License.
 package ifs
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type LogConfig struct {
@@ -29,38 +36,400 @@ type LogConfig struct {
 	Path    string `json:"path"`
 }
 
+// Sets logging from one of off, info or debug
+func (c *LogConfig) SetLevel(level string) error {
+	switch level {
+	case "off":
+		c.Logging = false
+	case "info":
+		c.Logging = true
+		c.Debug = false
+	case "debug":
+		c.Logging = true
+		c.Debug = true
+	default:
+		return fmt.Errorf("unknown log level %s, expected off, info or debug", level)
+	}
+
+	return nil
+}
+
+func defaultLogConfig() *LogConfig {
+	return &LogConfig{
+		Logging: true,
+		Console: true,
+	}
+}
+
+func (c *LogConfig) validate(field string) error {
+	if c.Logging && !c.Console && c.Path == "" {
+		return fmt.Errorf("%s.path must be set when %s.console is false", field, field)
+	}
+
+	return nil
+}
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
 type FsConfig struct {
-	MountPoint    string        `json:"mount_point"`
-	CacheLocation string        `json:"cache_location"`
-	RemoteRoots   []*RemoteRoot `json:"remote_roots"`
-	Log           *LogConfig    `json:"log"`
-	ConnCount     int           `json:"connection_count"`
+	MountPoint      string           `json:"mount_point"`
+	CacheLocation   string           `json:"cache_location"`
+	RemoteRoots     []*RemoteRoot    `json:"remote_roots"`
+	Log             *LogConfig       `json:"log"`
+	ConnCount       int              `json:"connection_count"`
+	CrossHostRename bool             `json:"cross_host_rename"`
+	ControlSocket   string           `json:"control_socket"`
+	CAFile          string           `json:"ca_file"`
+	CacheSize       uint64           `json:"cache_size"`
+	Unions          []*UnionConfig   `json:"unions"`
+	Replicas        []*ReplicaConfig `json:"replicas"`
+
+	// Megabytes of file data in flight per connection and in total
+	ConnWindow  uint64 `json:"connection_window"`
+	MemoryLimit uint64 `json:"memory_limit"`
+
+	// Only payload encoding offered to agents, empty lets the handshake pick
+	Codec string `json:"codec"`
+
+	// Only compressor offered to agents, off sends file data as it is
+	Compression string `json:"compression"`
 }
 
+// Loads a JSON, YAML or TOML file, IFS_* variables override its fields
 func (c *FsConfig) Load(path string) error {
+	return loadConfig(path, c, FsEnvPrefix)
+}
+
+// Applies only the IFS_* variables, for running without a config file
+func (c *FsConfig) LoadEnv() error {
+	return loadEnv(c, FsEnvPrefix)
+}
+
+// Fills in defaults and checks the config, errors name the offending field
+func (c *FsConfig) Validate() error {
+
+	if c.MountPoint == "" {
+		return errors.New("mount_point must be set")
+	}
+
+	if c.CacheLocation == "" {
+		c.CacheLocation = filepath.Join(os.TempDir(), DefaultCacheDir)
+	}
+
+	if c.CacheSize == 0 {
+		c.CacheSize = DefaultCacheSize
+	}
+
+	if c.ConnWindow == 0 {
+		c.ConnWindow = DefaultConnWindow
+	}
+
+	if c.MemoryLimit == 0 {
+		c.MemoryLimit = DefaultMemoryLimit
+	}
+
+	if c.MemoryLimit < c.ConnWindow {
+		return fmt.Errorf("memory_limit %d must be at least connection_window %d", c.MemoryLimit, c.ConnWindow)
+	}
+
+	if c.Codec != "" {
+		if _, ok := GetCodec(c.Codec); !ok {
+			return fmt.Errorf("codec must be one of %v, got %q", codecNames(), c.Codec)
+		}
+	}
+
+	if c.Compression != "" && c.Compression != CompressionOff {
+		if _, ok := GetCompressor(c.Compression); !ok {
+			return fmt.Errorf("compression must be off or one of %v, got %q", compressorNames(), c.Compression)
+		}
+	}
+
+	if c.ConnCount == 0 {
+		c.ConnCount = DefaultConnCount
+	} else if c.ConnCount < 0 || c.ConnCount > MaxConnCount {
+		return fmt.Errorf("connection_count must be between 1 and %d, got %d", MaxConnCount, c.ConnCount)
+	}
+
+	if c.Log == nil {
+		c.Log = defaultLogConfig()
+	} else if err := c.Log.validate("log"); err != nil {
+		return err
+	}
+
+	dirs := make(map[string]int)
+	addresses := make(map[string]int)
+
+	for i, remoteRoot := range c.RemoteRoots {
+
+		field := fmt.Sprintf("remote_roots[%d]", i)
+
+		if remoteRoot == nil {
+			return fmt.Errorf("%s must be set", field)
+		}
+
+		if err := remoteRoot.validate(field); err != nil {
+			return err
+		}
+
+		if j, ok := addresses[remoteRoot.Address()]; ok {
+			return fmt.Errorf("%s %s duplicates remote_roots[%d]", field, remoteRoot.Address(), j)
+		}
+
+		// Agents sharing a hostname need names to get their own directories
+		if j, ok := dirs[remoteRoot.DirName()]; ok {
+			return fmt.Errorf("%s directory %s is used by remote_roots[%d], set name", field, remoteRoot.DirName(), j)
+		}
+
+		addresses[remoteRoot.Address()] = i
+		dirs[remoteRoot.DirName()] = i
+	}
+
+	unions := make(map[string]int)
+
+	for i, union := range c.Unions {
+
+		field := fmt.Sprintf("unions[%d]", i)
+
+		if union == nil {
+			return fmt.Errorf("%s must be set", field)
+		}
+
+		if err := union.validate(field); err != nil {
+			return err
+		}
+
+		if j, ok := dirs[union.Name]; ok {
+			return fmt.Errorf("%s.name %s is used by remote_roots[%d]", field, union.Name, j)
+		}
+
+		if j, ok := unions[union.Name]; ok {
+			return fmt.Errorf("%s.name %s is used by unions[%d]", field, union.Name, j)
+		}
+
+		unions[union.Name] = i
+	}
+
+	replicas := make(map[string]int)
+
+	for i, replica := range c.Replicas {
+
+		field := fmt.Sprintf("replicas[%d]", i)
+
+		if replica == nil {
+			return fmt.Errorf("%s must be set", field)
+		}
+
+		if err := replica.validate(field); err != nil {
+			return err
+		}
+
+		if j, ok := dirs[replica.Name]; ok {
+			return fmt.Errorf("%s.name %s is used by remote_roots[%d]", field, replica.Name, j)
+		}
+
+		if j, ok := unions[replica.Name]; ok {
+			return fmt.Errorf("%s.name %s is used by unions[%d]", field, replica.Name, j)
+		}
 
-	data, err := ioutil.ReadFile(path)
+		if j, ok := replicas[replica.Name]; ok {
+			return fmt.Errorf("%s.name %s is used by replicas[%d]", field, replica.Name, j)
+		}
 
-	if err == nil {
-		err = json.Unmarshal(data, c)
+		replicas[replica.Name] = i
 	}
 
-	return err
+	return nil
+}
+
+// Remote roots to connect to, members of unions on agents that no remote
+// root names get one without paths
+func (c *FsConfig) HostRoots() []*RemoteRoot {
+
+	remoteRoots := append([]*RemoteRoot{}, c.RemoteRoots...)
+
+	seen := make(map[string]bool)
+	for _, remoteRoot := range c.RemoteRoots {
+		seen[remoteRoot.Address()] = true
+	}
+
+	for _, union := range c.Unions {
+		for _, remotePath := range union.RemotePaths() {
+
+			if seen[remotePath.Address()] {
+				continue
+			}
+
+			seen[remotePath.Address()] = true
+			remoteRoots = append(remoteRoots, &RemoteRoot{
+				Hostname:  remotePath.Hostname,
+				Port:      remotePath.Port,
+				TLS:       union.TLS,
+				Transport: union.Transport,
+			})
+		}
+	}
+
+	return remoteRoots
+}
+
+// Remote root connecting to the agent at address, nil when the config does
+// not reach it
+func (c *FsConfig) HostRoot(address string) *RemoteRoot {
+	for _, remoteRoot := range c.HostRoots() {
+		if remoteRoot.Address() == address {
+			return remoteRoot
+		}
+	}
+
+	return nil
+}
+
+// Socket used by the CLI to talk to the running mount, defaults to one
+// derived from the mount point so that several mounts can coexist
+func (c *FsConfig) ControlSocketPath() string {
+	if c.ControlSocket != "" {
+		return c.ControlSocket
+	}
+
+	mountPoint, err := filepath.Abs(c.MountPoint)
+
+	if err != nil {
+		mountPoint = c.MountPoint
+	}
+
+	name := "ifs-" + strconv.FormatUint(GeneratePathInode(mountPoint), 16) + ".sock"
+	return filepath.Join(os.TempDir(), name)
 }
 
 type RemoteRoot struct {
+	Name     string   `json:"name"`
 	Hostname string   `json:"hostname"`
 	Port     uint16   `json:"port"`
 	Paths    []string `json:"paths"`
+	TLS      bool     `json:"tls"`
+
+	// Websocket when empty, a unix socket is reached through Socket and
+	// Hostname only names the agent
+	Transport string `json:"transport"`
+	Socket    string `json:"socket"`
+}
+
+// Top level directory of the remote root, its hostname unless named
+func (rr *RemoteRoot) DirName() string {
+	if rr.Name != "" {
+		return rr.Name
+	}
+
+	return rr.Hostname
+}
+
+func (rr *RemoteRoot) validate(field string) error {
+
+	if rr.Hostname == "" {
+		return fmt.Errorf("%s.hostname must be set", field)
+	}
+
+	if strings.HasPrefix(rr.Hostname, ReplicaHostnamePrefix) {
+		return fmt.Errorf("%s.hostname %s is reserved for replica groups", field, rr.Hostname)
+	}
+
+	if strings.Contains(rr.Name, "/") || rr.Name == "." || rr.Name == ".." {
+		return fmt.Errorf("%s.name %s is not a valid directory name", field, rr.Name)
+	}
+
+	if err := validateTransport(field+".", rr.Transport, rr.Socket, rr.TLS); err != nil {
+		return err
+	}
+
+	if rr.Port == 0 && rr.Transport != TransportUnix {
+		return fmt.Errorf("%s.port must be set", field)
+	}
+
+	for j, entry := range rr.Paths {
+
+		pathField := fmt.Sprintf("%s.paths[%d]", field, j)
+		alias, remote := splitPathEntry(entry)
+
+		if !path.IsAbs(remote) {
+			return fmt.Errorf("%s %s is not an absolute path", pathField, remote)
+		}
+
+		if alias != "" && (alias == "." || path.IsAbs(alias) || path.Clean(alias) != alias || strings.HasPrefix(alias, "..")) {
+			return fmt.Errorf("%s alias %s must be a clean relative path", pathField, alias)
+		}
+
+		rr.Paths[j] = joinPathEntry(alias, path.Clean(remote))
+		local := rr.LocalPaths()[j]
+
+		if local == "/" {
+			return fmt.Errorf("%s cannot mount the root of %s without an alias", pathField, rr.Address())
+		}
+
+		// A path and one below it would both need the same directory
+		for k, other := range rr.LocalPaths()[:j] {
+
+			a := &RemotePath{Path: other}
+			b := &RemotePath{Path: local}
+
+			if a.Contains(b) || b.Contains(a) {
+				return fmt.Errorf("%s %s overlaps %s.paths[%d] %s", pathField, entry, field, k, rr.Paths[k])
+			}
+		}
+	}
+
+	return nil
+}
+
+// Splits a paths entry of the form alias=/remote/path, alias is empty when
+// the remote path is mounted as is. An entry starting with / is a plain path,
+// so remote paths may contain = themselves
+func splitPathEntry(entry string) (string, string) {
+	if strings.HasPrefix(entry, "/") {
+		return "", entry
+	}
+
+	if i := strings.Index(entry, "="); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+
+	return "", entry
+}
+
+func joinPathEntry(alias string, remote string) string {
+	if alias == "" {
+		return remote
+	}
+
+	return alias + "=" + remote
+}
+
+// Where each entry of Paths shows up below the top level directory
+func (rr *RemoteRoot) LocalPaths() []string {
+	var localPaths []string
+	for _, entry := range rr.Paths {
+		alias, remote := splitPathEntry(entry)
+
+		if alias != "" {
+			remote = "/" + alias
+		}
+
+		localPaths = append(localPaths, remote)
+	}
+
+	return localPaths
 }
 
 func (rr *RemoteRoot) RemotePaths() []*RemotePath {
 	var remotePaths []*RemotePath
-	for _, path := range rr.Paths {
+	for _, entry := range rr.Paths {
+		_, remote := splitPathEntry(entry)
 		remotePaths = append(remotePaths, &RemotePath{
 			Hostname: rr.Hostname,
 			Port:     rr.Port,
-			Path:     path,
+			Path:     remote,
 		})
 	}
 
@@ -70,8 +439,8 @@ func (rr *RemoteRoot) RemotePaths() []*RemotePath {
 func (rr *RemoteRoot) StringArray() []string {
 
 	var joinedPaths []string
-	for _, path := range rr.Paths {
-		joinedPaths = append(joinedPaths, rr.Address()+"@"+path)
+	for _, remotePath := range rr.RemotePaths() {
+		joinedPaths = append(joinedPaths, remotePath.String())
 	}
 
 	return joinedPaths
@@ -81,19 +450,341 @@ func (rr *RemoteRoot) Address() string {
 	return rr.Hostname + ":" + strconv.FormatInt(int64(rr.Port), 10)
 }
 
+// Where the transport connects to, Address unless it is a unix socket
+func (rr *RemoteRoot) DialAddress() string {
+	if rr.Transport == TransportUnix {
+		return rr.Socket
+	}
+
+	return rr.Address()
+}
+
+// Checks transport settings, prefix comes before the field names in errors.
+// A unix socket needs a path and never uses TLS.
+func validateTransport(prefix string, transport string, socket string, tls bool) error {
+
+	if _, ok := GetTransport(transport); !ok {
+		return fmt.Errorf("%stransport must be one of %v, got %q", prefix, transportNames(), transport)
+	}
+
+	if transport != TransportUnix {
+		if socket != "" {
+			return fmt.Errorf("%ssocket is only used by the unix transport", prefix)
+		}
+
+		return nil
+	}
+
+	if !filepath.IsAbs(socket) {
+		return fmt.Errorf("%ssocket must be an absolute path, got %q", prefix, socket)
+	}
+
+	if tls {
+		return fmt.Errorf("%stls is not used by the unix transport", prefix)
+	}
+
+	return nil
+}
+
+// Transport of a union or replica group, their agents are named by
+// hostname:port so a unix socket cannot be one
+func validateSectionTransport(field string, transport string, tls bool) error {
+
+	if transport == TransportUnix {
+		return fmt.Errorf("%s.transport unix needs a socket per agent, list the agent in remote_roots instead", field)
+	}
+
+	return validateTransport(field+".", transport, "", tls)
+}
+
+// A top level directory merging the listings of several remote paths
+type UnionConfig struct {
+	Name         string         `json:"name"`
+	Members      []*UnionMember `json:"members"`
+	Precedence   string         `json:"precedence"`
+	CreatePolicy string         `json:"create_policy"`
+	TLS          bool           `json:"tls"`
+
+	// How members on agents that no remote root names are reached,
+	// websocket when empty
+	Transport string `json:"transport"`
+}
+
+type UnionMember struct {
+	RemotePath string `json:"remote_path"`
+	Priority   int    `json:"priority"`
+}
+
+func (u *UnionConfig) validate(field string) error {
+
+	if u.Name == "" || strings.Contains(u.Name, "/") || u.Name == "." || u.Name == ".." {
+		return fmt.Errorf("%s.name %s is not a valid directory name", field, u.Name)
+	}
+
+	switch u.Precedence {
+	case "":
+		u.Precedence = UnionPrecedenceFirst
+	case UnionPrecedenceFirst, UnionPrecedencePriority:
+	default:
+		return fmt.Errorf("%s.precedence %s is unknown, expected %s or %s", field, u.Precedence, UnionPrecedenceFirst, UnionPrecedencePriority)
+	}
+
+	switch u.CreatePolicy {
+	case "":
+		u.CreatePolicy = CreatePolicyFirst
+	case CreatePolicyFirst, CreatePolicyMostFree, CreatePolicyRoundRobin:
+	default:
+		return fmt.Errorf("%s.create_policy %s is unknown, expected %s, %s or %s", field, u.CreatePolicy, CreatePolicyFirst, CreatePolicyMostFree, CreatePolicyRoundRobin)
+	}
+
+	if err := validateSectionTransport(field, u.Transport, u.TLS); err != nil {
+		return err
+	}
+
+	if len(u.Members) == 0 {
+		return fmt.Errorf("%s.members must be set", field)
+	}
+
+	seen := make(map[string]int)
+
+	for i, member := range u.Members {
+
+		memberField := fmt.Sprintf("%s.members[%d]", field, i)
+
+		if member == nil {
+			return fmt.Errorf("%s must be set", memberField)
+		}
+
+		remotePath, err := ParseRemotePath(member.RemotePath)
+
+		if err != nil {
+			return fmt.Errorf("%s.remote_path %s", memberField, err)
+		}
+
+		member.RemotePath = remotePath.String()
+
+		if j, ok := seen[member.RemotePath]; ok {
+			return fmt.Errorf("%s.remote_path %s duplicates %s.members[%d]", memberField, member.RemotePath, field, j)
+		}
+
+		seen[member.RemotePath] = i
+	}
+
+	return nil
+}
+
+// Members in the order they win name clashes, highest priority first when
+// precedence is priority and in listed order otherwise
+func (u *UnionConfig) RemotePaths() []*RemotePath {
+
+	members := append([]*UnionMember{}, u.Members...)
+
+	if u.Precedence == UnionPrecedencePriority {
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].Priority > members[j].Priority
+		})
+	}
+
+	var remotePaths []*RemotePath
+	for _, member := range members {
+		remotePath, err := ParseRemotePath(member.RemotePath)
+
+		if err == nil {
+			remotePaths = append(remotePaths, remotePath)
+		}
+	}
+
+	return remotePaths
+}
+
+// A top level directory served by several agents holding identical copies
+// of path, reads go to the healthiest replica and writes to the primary
+type ReplicaConfig struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Replicas []string `json:"replicas"`
+	Primary  string   `json:"primary"`
+	TLS      bool     `json:"tls"`
+
+	// How replicas that no remote root names are reached, websocket when
+	// empty
+	Transport string `json:"transport"`
+}
+
+func (r *ReplicaConfig) validate(field string) error {
+
+	if r.Name == "" || strings.Contains(r.Name, "/") || r.Name == "." || r.Name == ".." {
+		return fmt.Errorf("%s.name %s is not a valid directory name", field, r.Name)
+	}
+
+	if !path.IsAbs(r.Path) {
+		return fmt.Errorf("%s.path %s is not an absolute path", field, r.Path)
+	}
+
+	r.Path = path.Clean(r.Path)
+
+	if err := validateSectionTransport(field, r.Transport, r.TLS); err != nil {
+		return err
+	}
+
+	if len(r.Replicas) == 0 {
+		return fmt.Errorf("%s.replicas must be set", field)
+	}
+
+	seen := make(map[string]int)
+
+	for i, address := range r.Replicas {
+
+		if _, _, err := splitAddress(address); err != nil {
+			return fmt.Errorf("%s.replicas[%d] %s", field, i, err)
+		}
+
+		if j, ok := seen[address]; ok {
+			return fmt.Errorf("%s.replicas[%d] %s duplicates %s.replicas[%d]", field, i, address, field, j)
+		}
+
+		seen[address] = i
+	}
+
+	if _, ok := seen[r.Primary]; r.Primary != "" && !ok {
+		return fmt.Errorf("%s.primary %s is not one of its replicas", field, r.Primary)
+	}
+
+	return nil
+}
+
+// Splits hostname:port, the port must not be 0
+func splitAddress(address string) (string, uint16, error) {
+
+	hostname, portStr, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+
+	if err != nil || port == 0 || hostname == "" {
+		return "", 0, fmt.Errorf("%s must be of the form hostname:port", address)
+	}
+
+	return hostname, uint16(port), nil
+}
+
+// Remote roots without paths for connecting to the replicas
+func (r *ReplicaConfig) RemoteRoots() []*RemoteRoot {
+
+	var remoteRoots []*RemoteRoot
+
+	for _, address := range r.Replicas {
+		hostname, port, _ := splitAddress(address)
+		remoteRoots = append(remoteRoots, &RemoteRoot{
+			Hostname:  hostname,
+			Port:      port,
+			TLS:       r.TLS,
+			Transport: r.Transport,
+		})
+	}
+
+	return remoteRoots
+}
+
+// Where nodes below the replica group point, port 0 marks an address the
+// talker resolves to one of the replicas
+func (r *ReplicaConfig) RemotePath() *RemotePath {
+	return &RemotePath{
+		Hostname: ReplicaHostnamePrefix + r.Name,
+		Path:     r.Path,
+	}
+}
+
 type AgentConfig struct {
 	Address string     `json:"address"`
 	Port    uint16     `json:"port"`
+	Exports []string   `json:"exports"`
+	TLS     *TLSConfig `json:"tls"`
 	Log     *LogConfig `json:"log"`
+
+	// Megabytes of file data held by requests being served
+	MemoryLimit uint64 `json:"memory_limit"`
+
+	// Websocket when empty, a unix socket listens on Socket instead of
+	// Address and Port
+	Transport string `json:"transport"`
+	Socket    string `json:"socket"`
 }
 
+func (c *AgentConfig) ListenAddress() string {
+	if c.Transport == TransportUnix {
+		return c.Socket
+	}
+
+	return c.Address + ":" + strconv.FormatInt(int64(c.Port), 10)
+}
+
+// Loads a JSON, YAML or TOML file, IFS_AGENT_* variables override its fields
 func (c *AgentConfig) Load(path string) error {
+	return loadConfig(path, c, AgentEnvPrefix)
+}
+
+// Applies only the IFS_AGENT_* variables, for running without a config file
+func (c *AgentConfig) LoadEnv() error {
+	return loadEnv(c, AgentEnvPrefix)
+}
+
+// Fills in defaults and checks the config, errors name the offending field
+func (c *AgentConfig) Validate() error {
+
+	if err := validateTransport("", c.Transport, c.Socket, c.TLS != nil); err != nil {
+		return err
+	}
+
+	if c.Port == 0 && c.Transport != TransportUnix {
+		return errors.New("port must be set")
+	}
+
+	if c.MemoryLimit == 0 {
+		c.MemoryLimit = DefaultAgentMemoryLimit
+	}
+
+	if c.Log == nil {
+		c.Log = defaultLogConfig()
+	} else if err := c.Log.validate("log"); err != nil {
+		return err
+	}
+
+	for i, export := range c.Exports {
+
+		field := fmt.Sprintf("exports[%d]", i)
+
+		if !filepath.IsAbs(export) {
+			return fmt.Errorf("%s %s is not an absolute path", field, export)
+		}
+
+		info, err := os.Stat(export)
+
+		if err != nil {
+			return fmt.Errorf("%s %s", field, err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s %s is not a directory", field, export)
+		}
+	}
+
+	if c.TLS != nil {
+		if c.TLS.CertFile == "" {
+			return errors.New("tls.cert_file must be set")
+		}
+
+		if c.TLS.KeyFile == "" {
+			return errors.New("tls.key_file must be set")
+		}
 
-	data, err := ioutil.ReadFile(path)
+		_, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
 
-	if err == nil {
-		err = json.Unmarshal(data, c)
+		if err != nil {
+			return fmt.Errorf("tls %s", err)
+		}
 	}
 
-	return err
+	return nil
 }
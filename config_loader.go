@@ -0,0 +1,297 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Prefixes of the environment variables overriding config fields
+const FsEnvPrefix = "IFS"
+const AgentEnvPrefix = "IFS_AGENT"
+
+var interpolationRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Reads a JSON, YAML or TOML file into cfg, picked by extension, then
+// applies environment overrides and ${VAR} interpolation
+func loadConfig(path string, cfg interface{}, prefix string) error {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	data, err = toJson(path, data)
+
+	if err == nil {
+		err = json.Unmarshal(data, cfg)
+	}
+
+	if err == nil {
+		err = loadEnv(cfg, prefix)
+	}
+
+	return err
+}
+
+// Converts YAML and TOML to JSON so the json tags stay the only field names
+func toJson(path string, data []byte) ([]byte, error) {
+
+	var generic interface{}
+	var err error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &generic)
+		generic = stringKeys(generic)
+	case ".toml":
+		m := make(map[string]interface{})
+		_, err = toml.Decode(string(data), &m)
+		generic = m
+	default:
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(generic)
+}
+
+// YAML decodes maps with interface keys which JSON cannot encode
+func stringKeys(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, item := range val {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range val {
+			val[i] = stringKeys(item)
+		}
+	}
+
+	return v
+}
+
+func loadEnv(cfg interface{}, prefix string) error {
+
+	env := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		if parts := strings.SplitN(kv, "=", 2); strings.HasPrefix(parts[0], prefix+"_") {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	return walkConfig(reflect.ValueOf(cfg).Elem(), prefix, "", env)
+}
+
+// Overrides fields from env and interpolates strings. Variables are named by
+// upper casing the json path, IFS_REMOTE_ROOTS_0_PORT for remote_roots[0].port,
+// and lists of strings are comma separated.
+func walkConfig(v reflect.Value, envKey string, field string, env map[string]string) error {
+
+	switch v.Kind() {
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			if v.Type().Elem().Kind() != reflect.Struct || !hasEnvPrefix(env, envKey+"_") {
+				return nil
+			}
+
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		return walkConfig(v.Elem(), envKey, field, env)
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+
+			name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+
+			if name == "" || name == "-" {
+				continue
+			}
+
+			err := walkConfig(v.Field(i), envKey+"_"+strings.ToUpper(name), joinField(field, name), env)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			if val, ok := env[envKey]; ok {
+				v.Set(reflect.ValueOf(splitList(val)))
+			}
+		} else if n := maxEnvIndex(env, envKey+"_") + 1; n > MaxEnvListLength {
+			// The list is grown up to the index, a stray one must not take
+			// all the memory there is
+			return fmt.Errorf("%s_%d: index is over the limit of %d", envKey, n-1, MaxEnvListLength-1)
+		} else if n > v.Len() {
+			grown := reflect.MakeSlice(v.Type(), n, n)
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+
+		for i := 0; i < v.Len(); i++ {
+
+			key := envKey + "_" + strconv.Itoa(i)
+			err := walkConfig(v.Index(i), key, fmt.Sprintf("%s[%d]", field, i), env)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if val, ok := env[envKey]; ok {
+		if err := setFromString(v, val); err != nil {
+			return fmt.Errorf("%s: %s is not a valid %s", envKey, val, v.Kind())
+		}
+	}
+
+	if v.Kind() == reflect.String {
+		val, err := interpolate(v.String())
+
+		if err != nil {
+			return fmt.Errorf("%s %s", field, err)
+		}
+
+		v.SetString(val)
+	}
+
+	return nil
+}
+
+func setFromString(v reflect.Value, val string) error {
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(val, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	}
+
+	return nil
+}
+
+// Replaces ${VAR} with the value of VAR, which must be set
+func interpolate(str string) (string, error) {
+
+	var err error
+
+	result := interpolationRegex.ReplaceAllStringFunc(str, func(match string) string {
+		name := interpolationRegex.FindStringSubmatch(match)[1]
+		val, ok := os.LookupEnv(name)
+
+		if !ok && err == nil {
+			err = fmt.Errorf("references unset variable %s", name)
+		}
+
+		return val
+	})
+
+	return result, err
+}
+
+func joinField(field string, name string) string {
+	if field == "" {
+		return name
+	}
+
+	return field + "." + name
+}
+
+func splitList(val string) []string {
+
+	var list []string
+
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+func hasEnvPrefix(env map[string]string, prefix string) bool {
+	for k := range env {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Highest list index mentioned by variables starting with prefix, -1 if none
+func maxEnvIndex(env map[string]string, prefix string) int {
+
+	max := -1
+
+	for k := range env {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		index := strings.SplitN(strings.TrimPrefix(k, prefix), "_", 2)[0]
+
+		if i, err := strconv.Atoi(index); err == nil && i > max {
+			max = i
+		}
+	}
+
+	return max
+}
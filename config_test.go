@@ -77,3 +77,519 @@ func TestRemoteRoot_StringArray(t *testing.T) {
 
 	Compare(t, paths, result)
 }
+
+func TestFsConfig_ControlSocketPath(t *testing.T) {
+
+	cfg := ifs.FsConfig{MountPoint: "/mnt/ifs"}
+	other := ifs.FsConfig{MountPoint: "/mnt/other"}
+
+	if cfg.ControlSocketPath() == other.ControlSocketPath() {
+		PrintTestError(t, "control sockets of different mounts collide", cfg.ControlSocketPath(), other.ControlSocketPath())
+	}
+
+	cfg.ControlSocket = "/tmp/ifs.sock"
+	Compare(t, cfg.ControlSocketPath(), "/tmp/ifs.sock")
+}
+
+func TestLogConfig_SetLevel(t *testing.T) {
+
+	cfg := &ifs.LogConfig{}
+
+	Ok(t, cfg.SetLevel("debug"))
+	Compare(t, *cfg, ifs.LogConfig{Logging: true, Debug: true})
+
+	Ok(t, cfg.SetLevel("off"))
+	Compare(t, cfg.Logging, false)
+
+	Err(t, cfg.SetLevel("verbose"))
+}
+
+func TestAgentConfig_Validate(t *testing.T) {
+
+	cfg := &ifs.AgentConfig{
+		Port:    11211,
+		Exports: []string{os.TempDir()},
+	}
+
+	Ok(t, cfg.Validate())
+
+	cfg.Exports = []string{"tmp"}
+	Err(t, cfg.Validate())
+
+	cfg.Exports = nil
+	cfg.TLS = &ifs.TLSConfig{CertFile: "cert.pem"}
+	Err(t, cfg.Validate())
+
+	cfg.TLS = nil
+	cfg.Port = 0
+	Err(t, cfg.Validate())
+
+	// A unix socket takes the place of the port
+	cfg.Transport = ifs.TransportUnix
+	cfg.Socket = "/run/ifs.sock"
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.ListenAddress(), "/run/ifs.sock")
+
+	cfg.Socket = ""
+	Err(t, cfg.Validate())
+}
+
+func TestFsConfig_ValidateDefaults(t *testing.T) {
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{
+				Hostname: "localhost",
+				Port:     11211,
+				Paths:    []string{"/tmp/a/"},
+			},
+		},
+	}
+
+	Ok(t, cfg.Validate())
+
+	Compare(t, cfg.ConnCount, ifs.DefaultConnCount)
+	Compare(t, cfg.ConnWindow, uint64(ifs.DefaultConnWindow))
+	Compare(t, cfg.MemoryLimit, uint64(ifs.DefaultMemoryLimit))
+	Compare(t, cfg.Log, &ifs.LogConfig{Logging: true, Console: true})
+	Compare(t, cfg.RemoteRoots[0].Paths, []string{"/tmp/a"})
+
+	if cfg.CacheLocation == "" {
+		PrintTestError(t, "cache location not defaulted", cfg.CacheLocation, "a path")
+	}
+}
+
+func TestFsConfig_ValidateErrors(t *testing.T) {
+
+	cases := []struct {
+		cfg ifs.FsConfig
+		err string
+	}{
+		{
+			cfg: ifs.FsConfig{},
+			err: "mount_point must be set",
+		},
+		{
+			cfg: ifs.FsConfig{MountPoint: "/tmp/ifs", ConnCount: -1},
+			err: "connection_count must be between 1 and 256, got -1",
+		},
+		{
+			cfg: ifs.FsConfig{MountPoint: "/tmp/ifs", ConnWindow: 16, MemoryLimit: 8},
+			err: "memory_limit 8 must be at least connection_window 16",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint:  "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{{Hostname: "localhost", Port: 11211, Transport: "quic"}},
+			},
+			err: `remote_roots[0].transport must be one of [websocket tcp unix], got "quic"`,
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint:  "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{{Hostname: "localhost", Transport: ifs.TransportUnix}},
+			},
+			err: `remote_roots[0].socket must be an absolute path, got ""`,
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint:  "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{{Hostname: "localhost", Port: 11211, Socket: "/run/ifs.sock"}},
+			},
+			err: "remote_roots[0].socket is only used by the unix transport",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint:  "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{{Hostname: "localhost", Transport: ifs.TransportUnix, Socket: "/run/ifs.sock", TLS: true}},
+			},
+			err: "remote_roots[0].tls is not used by the unix transport",
+		},
+		{
+			cfg: ifs.FsConfig{MountPoint: "/tmp/ifs", Compression: "gzip"},
+			err: `compression must be off or one of [zstd lz4], got "gzip"`,
+		},
+		{
+			cfg: ifs.FsConfig{MountPoint: "/tmp/ifs", Codec: "json"},
+			err: `codec must be one of [msgpack cbor], got "json"`,
+		},
+		{
+			cfg: ifs.FsConfig{MountPoint: "/tmp/ifs", Log: &ifs.LogConfig{Logging: true}},
+			err: "log.path must be set when log.console is false",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint:  "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{{Hostname: "localhost"}},
+			},
+			err: "remote_roots[0].port must be set",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint:  "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{{Hostname: "replica+mirror", Transport: ifs.TransportUnix, Socket: "/run/ifs.sock"}},
+			},
+			err: "remote_roots[0].hostname replica+mirror is reserved for replica groups",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint: "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{
+					{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp", "/var", "/tmp/a"}},
+				},
+			},
+			err: "remote_roots[0].paths[2] /tmp/a overlaps remote_roots[0].paths[0] /tmp",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint: "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{
+					{Hostname: "localhost", Port: 11211, Paths: []string{"tmp"}},
+				},
+			},
+			err: "remote_roots[0].paths[0] tmp is not an absolute path",
+		},
+		{
+			cfg: ifs.FsConfig{
+				MountPoint: "/tmp/ifs",
+				RemoteRoots: []*ifs.RemoteRoot{
+					{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+					{Hostname: "localhost", Port: 11212, Paths: []string{"/var"}},
+				},
+			},
+			err: "remote_roots[1] directory localhost is used by remote_roots[0], set name",
+		},
+	}
+
+	for _, c := range cases {
+		err := c.cfg.Validate()
+
+		if err == nil {
+			PrintTestError(t, "invalid config passed", nil, c.err)
+		} else {
+			Compare(t, err.Error(), c.err)
+		}
+	}
+}
+
+func TestConfig_LoadYaml(t *testing.T) {
+
+	data := `
+mount_point: /tmp/ifs
+connection_count: 2
+remote_roots:
+  - hostname: localhost
+    port: 11211
+    paths: [/tmp, /var]
+log:
+  logging: true
+  console: true
+`
+
+	ioutil.WriteFile(configLocation+".yaml", []byte(data), 0666)
+
+	cfg := ifs.FsConfig{}
+	err := cfg.Load(configLocation + ".yaml")
+
+	Ok(t, err)
+	Compare(t, cfg, ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		ConnCount:  2,
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp", "/var"}},
+		},
+		Log: &ifs.LogConfig{Logging: true, Console: true},
+	})
+
+	os.Remove(configLocation + ".yaml")
+}
+
+func TestConfig_LoadToml(t *testing.T) {
+
+	data := `
+address = "0.0.0.0"
+port = 11211
+exports = ["/tmp"]
+`
+
+	ioutil.WriteFile(configLocation+".toml", []byte(data), 0666)
+
+	cfg := ifs.AgentConfig{}
+	err := cfg.Load(configLocation + ".toml")
+
+	Ok(t, err)
+	Compare(t, cfg, ifs.AgentConfig{
+		Address: "0.0.0.0",
+		Port:    11211,
+		Exports: []string{"/tmp"},
+	})
+
+	os.Remove(configLocation + ".toml")
+}
+
+func TestConfig_LoadEnv(t *testing.T) {
+
+	os.Setenv("IFS_MOUNT_POINT", "/tmp/env")
+	os.Setenv("IFS_REMOTE_ROOTS_1_HOSTNAME", "remote")
+	os.Setenv("IFS_REMOTE_ROOTS_1_PORT", "11212")
+	os.Setenv("IFS_REMOTE_ROOTS_1_PATHS", "/a, /b")
+	os.Setenv("IFS_LOG_DEBUG", "true")
+
+	cfg := ifs.FsConfig{
+		MountPoint: "/tmp",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+		},
+	}
+
+	err := cfg.LoadEnv()
+
+	Ok(t, err)
+	Compare(t, cfg, ifs.FsConfig{
+		MountPoint: "/tmp/env",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+			{Hostname: "remote", Port: 11212, Paths: []string{"/a", "/b"}},
+		},
+		Log: &ifs.LogConfig{Debug: true},
+	})
+
+	os.Setenv("IFS_REMOTE_ROOTS_1_PORT", "port")
+	Err(t, cfg.LoadEnv())
+
+	os.Setenv("IFS_REMOTE_ROOTS_1_PORT", "11212")
+	os.Setenv("IFS_REMOTE_ROOTS_1000000000_HOSTNAME", "remote")
+	Err(t, cfg.LoadEnv())
+	os.Unsetenv("IFS_REMOTE_ROOTS_1000000000_HOSTNAME")
+
+	os.Unsetenv("IFS_MOUNT_POINT")
+	os.Unsetenv("IFS_REMOTE_ROOTS_1_HOSTNAME")
+	os.Unsetenv("IFS_REMOTE_ROOTS_1_PORT")
+	os.Unsetenv("IFS_REMOTE_ROOTS_1_PATHS")
+	os.Unsetenv("IFS_LOG_DEBUG")
+}
+
+func TestConfig_Interpolation(t *testing.T) {
+
+	os.Setenv("IFS_TEST_KEY_DIR", "/etc/ifs")
+
+	cfg := ifs.AgentConfig{
+		Port: 11211,
+		TLS:  &ifs.TLSConfig{CertFile: "${IFS_TEST_KEY_DIR}/cert.pem", KeyFile: "${IFS_TEST_MISSING}"},
+	}
+
+	err := cfg.LoadEnv()
+
+	if err == nil {
+		PrintTestError(t, "unset variable interpolated", nil, "error")
+	} else {
+		Compare(t, err.Error(), "tls.key_file references unset variable IFS_TEST_MISSING")
+	}
+
+	Compare(t, cfg.TLS.CertFile, "/etc/ifs/cert.pem")
+
+	os.Unsetenv("IFS_TEST_KEY_DIR")
+}
+
+func TestFsConfig_ValidateNames(t *testing.T) {
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+			{Name: "other", Hostname: "localhost", Port: 11212, Paths: []string{"/tmp"}},
+		},
+	}
+
+	Ok(t, cfg.Validate())
+
+	cfg.RemoteRoots[1].Port = 11211
+	Err(t, cfg.Validate())
+}
+
+func TestRemoteRoot_LocalPaths(t *testing.T) {
+
+	rr := &ifs.RemoteRoot{
+		Hostname: "localhost",
+		Port:     11211,
+		Paths:    []string{"x=/data/projects/x", "/tmp/bye", "deep/y=/"},
+	}
+
+	Compare(t, rr.LocalPaths(), []string{"/x", "/tmp/bye", "/deep/y"})
+	Compare(t, rr.StringArray(), []string{"localhost:11211@/data/projects/x", "localhost:11211@/tmp/bye", "localhost:11211@/"})
+}
+
+func TestFsConfig_ValidateAliases(t *testing.T) {
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"x=/data/x/", "tmp=/tmp"}},
+		},
+	}
+
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.RemoteRoots[0].Paths, []string{"x=/data/x", "tmp=/tmp"})
+
+	cfg.RemoteRoots[0].Paths = []string{"x=/data/x", "x=/data/y"}
+	Err(t, cfg.Validate())
+
+	cfg.RemoteRoots[0].Paths = []string{"../x=/data/x"}
+	Err(t, cfg.Validate())
+
+	// Only an entry not starting with / carries an alias
+	cfg.RemoteRoots[0].Paths = []string{"/data/a=b", "y=/data/c=d"}
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.RemoteRoots[0].Paths, []string{"/data/a=b", "y=/data/c=d"})
+	Compare(t, cfg.RemoteRoots[0].LocalPaths(), []string{"/data/a=b", "/y"})
+	Compare(t, cfg.RemoteRoots[0].StringArray(), []string{"localhost:11211@/data/a=b", "localhost:11211@/data/c=d"})
+}
+
+func TestFsConfig_ValidateUnions(t *testing.T) {
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+		},
+		Unions: []*ifs.UnionConfig{
+			{
+				Name: "media",
+				Members: []*ifs.UnionMember{
+					{RemotePath: "localhost:11211@/data/media/"},
+					{RemotePath: "other:11212@/media", Priority: 1},
+				},
+			},
+		},
+	}
+
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.Unions[0].Precedence, ifs.UnionPrecedenceFirst)
+	Compare(t, cfg.Unions[0].CreatePolicy, ifs.CreatePolicyFirst)
+	Compare(t, cfg.Unions[0].Members[0].RemotePath, "localhost:11211@/data/media")
+
+	cfg.Unions[0].Name = "localhost"
+	Err(t, cfg.Validate())
+
+	cfg.Unions[0].Name = "media"
+	cfg.Unions[0].CreatePolicy = "random"
+	Err(t, cfg.Validate())
+
+	cfg.Unions[0].CreatePolicy = ifs.CreatePolicyMostFree
+	cfg.Unions[0].Members[1].RemotePath = "other@/media"
+	Err(t, cfg.Validate())
+
+	cfg.Unions[0].Members[1].RemotePath = "localhost:11211@/data/media"
+	Err(t, cfg.Validate())
+}
+
+func TestUnionConfig_RemotePaths(t *testing.T) {
+
+	union := &ifs.UnionConfig{
+		Name: "media",
+		Members: []*ifs.UnionMember{
+			{RemotePath: "localhost:11211@/a"},
+			{RemotePath: "other:11212@/b", Priority: 2},
+			{RemotePath: "third:11213@/c", Priority: 2},
+		},
+		Precedence: ifs.UnionPrecedenceFirst,
+	}
+
+	var paths []string
+	for _, remotePath := range union.RemotePaths() {
+		paths = append(paths, remotePath.String())
+	}
+
+	Compare(t, paths, []string{"localhost:11211@/a", "other:11212@/b", "third:11213@/c"})
+
+	union.Precedence = ifs.UnionPrecedencePriority
+
+	paths = nil
+	for _, remotePath := range union.RemotePaths() {
+		paths = append(paths, remotePath.String())
+	}
+
+	Compare(t, paths, []string{"other:11212@/b", "third:11213@/c", "localhost:11211@/a"})
+}
+
+func TestFsConfig_HostRoots(t *testing.T) {
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+		},
+		Unions: []*ifs.UnionConfig{
+			{
+				Name: "media",
+				TLS:  true,
+				Members: []*ifs.UnionMember{
+					{RemotePath: "localhost:11211@/a"},
+					{RemotePath: "other:11212@/b"},
+					{RemotePath: "other:11212@/c"},
+				},
+			},
+		},
+	}
+
+	Compare(t, cfg.HostRoots(), []*ifs.RemoteRoot{
+		{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}},
+		{Hostname: "other", Port: 11212, TLS: true},
+	})
+
+	Compare(t, cfg.HostRoot("other:11212"), &ifs.RemoteRoot{Hostname: "other", Port: 11212, TLS: true})
+	Compare(t, cfg.HostRoot("missing:11211") == nil, true)
+
+	// Members on agents no remote root names use the transport of the union
+	cfg.Unions[0].Transport = ifs.TransportTCP
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.HostRoots()[1], &ifs.RemoteRoot{Hostname: "other", Port: 11212, TLS: true, Transport: ifs.TransportTCP})
+
+	cfg.Unions[0].Transport = ifs.TransportUnix
+	Err(t, cfg.Validate())
+}
+
+func TestFsConfig_ValidateReplicas(t *testing.T) {
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		Replicas: []*ifs.ReplicaConfig{
+			{
+				Name:     "mirror",
+				Path:     "/data/set/",
+				Replicas: []string{"a:11211", "b:11211"},
+				Primary:  "a:11211",
+			},
+		},
+	}
+
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.Replicas[0].Path, "/data/set")
+	Compare(t, cfg.Replicas[0].RemotePath().Address(), "replica+mirror:0")
+	Compare(t, cfg.Replicas[0].RemoteRoots(), []*ifs.RemoteRoot{
+		{Hostname: "a", Port: 11211},
+		{Hostname: "b", Port: 11211},
+	})
+
+	cfg.Replicas[0].Transport = ifs.TransportTCP
+	Ok(t, cfg.Validate())
+	Compare(t, cfg.Replicas[0].RemoteRoots()[1], &ifs.RemoteRoot{Hostname: "b", Port: 11211, Transport: ifs.TransportTCP})
+
+	cfg.Replicas[0].Transport = "quic"
+	Err(t, cfg.Validate())
+	cfg.Replicas[0].Transport = ""
+
+	cfg.Replicas[0].Primary = "c:11211"
+	Err(t, cfg.Validate())
+
+	cfg.Replicas[0].Primary = ""
+	cfg.Replicas[0].Replicas = []string{"a:11211", "a:11211"}
+	Err(t, cfg.Validate())
+
+	cfg.Replicas[0].Replicas = []string{"a"}
+	Err(t, cfg.Validate())
+
+	cfg.Replicas[0].Replicas = []string{"a:0"}
+	Err(t, cfg.Validate())
+}
@@ -16,6 +16,8 @@ limitations under the License.
 
 package ifs
 
+import "time"
+
 const FileOpBase = 0
 const AttrRequest = FileOpBase + 0
 const ReadDirRequest = FileOpBase + 1
@@ -30,6 +32,11 @@ const OpenRequest = FileOpBase + 9
 const CloseRequest = FileOpBase + 10
 const FlushRequest = FileOpBase + 11
 const ReadDirAllRequest = FileOpBase + 12
+const CopyRequest = FileOpBase + 13
+const AllocateRequest = FileOpBase + 14
+const StatfsRequest = FileOpBase + 15
+const HelloRequest = FileOpBase + 16
+const BatchRequest = FileOpBase + 17
 
 const ResponseBase = 30
 const StatResponse = ResponseBase + 0
@@ -37,5 +44,115 @@ const StatsResponse = ResponseBase + 1
 const FileDataResponse = ResponseBase + 2
 const WriteResponse = ResponseBase + 3
 const ErrorResponse = ResponseBase + 4
+const FsStatResponse = ResponseBase + 5
+const HelloResponse = ResponseBase + 6
+const BatchResponse = ResponseBase + 7
+
+// Sent in the hello that opens every connection
+const ProtocolMagic = "ifs"
+const ProtocolVersion = 1
+const MinProtocolVersion = 1
+
+// Optional parts of the protocol a peer may offer in its hello
+const FeatureCompression = "compression"
+const FeatureStreaming = "streaming"
+const FeatureXattrs = "xattrs"
+const FeatureLocks = "locks"
+
+// Payload encodings a connection can agree on
+const CodecMsgpack = "msgpack"
+const CodecCBOR = "cbor"
+
+// Compression of file data, the id travels in each message
+const CompressionOff = "off"
+const CompressionZstd = "zstd"
+const CompressionLz4 = "lz4"
+
+const (
+	CompressionNone uint8 = iota
+	CompressionZstdId
+	CompressionLz4Id
+)
+
+// Data smaller than this is sent as it is
+const CompressionMinSize = 4 * 1024
+
+// Bytes compressed to guess whether the rest is worth it
+const CompressionSampleSize = 16 * 1024
+
+// Data that does not shrink below this fraction is sent as it is
+const CompressionMaxRatio = 0.9
+
+// How long a new connection waits for the hello of the agent
+const HandshakeTimeout = 10 * time.Second
 
 const ChannelLength = 100
+
+// Modes for AllocateRequest, same values as FALLOC_FL_* on Linux
+const FallocKeepSize = 0x01
+const FallocPunchHole = 0x02
+
+// How a union picks between members that hold the same name
+const UnionPrecedenceFirst = "first"
+const UnionPrecedencePriority = "priority"
+
+// How a union picks the member that new files and directories go to
+const CreatePolicyFirst = "first"
+const CreatePolicyMostFree = "most_free"
+const CreatePolicyRoundRobin = "round_robin"
+
+// Hostnames of nodes below replica groups start with this, it is reserved so
+// that no remote root can share their address. A + cannot appear in a real
+// hostname and keeps the : and @ of remote path strings unambiguous.
+const ReplicaHostnamePrefix = "replica+"
+
+// Config defaults
+const DefaultConnCount = 4
+const DefaultCacheDir = "ifs-cache"
+const DefaultCacheSize = 100
+
+// Flow control defaults in megabytes, bytes of file data in flight on one
+// connection, across all connections of a mount and inside an agent
+const DefaultConnWindow = 8
+const DefaultMemoryLimit = 64
+const DefaultAgentMemoryLimit = 256
+
+// Connection ids are a single byte
+const MaxConnCount = 256
+
+// How often idle connections are checked
+const PingInterval = 30 * time.Second
+
+// How long a ping may wait to be written before the connection is failed
+const PingWriteTimeout = 10 * time.Second
+
+// How long closing a connection waits to tell the peer
+const CloseWriteTimeout = time.Second
+
+// How long a response waits for room in the queue of a client that stopped
+// reading before the agent drops the connection
+const SendQueueTimeout = 10 * time.Second
+
+// How long a mount starting up waits for another one to answer on its
+// control socket before treating the socket as stale
+const ControlDialTimeout = time.Second
+
+// Ways of reaching an agent
+const TransportWebsocket = "websocket"
+const TransportTCP = "tcp"
+const TransportUnix = "unix"
+
+// Largest frame a stream transport accepts, a whole file can travel in one
+const MaxFrameSize = 1 << 30
+
+// How long an unmount waits for outstanding requests
+const DrainTimeout = 30 * time.Second
+
+// Bytes moved per request when streaming a file between agents
+const TransferChunkSize = 1024 * 1024
+
+// Longest list the environment can set, IFS_REMOTE_ROOTS_<i>_* and alike
+const MaxEnvListLength = 1024
+
+// Most requests carried by one batch, longer lists go out as several
+const BatchMaxOps = 512
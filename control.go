@@ -0,0 +1,278 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Control is served on a unix socket next to the mount so that the CLI can
+// inspect and change a running filesystem
+type Control struct {
+	mountPoint string
+}
+
+type ControlReply struct {
+	Message string
+}
+
+type MountStatus struct {
+	MountPoint string        `json:"mount_point"`
+	Hosts      []*HostStatus `json:"hosts"`
+}
+
+// Hosts that are down, an empty list means the mount is healthy
+func (ms *MountStatus) Down() []*HostStatus {
+	var down []*HostStatus
+
+	for _, host := range ms.Hosts {
+		if !host.Up {
+			down = append(down, host)
+		}
+	}
+
+	return down
+}
+
+type HostStatus struct {
+	Address     string        `json:"address"`
+	Up          bool          `json:"up"`
+	Latency     time.Duration `json:"latency_ns"`
+	InFlight    int64         `json:"in_flight"`
+	Version     uint16        `json:"protocol_version"`
+	Features    []string      `json:"features"`
+	Codec       string        `json:"codec"`
+	Compression string        `json:"compression"`
+
+	// Bytes of file data compression kept off the wire
+	BytesSaved int64 `json:"bytes_saved"`
+
+	Connections []*ConnStatus `json:"connections"`
+	Paths       []*PathStatus `json:"paths"`
+}
+
+type ConnStatus struct {
+	Index    int   `json:"index"`
+	Up       bool  `json:"up"`
+	InFlight int64 `json:"in_flight"`
+
+	// Bytes of file data held by requests on the connection
+	BytesInFlight int64 `json:"bytes_in_flight"`
+
+	// Request ids skipped because an older request still held them
+	IdCollisions uint64 `json:"id_collisions"`
+}
+
+type PathStatus struct {
+	RemotePath  string `json:"remote_path"`
+	LocalPath   string `json:"local_path"`
+	CachedBytes int64  `json:"cached_bytes"`
+	OpenHandles int    `json:"open_handles"`
+}
+
+func (c *Control) Status(verbose bool, reply *MountStatus) error {
+
+	reply.MountPoint = c.mountPoint
+	hosts := make(map[string]*HostStatus)
+
+	for _, remotePath := range Ifs().RemotePaths() {
+
+		host, ok := hosts[remotePath.Address()]
+
+		if !ok {
+			host, ok = Talker().HostStatus(remotePath.Address())
+
+			if !ok {
+				host = &HostStatus{}
+			}
+
+			host.Address = remotePath.Address()
+			hosts[remotePath.Address()] = host
+			reply.Hosts = append(reply.Hosts, host)
+		}
+
+		if verbose {
+			host.Paths = append(host.Paths, &PathStatus{
+				RemotePath:  remotePath.String(),
+				LocalPath:   filepath.Join(c.mountPoint, Ifs().LocalPath(remotePath)),
+				CachedBytes: Hoarder().CachedBytes(remotePath),
+				OpenHandles: FileHandler().OpenHandles(remotePath),
+			})
+		}
+	}
+
+	return nil
+}
+
+func (c *Control) Add(remoteRoot *RemoteRoot, reply *ControlReply) error {
+	err := Ifs().Add(remoteRoot)
+
+	if err == nil {
+		reply.Message = "Added " + strings.Join(remoteRoot.StringArray(), ", ")
+	}
+
+	return err
+}
+
+func (c *Control) Remove(remotePath *RemotePath, reply *ControlReply) error {
+	err := Ifs().Remove(remotePath)
+
+	if err == nil {
+		reply.Message = "Removed " + remotePath.String()
+	}
+
+	return err
+}
+
+func (c *Control) Reload(_ bool, reply *ReloadResult) error {
+	result, err := ReloadConfig()
+
+	if err == nil {
+		result.log()
+		*reply = *result
+	}
+
+	return err
+}
+
+func serveControl(socketPath string, mountPoint string) (net.Listener, error) {
+
+	server := rpc.NewServer()
+	err := server.Register(&Control{
+		mountPoint: mountPoint,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := clearControlSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	// Created without permissions for anyone else instead of restricted
+	// after, when another user could already have connected
+	mask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(mask)
+
+	if err != nil {
+		return nil, err
+	}
+
+	zap.L().Info("Control Socket Listening",
+		zap.String("path", socketPath),
+	)
+
+	go server.Accept(listener)
+
+	return listener, nil
+}
+
+// Clears a socket left behind by a mount that crashed, one that a mount
+// still answers on is in use and fails the startup
+func clearControlSocket(socketPath string) error {
+
+	conn, err := net.DialTimeout("unix", socketPath, ControlDialTimeout)
+
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by a running mount", socketPath)
+	}
+
+	return removeStaleSocket(socketPath)
+}
+
+func callControl(socketPath string, method string, args interface{}) (*ControlReply, error) {
+
+	client, err := rpc.Dial("unix", socketPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	reply := &ControlReply{}
+	err = client.Call("Control."+method, args, reply)
+
+	return reply, err
+}
+
+// Asks the mount listening on socketPath to add the paths of remoteRoot
+func AddRemoteRoot(socketPath string, remoteRoot *RemoteRoot) (string, error) {
+	reply, err := callControl(socketPath, "Add", remoteRoot)
+
+	if err != nil {
+		return "", err
+	}
+
+	return reply.Message, nil
+}
+
+// Asks the mount listening on socketPath to remove remotePath
+func RemoveRemotePath(socketPath string, remotePath *RemotePath) (string, error) {
+	reply, err := callControl(socketPath, "Remove", remotePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	return reply.Message, nil
+}
+
+// Fetches the health of the mount listening on socketPath, verbose also
+// reports every mounted path
+func GetMountStatus(socketPath string, verbose bool) (*MountStatus, error) {
+
+	client, err := rpc.Dial("unix", socketPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	status := &MountStatus{}
+	err = client.Call("Control.Status", verbose, status)
+
+	return status, err
+}
+
+// Asks the mount listening on socketPath to reload its config
+func ReloadMount(socketPath string) (*ReloadResult, error) {
+
+	client, err := rpc.Dial("unix", socketPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	result := &ReloadResult{}
+	err = client.Call("Control.Reload", false, result)
+
+	return result, err
+}
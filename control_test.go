@@ -0,0 +1,143 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestMountStatus_Down(t *testing.T) {
+
+	status := &ifs.MountStatus{
+		Hosts: []*ifs.HostStatus{
+			{Address: "localhost:11211", Up: true},
+			{Address: "localhost:11212", Up: false},
+		},
+	}
+
+	down := status.Down()
+
+	Compare(t, len(down), 1)
+	Compare(t, down[0].Address, "localhost:11212")
+}
+
+func TestGetMountStatus(t *testing.T) {
+
+	_, err := ifs.GetMountStatus("/tmp/ifs-not-mounted.sock", false)
+	Err(t, err)
+}
+
+func TestReloadConfig(t *testing.T) {
+
+	ifs.SetConfigLoader(func() (*ifs.FsConfig, error) {
+		return &ifs.FsConfig{}, nil
+	})
+
+	// Nothing is mounted so there is no config to compare against
+	_, err := ifs.ReloadConfig()
+	Err(t, err)
+}
+
+// A stale socket is replaced, a live one or anything else at the path is
+// left alone, and nobody else can connect to the new socket
+func TestServeControl(t *testing.T) {
+
+	socket := path.Join(os.TempDir(), "ifs_control_"+strconv.Itoa(os.Getpid())+".sock")
+	defer os.Remove(socket)
+
+	// Bound and never cleaned up, the way a crashed mount leaves it
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	Ok(t, err)
+	Ok(t, syscall.Bind(fd, &syscall.SockaddrUnix{Name: socket}))
+	syscall.Close(fd)
+
+	listener, err := ifs.ServeControl(socket, "/mnt/ifs")
+	Ok(t, err)
+
+	info, err := os.Lstat(socket)
+	Ok(t, err)
+	Compare(t, info.Mode().Perm(), os.FileMode(0600))
+
+	_, err = ifs.ServeControl(socket, "/mnt/ifs")
+	Err(t, err)
+
+	status, err := ifs.GetMountStatus(socket, false)
+	Ok(t, err)
+	Compare(t, status.MountPoint, "/mnt/ifs")
+
+	listener.Close()
+
+	Ok(t, ioutil.WriteFile(socket, []byte("config"), 0644))
+
+	_, err = ifs.ServeControl(socket, "/mnt/ifs")
+	Err(t, err)
+
+	data, err := ioutil.ReadFile(socket)
+	Ok(t, err)
+	Compare(t, string(data), "config")
+}
+
+// Changes that failed or wait for a restart stay out of the running config,
+// so the next reload tries and reports them again
+func TestReloadConfig_Partial(t *testing.T) {
+
+	kept := &ifs.RemoteRoot{Hostname: "localhost", Port: 11231, Paths: []string{"/tmp/kept"}}
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{kept})
+
+	// Listed by the old config without being mounted, so removing it fails
+	old := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11231, Paths: []string{"/tmp/kept", "/tmp/gone"}},
+		},
+	}
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/other",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11231, Paths: []string{"/tmp/kept", "/tmp/kept/overlap"}},
+		},
+	}
+
+	ifs.SetFsConfig(old)
+	ifs.SetConfigLoader(func() (*ifs.FsConfig, error) {
+		return cfg, nil
+	})
+	defer ifs.SetFsConfig(nil)
+
+	for i := 0; i < 2; i++ {
+		result, err := ifs.ReloadConfig()
+		Ok(t, err)
+
+		Compare(t, len(result.Errors), 2)
+		Compare(t, result.RestartRequired, []string{"mount_point"})
+
+		running := ifs.GetFsConfig()
+		Compare(t, running.MountPoint, "/tmp/ifs")
+		Compare(t, running.RemoteRoots, []*ifs.RemoteRoot{
+			{Hostname: "localhost", Port: 11231, Paths: []string{"/tmp/kept", "/tmp/gone"}},
+		})
+	}
+}
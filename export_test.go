@@ -0,0 +1,141 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"github.com/orcaman/concurrent-map"
+	"strconv"
+	"sync/atomic"
+)
+
+// Rewinds the ids of a table so that tests can make them collide
+func (t *InFlightTable) SetLast(last uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.last = last
+}
+
+func (t *talker) SendBatched(opCode uint8, remotePaths []*RemotePath) []*Packet {
+	return t.sendBatched(opCode, remotePaths)
+}
+
+type ByteLimiter = byteLimiter
+
+var NewByteLimiter = newByteLimiter
+
+func (l *byteLimiter) Acquire(n int64) int64 {
+	return l.acquire(n)
+}
+
+func (l *byteLimiter) Release(n int64) {
+	l.release(n)
+}
+
+func (l *byteLimiter) SetLimit(limit int64) {
+	l.setLimit(limit)
+}
+
+var WriteSparse = writeSparse
+
+var RemoveStaleSocket = removeStaleSocket
+
+// Union of remotePaths in the given order, which config cannot express for
+// unix agents as they have no port
+func NewUnionNode(policy string, remotePaths ...*RemotePath) *UnionNode {
+
+	un := generateUnion(&UnionConfig{Name: "union", CreatePolicy: policy})
+
+	for _, remotePath := range remotePaths {
+		cm := cmap.New()
+		un.Members = append(un.Members, &RemoteNode{
+			IsDir:       true,
+			RemotePath:  remotePath,
+			RemoteNodes: &cm,
+		})
+	}
+
+	return un
+}
+
+func (t *talker) SendRequest(opCode uint8, address string, payload Payload) *Packet {
+	return t.sendRequest(opCode, address, payload)
+}
+
+// Adds a replica group over agents the talker is connected to already
+func (t *talker) AddReplicaSet(cfg *ReplicaConfig) {
+	rs := newReplicaSet(cfg)
+	t.Replicas.Set(rs.Address(), rs)
+}
+
+// Replica holding a descriptor opened through the group
+func (t *talker) ReplicaHandle(cfg *ReplicaConfig, fd uint64) string {
+
+	val, _ := t.Replicas.Get(cfg.RemotePath().Address())
+	handle, ok := val.(*ReplicaSet).handles.Get(strconv.FormatUint(fd, 10))
+
+	if !ok {
+		return ""
+	}
+
+	return handle.(*replicaHandle).address
+}
+
+// Fails every connection to address as if the agent had gone away
+func (t *talker) FailHost(address string) {
+	for _, state := range t.getPool(address).States {
+		state.fail()
+	}
+}
+
+var ServeControl = serveControl
+
+func (a *agent) IsExported(req *Packet) bool {
+	return a.isExported(req)
+}
+
+// Config the mount runs with, as a reload sees it
+func SetFsConfig(cfg *FsConfig) {
+	fsConfig = cfg
+}
+
+func GetFsConfig() *FsConfig {
+	return fsConfig
+}
+
+func (h *hoarder) CacheFile(remotePath *RemotePath) error {
+	return h.cacheFile(remotePath)
+}
+
+// Ceiling on the file data in flight for the whole mount
+func (t *talker) Memory() *byteLimiter {
+	return t.memory
+}
+
+func (rn *RemoteNode) LogMoveProgress(remotePath *RemotePath, destPath *RemotePath) func(int64, int64) {
+	return rn.logMoveProgress(remotePath, destPath)
+}
+
+var ShutdownMount = shutdown
+
+// Lets the talker send again after a shutdown, the connections it closed
+// stay closed
+func (t *talker) Reopen() {
+	atomic.StoreInt32(&t.closing, 0)
+}
@@ -114,13 +114,13 @@ func (fh *FileHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		FileDescriptor: fh.FileDescriptor,
 	}
 
-	resp := Talker().sendRequest(ReadDirRequest, rn.RemotePath.Hostname, req)
+	resp := Talker().sendRequest(ReadDirRequest, rn.RemotePath.Address(), req)
 
 	var children []fuse.Dirent
 	//rn.RemoteNodes = make(map[string] *RemoteNode)
 
-	var err error
-	if respError, ok := resp.Data.(Error); !ok {
+	err := resp.Err()
+	if err == nil {
 
 		files := resp.Data.(*DirInfo).Stats
 
@@ -146,11 +146,13 @@ func (fh *FileHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 				zap.Time("mtime", time.Unix(0, s.ModTime)),
 			)
 
+			inode := GenerateInode(rn.RemotePath.Address(), s.Dev, s.Ino)
+
 			var child fuse.Dirent
 			if s.IsDir {
-				child = fuse.Dirent{Type: fuse.DT_Dir, Name: s.Name}
+				child = fuse.Dirent{Inode: inode, Type: fuse.DT_Dir, Name: s.Name}
 			} else {
-				child = fuse.Dirent{Type: fuse.DT_File, Name: s.Name}
+				child = fuse.Dirent{Inode: inode, Type: fuse.DT_File, Name: s.Name}
 			}
 			children = append(children, child)
 
@@ -171,10 +173,7 @@ func (fh *FileHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 				Hoarder().CacheFetch(rn.RemotePath)
 			}
 
-			newRn.Size = uint64(s.Size)
-			newRn.Mode = s.Mode
-			newRn.Mtime = mtime
-			newRn.IsCached = true
+			newRn.setStat(s)
 
 			newRns.Set(s.Name, newRn)
 			//rn.RemoteNodes[s.Name] = newRn
@@ -187,7 +186,6 @@ func (fh *FileHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		return children, nil
 
 	} else {
-		err = respError.Err
 
 		zap.L().Warn("ReadDir Error Response",
 			zap.String("op", "readdir"),
@@ -18,13 +18,17 @@ package ifs
 
 import (
 	"bazil.org/fuse"
+	"fmt"
 	"github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
+	"io"
 	"os"
 	"path"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
@@ -35,6 +39,9 @@ var (
 type fileHandler struct {
 	FileDescriptor uint64
 	Opened         cmap.ConcurrentMap
+
+	// Set to 1 to stream renames between hosts, changes on reload
+	crossHostRename int32
 }
 
 func FileHandler() *fileHandler {
@@ -48,8 +55,27 @@ func FileHandler() *fileHandler {
 	return fh
 }
 
-func (fh *fileHandler) StartUp() {
-	zap.L().Info("Starting File Handler")
+func (fh *fileHandler) StartUp(crossHostRename bool) {
+	fh.SetCrossHostRename(crossHostRename)
+
+	zap.L().Info("Starting File Handler",
+		zap.Bool("cross_host_rename", crossHostRename),
+	)
+}
+
+func (fh *fileHandler) SetCrossHostRename(enabled bool) {
+	var value int32
+
+	if enabled {
+		value = 1
+	}
+
+	atomic.StoreInt32(&fh.crossHostRename, value)
+}
+
+// Whether renames between hosts are done by streaming the file across
+func (fh *fileHandler) CrossHostRename() bool {
+	return atomic.LoadInt32(&fh.crossHostRename) == 1
 }
 
 func (fh *fileHandler) OpenFile(remotePath *RemotePath, flags fuse.OpenFlags, isDir bool) (uint64, error) {
@@ -66,13 +92,13 @@ func (fh *fileHandler) OpenFile(remotePath *RemotePath, flags fuse.OpenFlags, is
 		go Hoarder().CacheOpen(remotePath, fd, flags)
 	}
 
-	resp := Talker().sendRequest(OpenRequest, remotePath.Hostname, openInfo)
+	resp := Talker().sendRequest(OpenRequest, remotePath.Address(), openInfo)
 
-	if err, ok := resp.Data.(Error); ok {
-		return 0, err.Err
+	if err := resp.Err(); err != nil {
+		return 0, err
 	}
 
-	fh.Opened.Set(strconv.FormatUint(fd, 10), openInfo)
+	fh.Opened.Set(strconv.FormatUint(fd, 10), remotePath)
 
 	return fd, nil
 }
@@ -94,10 +120,10 @@ func (fh *fileHandler) ReadData(handle *FileHandle, offset int64, size int) ([]b
 				Size:           size,
 			}
 
-			resp := Talker().sendRequest(ReadFileRequest, handle.RemoteNode.RemotePath.Hostname, fileReadInfo)
+			resp := Talker().sendRequest(ReadFileRequest, handle.RemoteNode.RemotePath.Address(), fileReadInfo)
 
-			if err, ok := resp.Data.(Error); ok {
-				return nil, err.Err
+			if err := resp.Err(); err != nil {
+				return nil, err
 			} else {
 				// TODO If EOF is returned in Read then for some reason decompress is happening and failing
 				fileChunk := resp.Data.(*FileChunk)
@@ -124,9 +150,9 @@ func (fh *fileHandler) WriteData(handle *FileHandle, data []byte, offset int64)
 			Offset:         offset,
 			Data:           data,
 		}
-		resp := Talker().sendRequest(WriteFileRequest, handle.RemoteNode.RemotePath.Hostname, writeInfo)
-		if err, ok := resp.Data.(Error); ok {
-			return 0, err.Err
+		resp := Talker().sendRequest(WriteFileRequest, handle.RemoteNode.RemotePath.Address(), writeInfo)
+		if err := resp.Err(); err != nil {
+			return 0, err
 		}
 
 		writeResult := resp.Data.(*WriteResult)
@@ -140,6 +166,8 @@ func (fh *fileHandler) WriteData(handle *FileHandle, data []byte, offset int64)
 		}
 
 		handle.RemoteNode.Size = uint64(writeResult.FileSize)
+		handle.RemoteNode.Mtime = time.Unix(0, writeResult.ModTime)
+		handle.RemoteNode.Ctime = time.Unix(0, writeResult.CTime)
 
 		return writeResult.Size, nil
 	}
@@ -149,10 +177,10 @@ func (fh *fileHandler) WriteData(handle *FileHandle, data []byte, offset int64)
 
 func (fh *fileHandler) Truncate(remotePath *RemotePath, attrInfo *AttrInfo) error {
 
-	resp := Talker().sendRequest(SetAttrRequest, remotePath.Hostname, attrInfo)
+	resp := Talker().sendRequest(SetAttrRequest, remotePath.Address(), attrInfo)
 
-	if err, ok := resp.Data.(Error); ok {
-		return err.Err
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	Hoarder().CacheTrunc(remotePath, attrInfo)
@@ -160,6 +188,45 @@ func (fh *fileHandler) Truncate(remotePath *RemotePath, attrInfo *AttrInfo) erro
 	return nil
 }
 
+// Preallocates or punches a hole in an open file. FUSE in bazil does not
+// forward fallocate so this is only reachable through the library.
+func (fh *fileHandler) Allocate(handle *FileHandle, mode uint32, offset int64, length int64) error {
+
+	if _, ok := fh.Opened.Get(strconv.FormatUint(handle.FileDescriptor, 10)); !ok {
+		return os.ErrInvalid
+	}
+
+	allocateInfo := &AllocateInfo{
+		Path:           handle.RemoteNode.RemotePath.Path,
+		FileDescriptor: handle.FileDescriptor,
+		Mode:           mode,
+		Offset:         offset,
+		Length:         length,
+	}
+
+	resp := Talker().sendRequest(AllocateRequest, handle.RemoteNode.RemotePath.Address(), allocateInfo)
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	err := Hoarder().CacheAllocate(handle.FileDescriptor, allocateInfo)
+
+	if err != nil {
+		zap.L().Warn("Cache Allocate Failed",
+			zap.Error(err),
+		)
+	}
+
+	end := uint64(offset + length)
+
+	if mode&FallocKeepSize == 0 && end > handle.RemoteNode.Size {
+		handle.RemoteNode.Size = end
+	}
+
+	return nil
+}
+
 func (fh *fileHandler) Release(handle *FileHandle) error {
 	if _, ok := fh.Opened.Get(strconv.FormatUint(handle.FileDescriptor, 10)); ok {
 
@@ -168,10 +235,10 @@ func (fh *fileHandler) Release(handle *FileHandle) error {
 			Path:           handle.RemoteNode.RemotePath.Path,
 		}
 
-		resp := Talker().sendRequest(CloseRequest, handle.RemoteNode.RemotePath.Hostname, closeInfo)
+		resp := Talker().sendRequest(CloseRequest, handle.RemoteNode.RemotePath.Address(), closeInfo)
 
-		if err, ok := resp.Data.(Error); ok {
-			return err.Err
+		if err := resp.Err(); err != nil {
+			return err
 		}
 
 		if !handle.RemoteNode.IsDir {
@@ -194,6 +261,50 @@ func (fh *fileHandler) Release(handle *FileHandle) error {
 	return os.ErrNotExist
 }
 
+// Closes every descriptor still open on the agents and in the cache
+func (fh *fileHandler) CloseAll() {
+	fh.closeOpened(func(remotePath *RemotePath) bool {
+		return true
+	})
+
+	zap.L().Info("Closed All Open Files")
+}
+
+// Closes the descriptors open on root or anything below it
+func (fh *fileHandler) CloseUnder(root *RemotePath) {
+	fh.closeOpened(root.Contains)
+}
+
+// Number of descriptors open on root or anything below it
+func (fh *fileHandler) OpenHandles(root *RemotePath) int {
+
+	count := 0
+
+	for tup := range fh.Opened.IterBuffered() {
+		if root.Contains(tup.Val.(*RemotePath)) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (fh *fileHandler) closeOpened(match func(*RemotePath) bool) {
+	for tup := range fh.Opened.IterBuffered() {
+
+		fd, _ := strconv.ParseUint(tup.Key, 10, 64)
+		remotePath := tup.Val.(*RemotePath)
+
+		if !match(remotePath) {
+			continue
+		}
+
+		fh.closeRemote(remotePath, fd)
+		Hoarder().CacheClose(fd)
+		fh.Opened.Remove(tup.Key)
+	}
+}
+
 func (fh *fileHandler) Create(remotePath *RemotePath, name string) (uint64, error) {
 
 	fd := atomic.AddUint64(&fh.FileDescriptor, 1)
@@ -205,10 +316,10 @@ func (fh *fileHandler) Create(remotePath *RemotePath, name string) (uint64, erro
 		FileDescriptor: fd,
 	}
 
-	resp := Talker().sendRequest(CreateRequest, remotePath.Hostname, req)
+	resp := Talker().sendRequest(CreateRequest, remotePath.Address(), req)
 
-	if err, ok := resp.Data.(Error); ok {
-		return 0, err.Err
+	if err := resp.Err(); err != nil {
+		return 0, err
 	}
 
 	newRemotePath := &RemotePath{
@@ -225,7 +336,7 @@ func (fh *fileHandler) Create(remotePath *RemotePath, name string) (uint64, erro
 		)
 	}
 
-	fh.Opened.Set(strconv.FormatUint(fd, 10), req)
+	fh.Opened.Set(strconv.FormatUint(fd, 10), newRemotePath)
 
 	return fd, nil
 }
@@ -237,15 +348,26 @@ func (fh *fileHandler) Mkdir(remotePath *RemotePath, name string) error {
 		IsDir:   true,
 	}
 
-	resp := Talker().sendRequest(CreateRequest, remotePath.Hostname, req)
+	resp := Talker().sendRequest(CreateRequest, remotePath.Address(), req)
 
-	if err, ok := resp.Data.(Error); ok {
-		return err.Err
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// Space left on the filesystem holding remotePath
+func (fh *fileHandler) Statfs(remotePath *RemotePath) (*FsStat, error) {
+	resp := Talker().sendRequest(StatfsRequest, remotePath.Address(), remotePath)
+
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	return resp.Data.(*FsStat), nil
+}
+
 func (fh *fileHandler) Remove(remotePath *RemotePath, name string, isDir bool) error {
 
 	newRemotePath := &RemotePath{
@@ -254,10 +376,10 @@ func (fh *fileHandler) Remove(remotePath *RemotePath, name string, isDir bool) e
 		Path:     path.Join(remotePath.Path, name),
 	}
 
-	resp := Talker().sendRequest(RemoveRequest, remotePath.Hostname, newRemotePath)
+	resp := Talker().sendRequest(RemoveRequest, remotePath.Address(), newRemotePath)
 
-	if err, ok := resp.Data.(Error); ok {
-		return err.Err
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	if !isDir {
@@ -279,10 +401,10 @@ func (fh *fileHandler) Rename(remotePath *RemotePath, destPath string) error {
 		DestPath: destPath,
 	}
 
-	resp := Talker().sendRequest(RenameRequest, remotePath.Hostname, req)
+	resp := Talker().sendRequest(RenameRequest, remotePath.Address(), req)
 
-	if err, ok := resp.Data.(Error); ok {
-		return err.Err
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	err := Hoarder().CacheRename(remotePath, destPath)
@@ -296,6 +418,195 @@ func (fh *fileHandler) Rename(remotePath *RemotePath, destPath string) error {
 	return nil
 }
 
+func (fh *fileHandler) Copy(remotePath *RemotePath, destPath *RemotePath) error {
+
+	// Agents can only copy between paths on their own disk
+	if remotePath.Address() != destPath.Address() {
+		return syscall.EXDEV
+	}
+
+	req := &CopyInfo{
+		Path:     remotePath.Path,
+		DestPath: destPath.Path,
+	}
+
+	resp := Talker().sendRequest(CopyRequest, remotePath.Address(), req)
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	// Destination might have been cached before it was overwritten
+	Hoarder().CacheDelete(destPath)
+
+	return nil
+}
+
+// Moves a file between two agents by streaming it through this machine. The
+// data is written to a temporary file beside the destination and only renamed
+// into place once it is complete, so a failed move leaves both sides as they
+// were.
+func (fh *fileHandler) Move(remotePath *RemotePath, destPath *RemotePath, progress func(int64, int64)) error {
+
+	resp := Talker().sendRequest(AttrRequest, remotePath.Address(), remotePath)
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	stat := resp.Data.(*Stat)
+
+	// Let the caller fall back to a recursive copy
+	if stat.IsDir {
+		return syscall.EXDEV
+	}
+
+	srcFd := atomic.AddUint64(&fh.FileDescriptor, 1)
+	tempFd := atomic.AddUint64(&fh.FileDescriptor, 1)
+
+	tempPath := &RemotePath{
+		Hostname: destPath.Hostname,
+		Port:     destPath.Port,
+		Path:     path.Join(path.Dir(destPath.Path), fmt.Sprintf(".%s.ifs-%d", path.Base(destPath.Path), tempFd)),
+	}
+
+	openInfo := &OpenInfo{
+		Path:           remotePath.Path,
+		FileDescriptor: srcFd,
+		Flags:          fuse.OpenReadOnly,
+	}
+
+	resp = Talker().sendRequest(OpenRequest, remotePath.Address(), openInfo)
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	defer fh.closeRemote(remotePath, srcFd)
+
+	createInfo := &CreateInfo{
+		BaseDir:        path.Dir(tempPath.Path),
+		Name:           path.Base(tempPath.Path),
+		FileDescriptor: tempFd,
+	}
+
+	resp = Talker().sendRequest(CreateRequest, tempPath.Address(), createInfo)
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	err := fh.transfer(remotePath, srcFd, tempPath, tempFd, stat.Size, progress)
+	fh.closeRemote(tempPath, tempFd)
+
+	if err == nil {
+		attrInfo := &AttrInfo{
+			Path:  tempPath.Path,
+			Valid: fuse.SetattrMode | fuse.SetattrAtime | fuse.SetattrMtime,
+			Mode:  stat.Mode,
+			ATime: stat.ModTime,
+			MTime: stat.ModTime,
+		}
+
+		resp = Talker().sendRequest(SetAttrRequest, tempPath.Address(), attrInfo)
+		err = resp.Err()
+	}
+
+	if err == nil {
+		renameInfo := &RenameInfo{
+			Path:     tempPath.Path,
+			DestPath: destPath.Path,
+		}
+
+		resp = Talker().sendRequest(RenameRequest, destPath.Address(), renameInfo)
+		err = resp.Err()
+	}
+
+	if err != nil {
+		Talker().sendRequest(RemoveRequest, tempPath.Address(), tempPath)
+
+		zap.L().Warn("Move Rolled Back",
+			zap.String("path", remotePath.String()),
+			zap.String("dest_path", destPath.String()),
+			zap.Error(err),
+		)
+
+		return err
+	}
+
+	resp = Talker().sendRequest(RemoveRequest, remotePath.Address(), remotePath)
+
+	// Both copies exist at this point, keeping them is safer than undoing
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	Hoarder().CacheDelete(destPath)
+	Hoarder().CacheMove(remotePath, destPath)
+
+	return nil
+}
+
+func (fh *fileHandler) transfer(remotePath *RemotePath, fd uint64, destPath *RemotePath, destFd uint64, size int64, progress func(int64, int64)) error {
+
+	for offset := int64(0); offset < size; {
+
+		readInfo := &ReadInfo{
+			Path:           remotePath.Path,
+			FileDescriptor: fd,
+			Offset:         offset,
+			Size:           TransferChunkSize,
+		}
+
+		resp := Talker().sendRequest(ReadFileRequest, remotePath.Address(), readInfo)
+		err := resp.Err()
+
+		// File was truncated while it was being moved, the agent answers a
+		// read past its end with EOF
+		if err != nil && err.Error() == io.EOF.Error() {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		chunk := resp.Data.(*FileChunk).Chunk
+
+		if len(chunk) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		writeInfo := &WriteInfo{
+			Path:           destPath.Path,
+			FileDescriptor: destFd,
+			Offset:         offset,
+			Data:           chunk,
+		}
+
+		resp = Talker().sendRequest(WriteFileRequest, destPath.Address(), writeInfo)
+
+		if err := resp.Err(); err != nil {
+			return err
+		}
+
+		offset += int64(len(chunk))
+
+		if progress != nil {
+			progress(offset, size)
+		}
+	}
+
+	return nil
+}
+
+func (fh *fileHandler) closeRemote(remotePath *RemotePath, fd uint64) {
+	closeInfo := &CloseInfo{
+		Path:           remotePath.Path,
+		FileDescriptor: fd,
+	}
+
+	Talker().sendRequest(CloseRequest, remotePath.Address(), closeInfo)
+}
+
 //func (fh *fileHandler) Flush(handle *FileHandle) error {
 //	req := &FlushInfo{
 //		RemotePath: handle.RemoteNode.RemotePath,
@@ -0,0 +1,152 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"bytes"
+	"github.com/chemistry-sourabh/ifs"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Larger than a transfer chunk so that a move takes several round trips
+const moveSize = 3*ifs.TransferChunkSize + 10
+
+// A file to move from the first agent to the second with its contents
+func setupMove(t *testing.T) (*ifs.RemotePath, *ifs.RemotePath, []byte, func()) {
+
+	remotePaths, cleanup := startAgents(t, "move-src", "move-dest")
+
+	data := bytes.Repeat([]byte("ifs"), moveSize/3+1)[:moveSize]
+	Ok(t, ioutil.WriteFile(path.Join(remotePaths[0].Path, "file"), data, 0644))
+
+	src := &ifs.RemotePath{Hostname: remotePaths[0].Hostname, Path: path.Join(remotePaths[0].Path, "file")}
+	dest := &ifs.RemotePath{Hostname: remotePaths[1].Hostname, Path: path.Join(remotePaths[1].Path, "file")}
+
+	return src, dest, data, cleanup
+}
+
+// Names in the directory of p, temporary files included
+func dirNames(p string) []string {
+	names, _ := filepath.Glob(path.Join(path.Dir(p), "*"))
+	hidden, _ := filepath.Glob(path.Join(path.Dir(p), ".*"))
+	return append(names, hidden...)
+}
+
+func TestFileHandler_Move(t *testing.T) {
+
+	src, dest, data, cleanup := setupMove(t)
+	defer cleanup()
+
+	var reports []int64
+	Ok(t, ifs.FileHandler().Move(src, dest, func(done int64, total int64) {
+		reports = append(reports, done)
+	}))
+
+	Compare(t, reports, []int64{ifs.TransferChunkSize, 2 * ifs.TransferChunkSize, 3 * ifs.TransferChunkSize, moveSize})
+
+	written, err := ioutil.ReadFile(dest.Path)
+	Ok(t, err)
+	Compare(t, bytes.Equal(written, data), true)
+
+	Compare(t, exists(src.Path), false)
+	Compare(t, dirNames(dest.Path), []string{dest.Path})
+}
+
+// A copy that breaks off leaves the source alone and nothing at the
+// destination
+func TestFileHandler_MoveFailedCopy(t *testing.T) {
+
+	src, dest, data, cleanup := setupMove(t)
+	defer cleanup()
+
+	// The source shrinks under the move after the first chunk
+	err := ifs.FileHandler().Move(src, dest, func(done int64, total int64) {
+		if done == ifs.TransferChunkSize {
+			Ok(t, os.Truncate(src.Path, done))
+		}
+	})
+	Compare(t, err == io.ErrUnexpectedEOF, true)
+
+	Compare(t, exists(src.Path), true)
+	Compare(t, dirNames(dest.Path) == nil, true)
+
+	// The destination agent goes away halfway through
+	Ok(t, ioutil.WriteFile(src.Path, data, 0644))
+
+	err = ifs.FileHandler().Move(src, dest, func(done int64, total int64) {
+		if done == ifs.TransferChunkSize {
+			ifs.Talker().FailHost(dest.Address())
+		}
+	})
+	Compare(t, err, syscall.EHOSTDOWN)
+
+	written, err := ioutil.ReadFile(src.Path)
+	Ok(t, err)
+	Compare(t, bytes.Equal(written, data), true)
+	Compare(t, exists(dest.Path), false)
+}
+
+// Once the copy is in place a source that cannot be removed leaves both
+func TestFileHandler_MoveFailedDelete(t *testing.T) {
+
+	src, dest, data, cleanup := setupMove(t)
+	defer cleanup()
+
+	// The source agent goes away once everything has been read
+	err := ifs.FileHandler().Move(src, dest, func(done int64, total int64) {
+		if done == total {
+			ifs.Talker().FailHost(src.Address())
+		}
+	})
+	Compare(t, err, syscall.EHOSTDOWN)
+
+	written, err := ioutil.ReadFile(dest.Path)
+	Ok(t, err)
+	Compare(t, bytes.Equal(written, data), true)
+	Compare(t, exists(src.Path), true)
+}
+
+// Progress is logged from the first chunk on and then every 10%
+func TestRemoteNode_LogMoveProgress(t *testing.T) {
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	rn := &ifs.RemoteNode{}
+	progress := rn.LogMoveProgress(&ifs.RemotePath{Path: "/a"}, &ifs.RemotePath{Path: "/b"})
+
+	for _, done := range []int64{1, 5, 12, 15, 50, 100} {
+		progress(done, 100)
+	}
+
+	var logged []int64
+	for _, entry := range logs.FilterMessage("Move Progress").All() {
+		logged = append(logged, entry.ContextMap()["done"].(int64))
+	}
+
+	Compare(t, logged, []int64{1, 12, 50, 100})
+}
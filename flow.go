@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"sync"
+)
+
+// Bounds the bytes held by requests in flight. A request larger than the
+// whole limit waits until nothing else is held and then goes alone. A nil
+// limiter never blocks.
+type byteLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newByteLimiter(limit int64) *byteLimiter {
+	l := &byteLimiter{
+		limit: limit,
+	}
+
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Blocks until n bytes fit, returns what was taken which has to be handed
+// back to release
+func (l *byteLimiter) acquire(n int64) int64 {
+
+	if l == nil || n <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The limit may shrink while waiting, the cap follows it so that the
+	// request still fits once nothing else is held
+	for {
+		take := n
+
+		if take > l.limit {
+			take = l.limit
+		}
+
+		if l.used+take <= l.limit {
+			l.used += take
+			return take
+		}
+
+		l.cond.Wait()
+	}
+}
+
+func (l *byteLimiter) release(n int64) {
+
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.used -= n
+	l.mu.Unlock()
+
+	l.cond.Broadcast()
+}
+
+func (l *byteLimiter) setLimit(limit int64) {
+
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+
+	l.cond.Broadcast()
+}
+
+func (l *byteLimiter) Used() int64 {
+
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.used
+}
+
+// Bytes of file data a request moves, metadata costs nothing so it is
+// never held back by large transfers
+func requestBytes(opCode uint8, payload Payload) int64 {
+	switch opCode {
+	case WriteFileRequest:
+		return int64(len(payload.(*WriteInfo).Data))
+	case ReadFileRequest:
+		return int64(payload.(*ReadInfo).Size)
+	case FetchFileRequest:
+		// The file is not known from its path, callers that stat it first
+		// charge its size instead
+		return TransferChunkSize
+	}
+
+	return 0
+}
+
+// Megabytes from the config to bytes
+func megabytes(mb uint64) int64 {
+	return int64(mb) * 1024 * 1024
+}
@@ -0,0 +1,146 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"testing"
+	"time"
+)
+
+// Waits for acquire to return, false if it is still blocked after timeout
+func acquireWithin(l *ifs.ByteLimiter, n int64, timeout time.Duration) (int64, bool) {
+
+	taken := make(chan int64, 1)
+
+	go func() {
+		taken <- l.Acquire(n)
+	}()
+
+	select {
+	case got := <-taken:
+		return got, true
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
+
+func TestByteLimiter_AcquireRelease(t *testing.T) {
+
+	l := ifs.NewByteLimiter(100)
+
+	Compare(t, l.Acquire(60), int64(60))
+	Compare(t, l.Acquire(40), int64(40))
+	Compare(t, l.Used(), int64(100))
+
+	// Full, the next one waits for a release
+	done := make(chan int64, 1)
+	go func() {
+		done <- l.Acquire(10)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("acquire did not wait on a full limiter")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release(60)
+
+	select {
+	case got := <-done:
+		Compare(t, got, int64(10))
+	case <-time.After(time.Second):
+		t.Fatal("acquire still blocked after release")
+	}
+
+	Compare(t, l.Used(), int64(50))
+}
+
+func TestByteLimiter_OverLimit(t *testing.T) {
+
+	l := ifs.NewByteLimiter(100)
+
+	// Larger than the limit, it takes the whole limit and goes alone
+	Compare(t, l.Acquire(500), int64(100))
+
+	if _, ok := acquireWithin(l, 1, 50*time.Millisecond); ok {
+		t.Fatal("acquire went through beside a request holding the whole limit")
+	}
+
+	l.Release(100)
+}
+
+func TestByteLimiter_Nil(t *testing.T) {
+
+	var l *ifs.ByteLimiter
+
+	Compare(t, l.Acquire(10), int64(0))
+	Compare(t, l.Used(), int64(0))
+	l.Release(10)
+	l.SetLimit(10)
+}
+
+func TestByteLimiter_Shrink(t *testing.T) {
+
+	l := ifs.NewByteLimiter(100)
+
+	Compare(t, l.Acquire(50), int64(50))
+
+	done := make(chan int64, 1)
+	go func() {
+		done <- l.Acquire(80)
+	}()
+
+	// Waiting for 80 when the limit drops below it
+	time.Sleep(50 * time.Millisecond)
+	l.SetLimit(60)
+	l.Release(50)
+
+	select {
+	case got := <-done:
+		Compare(t, got, int64(60))
+	case <-time.After(time.Second):
+		t.Fatal("acquire stuck after the limit shrank")
+	}
+
+	Compare(t, l.Used(), int64(60))
+}
+
+func TestByteLimiter_Grow(t *testing.T) {
+
+	l := ifs.NewByteLimiter(100)
+
+	Compare(t, l.Acquire(100), int64(100))
+
+	done := make(chan int64, 1)
+	go func() {
+		done <- l.Acquire(50)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	l.SetLimit(150)
+
+	select {
+	case got := <-done:
+		Compare(t, got, int64(50))
+	case <-time.After(time.Second):
+		t.Fatal("acquire stuck after the limit grew")
+	}
+}
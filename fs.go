@@ -19,12 +19,15 @@ package ifs
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"fmt"
 	"github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,6 +36,9 @@ import (
 
 type fileSystem struct {
 	RemoteRoots cmap.ConcurrentMap
+
+	// Serializes changes to the tree made while mounted
+	graftMu sync.Mutex
 }
 
 var (
@@ -54,6 +60,25 @@ func (root *fileSystem) Startup(remoteRoots []*RemoteRoot) {
 	root.RemoteRoots = generateRemoteRoots(remoteRoots)
 }
 
+// Adds a top level directory for each replica group, call after Startup
+func (root *fileSystem) StartupReplicas(replicas []*ReplicaConfig) {
+	for _, replica := range replicas {
+		cm := cmap.New()
+		root.RemoteRoots.Set(replica.Name, &RemoteNode{
+			IsDir:       true,
+			RemotePath:  replica.RemotePath(),
+			RemoteNodes: &cm,
+		})
+	}
+}
+
+// Adds a top level union directory for each config, call after Startup
+func (root *fileSystem) StartupUnions(unions []*UnionConfig) {
+	for _, union := range unions {
+		root.RemoteRoots.Set(union.Name, generateUnion(union))
+	}
+}
+
 // TODO All Errors should be resolved here
 func (root *fileSystem) Root() (fs.Node, error) {
 	return root, nil
@@ -73,6 +98,7 @@ func (root *fileSystem) Attr(ctx context.Context, attr *fuse.Attr) error {
 	curGroup, _ := user.LookupGroup("staff")
 	gid, _ := strconv.ParseUint(curGroup.Gid, 10, 64)
 
+	attr.Inode = 1
 	attr.Uid = uint32(uid)
 	attr.Gid = uint32(gid)
 	//attr.Size = uint64(10)
@@ -98,7 +124,7 @@ func (root *fileSystem) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	var children []fuse.Dirent
 
 	for dirName := range root.RemoteRoots.IterBuffered() {
-		child := fuse.Dirent{Type: fuse.DT_Dir, Name: dirName.Key}
+		child := fuse.Dirent{Inode: childInode(dirName.Val), Type: fuse.DT_Dir, Name: dirName.Key}
 		children = append(children, child)
 	}
 
@@ -135,7 +161,313 @@ func (root *fileSystem) Lookup(ctx context.Context, name string) (fs.Node, error
 	}
 }
 
-func generateVirtualNodes(paths []string, remotePaths []*RemotePath) cmap.ConcurrentMap {
+// Mounts the paths of remoteRoot into the running filesystem, connecting
+// to its agent if it has not been seen yet
+//
+// The paths go under the top level directory named by remoteRoot, which
+// defaults to the directory already used for the agent or else its hostname
+func (root *fileSystem) Add(remoteRoot *RemoteRoot) error {
+
+	root.graftMu.Lock()
+	defer root.graftMu.Unlock()
+
+	if err := remoteRoot.validate("remote_root"); err != nil {
+		return err
+	}
+
+	address := remoteRoot.Address()
+	name := remoteRoot.Name
+	existing, mounted := root.rootName(address)
+
+	if name == "" && mounted {
+		name = existing
+	} else if name == "" {
+		name = remoteRoot.Hostname
+	} else if mounted && name != existing {
+		return fmt.Errorf("%s is already mounted as %s", address, existing)
+	}
+
+	if val, ok := root.RemoteRoots.Get(name); ok {
+		if vn, isVn := val.(*VirtualNode); !isVn {
+			return fmt.Errorf("directory %s is a union or replica group, choose another name", name)
+		} else if vn.Address != address {
+			return fmt.Errorf("directory %s belongs to %s, choose another name", name, vn.Address)
+		}
+	}
+
+	localPaths := remoteRoot.LocalPaths()
+	remotePaths := remoteRoot.RemotePaths()
+
+	// Check every path before changing anything
+	for i, localPath := range localPaths {
+		if !root.canGraft(treeNames(name, localPath)) {
+			return fmt.Errorf("%s overlaps a mounted path", remoteRoot.Paths[i])
+		}
+	}
+
+	err := Talker().Connect(remoteRoot)
+
+	if err != nil {
+		return err
+	}
+
+	for i, localPath := range localPaths {
+
+		root.graft(treeNames(name, localPath), address, remotePaths[i])
+
+		zap.L().Info("Added Remote Path",
+			zap.String("remote_path", remotePaths[i].String()),
+			zap.String("local_path", path.Join(name, localPath)),
+		)
+	}
+
+	return nil
+}
+
+// Checks that nothing is mounted at or above names
+func (root *fileSystem) canGraft(names []string) bool {
+
+	nodes := root.RemoteRoots
+
+	for i, name := range names {
+
+		val, ok := nodes.Get(name)
+
+		if !ok {
+			return true
+		}
+
+		vn, isVn := val.(*VirtualNode)
+
+		if i == len(names)-1 || !isVn {
+			return false
+		}
+
+		nodes = vn.Nodes
+	}
+
+	return true
+}
+
+func (root *fileSystem) graft(names []string, address string, remotePath *RemotePath) {
+
+	var parent fs.Node = root
+	nodes := root.RemoteRoots
+
+	for i, name := range names[:len(names)-1] {
+
+		val, ok := nodes.Get(name)
+
+		if !ok {
+			vn := &VirtualNode{
+				Inode: GeneratePathInode(path.Join(names[:i+1]...)),
+				Nodes: cmap.New(),
+			}
+
+			if i == 0 {
+				vn.Address = address
+			}
+
+			val = vn
+			nodes.Set(name, val)
+		}
+
+		parent = val.(*VirtualNode)
+		nodes = val.(*VirtualNode).Nodes
+	}
+
+	cm := cmap.New()
+	nodes.Set(names[len(names)-1], &RemoteNode{
+		IsDir:       true,
+		RemotePath:  remotePath,
+		RemoteNodes: &cm,
+	})
+
+	invalidateEntry(parent, names[len(names)-1])
+}
+
+// Unmounts remotePath from the running filesystem after closing the files
+// open below it and dropping their cached copies
+func (root *fileSystem) Remove(remotePath *RemotePath) error {
+
+	root.graftMu.Lock()
+	defer root.graftMu.Unlock()
+
+	if name, ok := root.configName(remotePath); ok {
+		return fmt.Errorf("%s is mounted by %s from the config, change the config to remove it", remotePath, name)
+	}
+
+	names := root.findNames(remotePath)
+
+	if names == nil {
+		return fmt.Errorf("%s is not mounted", remotePath)
+	}
+
+	parents := []fs.Node{root}
+	maps := []cmap.ConcurrentMap{root.RemoteRoots}
+
+	for _, name := range names[:len(names)-1] {
+		val, _ := maps[len(maps)-1].Get(name)
+		parents = append(parents, val.(*VirtualNode))
+		maps = append(maps, val.(*VirtualNode).Nodes)
+	}
+
+	FileHandler().CloseUnder(remotePath)
+	Hoarder().CachePurge(remotePath)
+
+	// Detach the node and every virtual directory left empty by it
+	i := len(names) - 1
+	maps[i].Remove(names[i])
+
+	for i > 0 && maps[i].IsEmpty() {
+		i--
+		maps[i].Remove(names[i])
+	}
+
+	invalidateEntry(parents[i], names[i])
+
+	zap.L().Info("Removed Remote Path",
+		zap.String("remote_path", remotePath.String()),
+	)
+
+	return nil
+}
+
+// Every remote path mounted in the tree, sorted
+func (root *fileSystem) RemotePaths() []*RemotePath {
+
+	remotePaths := collectRemotePaths(root.RemoteRoots)
+
+	sort.Slice(remotePaths, func(i, j int) bool {
+		return remotePaths[i].String() < remotePaths[j].String()
+	})
+
+	return remotePaths
+}
+
+func collectRemotePaths(nodes cmap.ConcurrentMap) []*RemotePath {
+
+	var remotePaths []*RemotePath
+
+	for tup := range nodes.IterBuffered() {
+		switch node := tup.Val.(type) {
+		case *VirtualNode:
+			remotePaths = append(remotePaths, collectRemotePaths(node.Nodes)...)
+		case *RemoteNode:
+			remotePaths = append(remotePaths, node.RemotePath)
+		case *UnionNode:
+			for _, member := range node.Members {
+				remotePaths = append(remotePaths, member.RemotePath)
+			}
+		}
+	}
+
+	return remotePaths
+}
+
+// Name of the top level directory of the agent at address
+func (root *fileSystem) rootName(address string) (string, bool) {
+	for tup := range root.RemoteRoots.IterBuffered() {
+		if vn, ok := tup.Val.(*VirtualNode); ok && vn.Address == address {
+			return tup.Key, true
+		}
+	}
+
+	return "", false
+}
+
+// Where remotePath shows up below the mount point, empty if not mounted
+func (root *fileSystem) LocalPath(remotePath *RemotePath) string {
+	if name, ok := root.configName(remotePath); ok {
+		return name
+	}
+
+	return path.Join(root.findNames(remotePath)...)
+}
+
+// Name of the union or replica group serving remotePath
+func (root *fileSystem) configName(remotePath *RemotePath) (string, bool) {
+	for tup := range root.RemoteRoots.IterBuffered() {
+		switch node := tup.Val.(type) {
+		case *UnionNode:
+			for _, member := range node.Members {
+				if member.RemotePath.String() == remotePath.String() {
+					return tup.Key, true
+				}
+			}
+		case *RemoteNode:
+			if node.RemotePath.String() == remotePath.String() {
+				return tup.Key, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Names of the nodes leading to where remotePath is mounted, nil if it is not
+func (root *fileSystem) findNames(remotePath *RemotePath) []string {
+
+	name, ok := root.rootName(remotePath.Address())
+
+	if !ok {
+		return nil
+	}
+
+	val, _ := root.RemoteRoots.Get(name)
+	return searchNames([]string{name}, val, remotePath)
+}
+
+func searchNames(names []string, node interface{}, remotePath *RemotePath) []string {
+	switch n := node.(type) {
+	case *VirtualNode:
+		for tup := range n.Nodes.IterBuffered() {
+			if found := searchNames(append(names[:len(names):len(names)], tup.Key), tup.Val, remotePath); found != nil {
+				return found
+			}
+		}
+	case *RemoteNode:
+		if n.RemotePath.String() == remotePath.String() {
+			return names
+		}
+	}
+
+	return nil
+}
+
+// Names of the nodes leading to localPath below the top level directory
+// rootName
+func treeNames(rootName string, localPath string) []string {
+
+	names := []string{rootName}
+
+	for _, name := range strings.Split(strings.Trim(path.Clean(localPath), "/"), "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Tells the kernel to forget a cached lookup of name in parent
+func invalidateEntry(parent fs.Node, name string) {
+
+	if FuseServer() == nil {
+		return
+	}
+
+	err := FuseServer().InvalidateEntry(parent, name)
+
+	if err != nil && err != fuse.ErrNotCached {
+		zap.L().Warn("Invalidate Entry Failed",
+			zap.String("name", name),
+			zap.Error(err),
+		)
+	}
+}
+
+func generateVirtualNodes(prefix string, paths []string, remotePaths []*RemotePath) cmap.ConcurrentMap {
 
 	aggPaths := make(map[string][]string)
 	aggRemotePaths := make(map[string][]*RemotePath)
@@ -157,7 +489,8 @@ func generateVirtualNodes(paths []string, remotePaths []*RemotePath) cmap.Concur
 
 		if len(v) > 1 || (len(v) == 1 && v[0] != "") {
 			virtualNodes.Set(k, &VirtualNode{
-				Nodes: generateVirtualNodes(v, aggRemotePaths[k]),
+				Inode: GeneratePathInode(path.Join(prefix, k)),
+				Nodes: generateVirtualNodes(path.Join(prefix, k), v, aggRemotePaths[k]),
 			})
 		} else {
 			cm := cmap.New()
@@ -172,10 +505,12 @@ func generateVirtualNodes(paths []string, remotePaths []*RemotePath) cmap.Concur
 	return virtualNodes
 }
 
-func generateRemoteRoot(paths []string, remotePaths []*RemotePath) *VirtualNode {
+func generateRemoteRoot(name string, address string, paths []string, remotePaths []*RemotePath) *VirtualNode {
 
 	return &VirtualNode{
-		Nodes: generateVirtualNodes(paths, remotePaths),
+		Inode:   GeneratePathInode(name),
+		Address: address,
+		Nodes:   generateVirtualNodes(name, paths, remotePaths),
 	}
 }
 
@@ -184,9 +519,30 @@ func generateRemoteRoots(remoteRoots []*RemoteRoot) cmap.ConcurrentMap {
 	virtualNodes := cmap.New()
 
 	for _, remoteRoot := range remoteRoots {
-		vn := generateRemoteRoot(remoteRoot.Paths, remoteRoot.RemotePaths())
-		virtualNodes.Set(remoteRoot.Hostname, vn)
+		vn := generateRemoteRoot(remoteRoot.DirName(), remoteRoot.Address(), remoteRoot.LocalPaths(), remoteRoot.RemotePaths())
+		virtualNodes.Set(remoteRoot.DirName(), vn)
 	}
 
 	return virtualNodes
 }
+
+func generateUnion(union *UnionConfig) *UnionNode {
+
+	var members []*RemoteNode
+
+	for _, remotePath := range union.RemotePaths() {
+		cm := cmap.New()
+		members = append(members, &RemoteNode{
+			IsDir:       true,
+			RemotePath:  remotePath,
+			RemoteNodes: &cm,
+		})
+	}
+
+	return &UnionNode{
+		Inode:   GeneratePathInode(union.Name),
+		Members: members,
+		Policy:  union.CreatePolicy,
+		Unions:  cmap.New(),
+	}
+}
@@ -0,0 +1,178 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"testing"
+)
+
+func TestFileSystem_AddOverlap(t *testing.T) {
+
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{
+		{
+			Hostname: "localhost",
+			Port:     11211,
+			Paths:    []string{"/tmp/a"},
+		},
+	})
+
+	err := ifs.Ifs().Add(&ifs.RemoteRoot{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp/a/b"}})
+	Err(t, err)
+
+	err = ifs.Ifs().Add(&ifs.RemoteRoot{Hostname: "localhost", Port: 11211, Paths: []string{"/tmp"}})
+	Err(t, err)
+}
+
+func TestFileSystem_Remove(t *testing.T) {
+
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{
+		{
+			Hostname: "localhost",
+			Port:     11211,
+			Paths:    []string{"/tmp/a", "/tmp/b"},
+		},
+	})
+
+	err := ifs.Ifs().Remove(&ifs.RemotePath{Hostname: "localhost", Port: 11211, Path: "/tmp/c"})
+	Err(t, err)
+
+	err = ifs.Ifs().Remove(&ifs.RemotePath{Hostname: "localhost", Port: 11211, Path: "/tmp/a"})
+	Ok(t, err)
+
+	_, ok := ifs.Ifs().RemoteRoots.Get("localhost")
+	Compare(t, ok, true)
+
+	err = ifs.Ifs().Remove(&ifs.RemotePath{Hostname: "localhost", Port: 11211, Path: "/tmp/b"})
+	Ok(t, err)
+
+	// Empty virtual directories are removed along with the last path
+	_, ok = ifs.Ifs().RemoteRoots.Get("localhost")
+	Compare(t, ok, false)
+}
+
+func TestFileSystem_RemotePaths(t *testing.T) {
+
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{
+		{
+			Hostname: "localhost",
+			Port:     11211,
+			Paths:    []string{"/tmp/b", "/tmp/a", "/var"},
+		},
+	})
+
+	var got []string
+	for _, remotePath := range ifs.Ifs().RemotePaths() {
+		got = append(got, remotePath.String())
+	}
+
+	want := []string{"localhost:11211@/tmp/a", "localhost:11211@/tmp/b", "localhost:11211@/var"}
+	Compare(t, got, want)
+}
+
+func TestFileSystem_SameHostname(t *testing.T) {
+
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{
+		{
+			Name:     "first",
+			Hostname: "localhost",
+			Port:     11211,
+			Paths:    []string{"/tmp"},
+		},
+		{
+			Name:     "second",
+			Hostname: "localhost",
+			Port:     11212,
+			Paths:    []string{"/tmp"},
+		},
+	})
+
+	Compare(t, ifs.Ifs().LocalPath(&ifs.RemotePath{Hostname: "localhost", Port: 11212, Path: "/tmp"}), "second/tmp")
+
+	// A directory cannot be shared by two agents
+	err := ifs.Ifs().Add(&ifs.RemoteRoot{Name: "first", Hostname: "localhost", Port: 11213, Paths: []string{"/var"}})
+	Err(t, err)
+
+	err = ifs.Ifs().Remove(&ifs.RemotePath{Hostname: "localhost", Port: 11211, Path: "/tmp"})
+	Ok(t, err)
+
+	_, ok := ifs.Ifs().RemoteRoots.Get("first")
+	Compare(t, ok, false)
+
+	_, ok = ifs.Ifs().RemoteRoots.Get("second")
+	Compare(t, ok, true)
+}
+
+func TestFileSystem_Alias(t *testing.T) {
+
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{
+		{
+			Hostname: "localhost",
+			Port:     11211,
+			Paths:    []string{"x=/data/projects/x", "/tmp"},
+		},
+	})
+
+	remotePath := &ifs.RemotePath{Hostname: "localhost", Port: 11211, Path: "/data/projects/x"}
+	Compare(t, ifs.Ifs().LocalPath(remotePath), "localhost/x")
+
+	err := ifs.Ifs().Remove(remotePath)
+	Ok(t, err)
+
+	Compare(t, ifs.Ifs().LocalPath(remotePath), "")
+	Compare(t, ifs.Ifs().LocalPath(&ifs.RemotePath{Hostname: "localhost", Port: 11211, Path: "/tmp"}), "localhost/tmp")
+}
+
+func TestFileSystem_Unions(t *testing.T) {
+
+	ifs.Ifs().Startup([]*ifs.RemoteRoot{
+		{
+			Hostname: "localhost",
+			Port:     11211,
+			Paths:    []string{"/tmp/a"},
+		},
+	})
+
+	ifs.Ifs().StartupUnions([]*ifs.UnionConfig{
+		{
+			Name: "media",
+			Members: []*ifs.UnionMember{
+				{RemotePath: "localhost:11211@/data/media"},
+				{RemotePath: "other:11212@/media"},
+			},
+		},
+	})
+
+	_, ok := ifs.Ifs().RemoteRoots.Get("media")
+	Compare(t, ok, true)
+
+	member := &ifs.RemotePath{Hostname: "other", Port: 11212, Path: "/media"}
+	Compare(t, ifs.Ifs().LocalPath(member), "media")
+
+	var paths []string
+	for _, remotePath := range ifs.Ifs().RemotePaths() {
+		paths = append(paths, remotePath.String())
+	}
+
+	Compare(t, paths, []string{"localhost:11211@/data/media", "localhost:11211@/tmp/a", "other:11212@/media"})
+
+	// Members come from the config, not from add and remove
+	Err(t, ifs.Ifs().Remove(member))
+	Err(t, ifs.Ifs().Add(&ifs.RemoteRoot{Name: "media", Hostname: "third", Port: 11213, Paths: []string{"/tmp"}}))
+}
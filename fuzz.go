@@ -0,0 +1,54 @@
+// +build gofuzz
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+// Entry point for go-fuzz, the corpus lives in testdata/fuzz/packet
+//
+//	go-fuzz-build -tags gofuzz github.com/chemistry-sourabh/ifs
+//	go-fuzz -bin ifs-fuzz.zip -workdir testdata/fuzz/packet
+func Fuzz(data []byte) int {
+
+	score := 0
+
+	for _, codec := range codecs {
+
+		pkt := &Packet{}
+
+		if pkt.Decode(codec, data) != nil {
+			continue
+		}
+
+		// Whatever decodes has to survive a round trip
+		out, err := pkt.Encode(codec)
+
+		if err != nil {
+			panic(err)
+		}
+
+		again := &Packet{}
+
+		if err := again.Decode(codec, out); err != nil {
+			panic(err)
+		}
+
+		score = 1
+	}
+
+	return score
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"fmt"
+	"time"
+)
+
+// First packet on every connection. Each side lists what it speaks and
+// both keep to what they have in common.
+type Hello struct {
+	Magic    string   `cbor:"1,keyasint,omitempty"`
+	Version  uint16   `cbor:"2,keyasint,omitempty"`
+	Ops      []uint8  `cbor:"3,keyasint,omitempty"`
+	Features []string `cbor:"4,keyasint,omitempty"`
+
+	// Payload encodings, a peer that lists none only speaks msgpack
+	Codecs []string `cbor:"5,keyasint,omitempty"`
+
+	// Compression of file data, a peer that lists none sends it as it is
+	Compressors []string `cbor:"6,keyasint,omitempty"`
+}
+
+// Requests this build can send and serve
+var supportedOps = []uint8{
+	AttrRequest,
+	ReadDirRequest,
+	FetchFileRequest,
+	ReadFileRequest,
+	WriteFileRequest,
+	SetAttrRequest,
+	CreateRequest,
+	RemoveRequest,
+	RenameRequest,
+	OpenRequest,
+	CloseRequest,
+	ReadDirAllRequest,
+	CopyRequest,
+	AllocateRequest,
+	StatfsRequest,
+	BatchRequest,
+}
+
+// Features this build implements, the others are known so peers that have
+// them can be told apart
+var supportedFeatures = []string{
+	FeatureCompression,
+}
+
+func LocalHello() *Hello {
+	return &Hello{
+		Magic:    ProtocolMagic,
+		Version:  ProtocolVersion,
+		Ops:      supportedOps,
+		Features: supportedFeatures,
+		Codecs:   codecNames(),
+
+		Compressors: compressorNames(),
+	}
+}
+
+// What h and peer have in common, an error if they cannot talk at all
+func (h *Hello) Common(peer *Hello) (*Hello, error) {
+
+	if peer.Magic != ProtocolMagic {
+		return nil, fmt.Errorf("peer is not speaking the ifs protocol, got magic %q", peer.Magic)
+	}
+
+	version := h.Version
+	if peer.Version < version {
+		version = peer.Version
+	}
+
+	if version < MinProtocolVersion {
+		return nil, fmt.Errorf("protocol version %d is older than the oldest supported %d", version, MinProtocolVersion)
+	}
+
+	common := &Hello{
+		Magic:   ProtocolMagic,
+		Version: version,
+	}
+
+	for _, op := range h.Ops {
+		if peer.Supports(op) {
+			common.Ops = append(common.Ops, op)
+		}
+	}
+
+	for _, feature := range h.Features {
+		if peer.HasFeature(feature) {
+			common.Features = append(common.Features, feature)
+		}
+	}
+
+	// Both sides rank codecs the same way so they settle on the same one
+	// without another round trip
+	for _, name := range codecNames() {
+		if h.HasCodec(name) && peer.HasCodec(name) {
+			common.Codecs = append(common.Codecs, name)
+		}
+	}
+
+	if len(common.Codecs) == 0 {
+		return nil, fmt.Errorf("no codec in common, peer speaks %v", peer.Codecs)
+	}
+
+	// No compressor in common leaves file data uncompressed
+	if h.HasFeature(FeatureCompression) && peer.HasFeature(FeatureCompression) {
+		for _, name := range compressorNames() {
+			if containsString(h.Compressors, name) && containsString(peer.Compressors, name) {
+				common.Compressors = append(common.Compressors, name)
+			}
+		}
+	}
+
+	return common, nil
+}
+
+func (h *Hello) HasCodec(name string) bool {
+	if len(h.Codecs) == 0 {
+		return name == CodecMsgpack
+	}
+
+	return containsString(h.Codecs, name)
+}
+
+// Codec the connection settled on, only meaningful on a common hello
+func (h *Hello) Codec() Codec {
+	if len(h.Codecs) > 0 {
+		if codec, ok := GetCodec(h.Codecs[0]); ok {
+			return codec
+		}
+	}
+
+	return MsgpackCodec
+}
+
+// Compressor the connection settled on, nil when file data goes as it is
+func (h *Hello) Compressor() Compressor {
+	if len(h.Compressors) > 0 {
+		if compressor, ok := GetCompressor(h.Compressors[0]); ok {
+			return compressor
+		}
+	}
+
+	return nil
+}
+
+func (h *Hello) Supports(opCode uint8) bool {
+	for _, op := range h.Ops {
+		if op == opCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Hello) HasFeature(feature string) bool {
+	return containsString(h.Features, feature)
+}
+
+// Sends local on a fresh connection and waits for the agent to answer with
+// its own hello
+func sendHello(conn Conn, local *Hello) (*Hello, error) {
+
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	req := &Packet{
+		Op:   HelloRequest,
+		Data: local,
+	}
+
+	data, err := req.Marshal()
+
+	if err == nil {
+		err = conn.WriteFrame(data)
+	}
+
+	if err == nil {
+		data, err = conn.ReadFrame()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Packet{}
+
+	if err := resp.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("agent answered the handshake with a bad packet, %s", err)
+	}
+
+	if err := resp.Err(); err != nil {
+		return nil, fmt.Errorf("agent refused the handshake, %s", err)
+	}
+
+	peer, ok := resp.Data.(*Hello)
+
+	if resp.Op != HelloResponse || !ok {
+		return nil, fmt.Errorf("agent answered the handshake with %s", ConvertOpCodeToString(resp.Op))
+	}
+
+	common, err := local.Common(peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return common, nil
+}
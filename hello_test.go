@@ -0,0 +1,98 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"testing"
+)
+
+func TestHello_Common(t *testing.T) {
+
+	peer := &ifs.Hello{
+		Magic:    ifs.ProtocolMagic,
+		Version:  ifs.ProtocolVersion + 1,
+		Ops:      []uint8{ifs.AttrRequest, ifs.ReadFileRequest, 200},
+		Features: []string{ifs.FeatureLocks, ifs.FeatureCompression},
+	}
+
+	common, err := ifs.LocalHello().Common(peer)
+	Ok(t, err)
+
+	Compare(t, common, &ifs.Hello{
+		Magic:    ifs.ProtocolMagic,
+		Version:  ifs.ProtocolVersion,
+		Ops:      []uint8{ifs.AttrRequest, ifs.ReadFileRequest},
+		Features: []string{ifs.FeatureCompression},
+		Codecs:   []string{ifs.CodecMsgpack},
+	})
+
+	Compare(t, common.Supports(ifs.StatfsRequest), false)
+	Compare(t, common.HasFeature(ifs.FeatureLocks), false)
+}
+
+func TestHello_CommonErrors(t *testing.T) {
+
+	_, err := ifs.LocalHello().Common(&ifs.Hello{Magic: "http", Version: ifs.ProtocolVersion})
+	Err(t, err)
+
+	_, err = ifs.LocalHello().Common(&ifs.Hello{Magic: ifs.ProtocolMagic, Version: 0})
+	Err(t, err)
+}
+
+func TestHello_CommonCodec(t *testing.T) {
+
+	peer := ifs.LocalHello()
+	peer.Codecs = []string{"json", ifs.CodecCBOR}
+
+	common, err := ifs.LocalHello().Common(peer)
+	Ok(t, err)
+
+	Compare(t, common.Codec().Name(), ifs.CodecCBOR)
+
+	// Both sides pick msgpack when they speak everything
+	common, err = ifs.LocalHello().Common(ifs.LocalHello())
+	Ok(t, err)
+
+	Compare(t, common.Codec().Name(), ifs.CodecMsgpack)
+
+	peer.Codecs = []string{"json"}
+
+	_, err = ifs.LocalHello().Common(peer)
+	Err(t, err)
+}
+
+func TestHello_CommonCompressor(t *testing.T) {
+
+	peer := ifs.LocalHello()
+	peer.Compressors = []string{ifs.CompressionLz4}
+
+	common, err := ifs.LocalHello().Common(peer)
+	Ok(t, err)
+
+	Compare(t, common.Compressor().Name(), ifs.CompressionLz4)
+
+	// A peer without the feature gets its file data as it is
+	peer.Features = nil
+
+	common, err = ifs.LocalHello().Common(peer)
+	Ok(t, err)
+
+	Compare(t, common.Compressor(), nil)
+}
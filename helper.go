@@ -17,11 +17,11 @@ limitations under the License.
 package ifs
 
 import (
-	"math/rand"
+	"encoding/binary"
+	"hash/fnv"
 	"os"
 	"path"
 	"strings"
-	"time"
 )
 
 func ConvertOpCodeToString(opCode uint8) string {
@@ -51,6 +51,16 @@ func ConvertOpCodeToString(opCode uint8) string {
 		return "Open Request"
 	case CloseRequest:
 		return "Close Request"
+	case CopyRequest:
+		return "Copy Request"
+	case AllocateRequest:
+		return "Allocate Request"
+	case StatfsRequest:
+		return "Statfs Request"
+	case HelloRequest:
+		return "Hello Request"
+	case BatchRequest:
+		return "Batch Request"
 
 	case StatResponse:
 		return "Stat Response"
@@ -62,16 +72,17 @@ func ConvertOpCodeToString(opCode uint8) string {
 		return "Write Response"
 	case ErrorResponse:
 		return "Error Response"
+	case FsStatResponse:
+		return "FsStat Response"
+	case HelloResponse:
+		return "Hello Response"
+	case BatchResponse:
+		return "Batch Response"
 	}
 
 	return "Unknown Op"
 }
 
-func GetRandomIndex(length int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(length)
-}
-
 func ConvertErr(err error) error {
 	switch t := err.(type) {
 	case *os.PathError:
@@ -109,3 +120,34 @@ func RemoveFirstDir(filePath string) string {
 
 	return path.Join(parts[index:]...)
 }
+
+// Derives an inode number for a remote file that stays the same across
+// lookups and restarts
+func GenerateInode(address string, dev uint64, ino uint64) uint64 {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, dev)
+	binary.BigEndian.PutUint64(b[8:], ino)
+
+	h := fnv.New64a()
+	h.Write([]byte(address))
+	h.Write(b)
+
+	return reserveRootInode(h.Sum64())
+}
+
+// Derives an inode number for a virtual directory from its path in the mount
+func GeneratePathInode(filePath string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(path.Clean("/" + filePath)))
+
+	return reserveRootInode(h.Sum64())
+}
+
+// 0 asks bazil for a dynamic inode and 1 is the mount root
+func reserveRootInode(inode uint64) uint64 {
+	if inode <= 1 {
+		inode += 2
+	}
+
+	return inode
+}
@@ -60,3 +60,33 @@ func TestRemoveFirstDir(t *testing.T) {
 	Compare(t, newPath, "")
 
 }
+
+func TestGenerateInode(t *testing.T) {
+
+	inode := ifs.GenerateInode("localhost:8000", 2049, 1234)
+
+	// Same file gives same inode
+	Compare(t, ifs.GenerateInode("localhost:8000", 2049, 1234), inode)
+
+	// Other hosts and devices dont collide
+	if ifs.GenerateInode("localhost:8001", 2049, 1234) == inode {
+		t.Error("inode not unique across hosts")
+	}
+
+	if ifs.GenerateInode("localhost:8000", 2050, 1234) == inode {
+		t.Error("inode not unique across devices")
+	}
+
+	if inode <= 1 {
+		t.Error("inode overlaps with root", inode)
+	}
+}
+
+func TestGeneratePathInode(t *testing.T) {
+
+	Compare(t, ifs.GeneratePathInode("localhost/tmp"), ifs.GeneratePathInode("/localhost/tmp/"))
+
+	if ifs.GeneratePathInode("localhost/tmp") == ifs.GeneratePathInode("localhost/var") {
+		t.Error("path inodes collide")
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"bazil.org/fuse"
 	"github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
-	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
@@ -38,6 +37,18 @@ type CacheRequest interface {
 // SetAttr To Cache is AttrInfo
 // Delete is RemotePath
 
+// A cached copy of a remote file, kept with the path it came from so that
+// keys never have to be parsed back
+type cacheEntry struct {
+	remotePath *RemotePath
+	fname      string
+}
+
+func newCacheEntry(remotePath *RemotePath, fname string) *cacheEntry {
+	rp := *remotePath
+	return &cacheEntry{remotePath: &rp, fname: fname}
+}
+
 type hoarder struct {
 	Path   string
 	Size   uint64
@@ -85,17 +96,22 @@ func (h *hoarder) DeleteCache() {
 }
 
 func (h *hoarder) CacheRename(remotePath *RemotePath, destPath string) error {
-	if val, ok := h.cached.Get(remotePath.String()); ok {
 
-		fname := val.(string)
+	newRemotePath := &RemotePath{
+		Hostname: remotePath.Hostname,
+		Port:     remotePath.Port,
+		Path:     destPath,
+	}
 
-		newRemotePath := &RemotePath{
-			Hostname: remotePath.Hostname,
-			Port:     remotePath.Port,
-			Path:     destPath,
-		}
+	return h.CacheMove(remotePath, newRemotePath)
+}
+
+func (h *hoarder) CacheMove(remotePath *RemotePath, destRemotePath *RemotePath) error {
+	if val, ok := h.cached.Get(remotePath.String()); ok {
+
+		fname := val.(*cacheEntry).fname
 
-		h.cached.Set(newRemotePath.String(), fname)
+		h.cached.Set(destRemotePath.String(), newCacheEntry(destRemotePath, fname))
 		h.cached.Remove(remotePath.String())
 
 		return nil
@@ -124,7 +140,7 @@ func (h *hoarder) openCacheFile(fname string, fileDescriptor uint64, flags fuse.
 func (h *hoarder) CacheOpen(remotePath *RemotePath, fileDescriptor uint64, flags fuse.OpenFlags) {
 
 	if val, ok := h.cached.Get(remotePath.String()); ok {
-		h.openCacheFile(val.(string), fileDescriptor, flags)
+		h.openCacheFile(val.(*cacheEntry).fname, fileDescriptor, flags)
 	} else {
 
 		fetchInfo := &FetchInfo{
@@ -155,7 +171,7 @@ func (h *hoarder) cacheAndOpen(info *FetchInfo) error {
 
 	val, _ := h.cached.Get(info.RemotePath.String())
 
-	return h.openCacheFile(val.(string), info.FileDescriptor, info.Flags)
+	return h.openCacheFile(val.(*cacheEntry).fname, info.FileDescriptor, info.Flags)
 
 }
 
@@ -217,24 +233,32 @@ func (h *hoarder) cacheFile(remotePath *RemotePath) error {
 	// TODO Check Cache Space
 	// TODO Implement some form of cache management
 
-	resp := Talker().sendRequest(FetchFileRequest, remotePath.Hostname, remotePath)
+	// The whole file arrives in one response, the flow limits are charged
+	// its size rather than a guess
+	resp := Talker().sendRequest(AttrRequest, remotePath.Address(), remotePath)
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	size := resp.Data.(*Stat).Size
+	resp = Talker().sendSized(FetchFileRequest, remotePath.Address(), remotePath, size)
 
 	// TODO Log Error
-	if err, ok := resp.Data.(Error); ok {
-		return err.Err
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	fname := h.GetCacheFileName()
 	fileChunk := resp.Data.(*FileChunk)
 	//fileChunk.Decompress()
-	err := ioutil.WriteFile(path.Join(h.Path, fname), fileChunk.Chunk,
-		0666)
+	err := writeSparse(path.Join(h.Path, fname), fileChunk)
 
 	if err == nil {
 		val, ok := h.cached.Get(remotePath.String())
-		h.cached.Set(remotePath.String(), fname)
+		h.cached.Set(remotePath.String(), newCacheEntry(remotePath, fname))
 		if ok {
-			oldFname := val.(string)
+			oldFname := val.(*cacheEntry).fname
 			os.Remove(path.Join(h.Path, oldFname))
 		}
 	}
@@ -242,21 +266,30 @@ func (h *hoarder) cacheFile(remotePath *RemotePath) error {
 	return err
 }
 
-func (h *hoarder) SendWrite(hostname string, writeInfo *WriteInfo) error {
+func (h *hoarder) SendWrite(address string, writeInfo *WriteInfo) error {
 	// TODO Log the error if any ?
-	Talker().sendRequest(WriteFileRequest, hostname, writeInfo)
+	Talker().sendRequest(WriteFileRequest, address, writeInfo)
 	return nil
 }
 
 func (h *hoarder) CacheTrunc(remotePath *RemotePath, truncInfo *AttrInfo) error {
-	if fname, ok := h.cached.Get(remotePath.String()); ok {
-		err := os.Truncate(path.Join(h.Path, fname.(string)), int64(truncInfo.Size))
+	if val, ok := h.cached.Get(remotePath.String()); ok {
+		err := os.Truncate(path.Join(h.Path, val.(*cacheEntry).fname), int64(truncInfo.Size))
 		return err
 	}
 
 	return os.ErrNotExist
 }
 
+func (h *hoarder) CacheAllocate(fd uint64, allocateInfo *AllocateInfo) error {
+	if val, ok := h.opened.Get(strconv.FormatUint(fd, 10)); ok {
+		f := val.(*os.File)
+		return fallocate(f, allocateInfo.Mode, allocateInfo.Offset, allocateInfo.Length)
+	}
+
+	return os.ErrInvalid
+}
+
 func (h *hoarder) CacheCreate(remotePath *RemotePath, fd uint64) error {
 	if !h.IsCached(remotePath) {
 		fname := h.GetCacheFileName()
@@ -264,7 +297,7 @@ func (h *hoarder) CacheCreate(remotePath *RemotePath, fd uint64) error {
 
 		// if error doesnt happens this will be nil right ?
 		if err == nil {
-			h.cached.Set(remotePath.String(), fname)
+			h.cached.Set(remotePath.String(), newCacheEntry(remotePath, fname))
 			h.opened.Set(strconv.FormatUint(fd, 10), f)
 		}
 
@@ -277,7 +310,7 @@ func (h *hoarder) CacheCreate(remotePath *RemotePath, fd uint64) error {
 func (h *hoarder) CacheDelete(remotePath *RemotePath) error {
 	if val, ok := h.cached.Get(remotePath.String()); ok {
 
-		fname := val.(string)
+		fname := val.(*cacheEntry).fname
 
 		err := os.Remove(path.Join(h.Path, fname))
 
@@ -291,6 +324,39 @@ func (h *hoarder) CacheDelete(remotePath *RemotePath) error {
 	return os.ErrInvalid
 }
 
+// Drops the cached copies of root and everything below it
+func (h *hoarder) CachePurge(root *RemotePath) {
+	for tup := range h.cached.IterBuffered() {
+
+		remotePath := tup.Val.(*cacheEntry).remotePath
+
+		if root.Contains(remotePath) {
+			h.CacheDelete(remotePath)
+		}
+	}
+}
+
+// Bytes held in the cache for root and everything below it
+func (h *hoarder) CachedBytes(root *RemotePath) int64 {
+
+	var size int64
+
+	for tup := range h.cached.IterBuffered() {
+
+		entry := tup.Val.(*cacheEntry)
+
+		if !root.Contains(entry.remotePath) {
+			continue
+		}
+
+		if info, err := os.Stat(path.Join(h.Path, entry.fname)); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
 //func (h *Hoarder) ReadAllCache(remotePath *RemotePath) ([]byte, error) {
 //	if fname, ok := h.cached[remotePath.String()]; ok {
 //		data, err := ioutil.ReadFile(path.Join(h.Path, fname))
@@ -336,6 +402,7 @@ func (h *hoarder) WriteCache(fd uint64, offset int64, data []byte) (int, error)
 func (h *hoarder) CacheClose(fd uint64) error {
 	if val, ok := h.opened.Get(strconv.FormatUint(fd, 10)); ok {
 		f := val.(*os.File)
+		h.opened.Remove(strconv.FormatUint(fd, 10))
 		return f.Close()
 	}
 
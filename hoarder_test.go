@@ -20,8 +20,12 @@ package ifs_test
 
 import (
 	"github.com/chemistry-sourabh/ifs"
+	"io/ioutil"
+	"os"
+	"path"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestHoarder_GetCacheFileName(t *testing.T) {
@@ -34,3 +38,79 @@ func TestHoarder_GetCacheFileName(t *testing.T) {
 	}
 
 }
+
+// Files below a replica group are listed and purged by the path they were
+// cached under
+func TestHoarder_CachePurgeReplica(t *testing.T) {
+
+	dir := path.Join(os.TempDir(), "ifs_hoarder_"+strconv.Itoa(os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	h := ifs.Hoarder()
+	h.Startup(dir, ifs.DefaultCacheSize)
+
+	cfg := &ifs.ReplicaConfig{Name: "mirror", Path: "/data", Replicas: []string{"a:11211"}}
+	root := cfg.RemotePath()
+	file := &ifs.RemotePath{Hostname: root.Hostname, Path: "/data/f"}
+	other := &ifs.RemotePath{Hostname: "a", Port: 11211, Path: "/data/f"}
+
+	Ok(t, h.CacheCreate(file, 901))
+	_, err := h.WriteCache(901, 0, make([]byte, 10))
+	Ok(t, err)
+	Ok(t, h.CacheClose(901))
+
+	Ok(t, h.CacheCreate(other, 902))
+	Ok(t, h.CacheClose(902))
+
+	Compare(t, h.CachedBytes(root), int64(10))
+
+	h.CachePurge(root)
+
+	Compare(t, h.IsCached(file), false)
+	Compare(t, h.IsCached(other), true)
+	Compare(t, h.CachedBytes(root), int64(0))
+
+	h.CacheDelete(other)
+}
+
+// Fetching a file holds its size under the ceiling of the mount, not a chunk
+func TestHoarder_FetchCharged(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "flow")
+	defer cleanup()
+
+	cache := path.Join(os.TempDir(), "ifs_flow_cache_"+strconv.Itoa(os.Getpid()))
+	defer os.RemoveAll(cache)
+	ifs.Hoarder().Startup(cache, ifs.DefaultCacheSize)
+
+	file := &ifs.RemotePath{Hostname: remotePaths[0].Hostname, Path: path.Join(remotePaths[0].Path, "large")}
+	Ok(t, ioutil.WriteFile(file.Path, make([]byte, 3*1024*1024), 0644))
+
+	ifs.Talker().SetFlowLimits(64, 4)
+	defer ifs.Talker().SetFlowLimits(0, 0)
+
+	// Leaves room for a chunk but not for the file
+	held := ifs.Talker().Memory().Acquire(2 * 1024 * 1024)
+
+	fetched := make(chan error, 1)
+	go func() {
+		fetched <- ifs.Hoarder().CacheFile(file)
+	}()
+
+	select {
+	case <-fetched:
+		t.Fatal("fetch went ahead without room for the file")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	ifs.Talker().Memory().Release(held)
+
+	select {
+	case err := <-fetched:
+		Ok(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch did not go ahead once there was room")
+	}
+
+	Compare(t, ifs.Hoarder().IsCached(file), true)
+}
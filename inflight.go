@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"errors"
+	"sync"
+)
+
+// Every id of a connection is waiting on a response
+var ErrIdsExhausted = errors.New("no request id is free on the connection")
+
+// Requests written on a single connection that wait for their response.
+// Ids are only unique on the connection, they wrap around at the top of
+// uint64 and skip any id that is still waiting.
+type InFlightTable struct {
+	mu      sync.Mutex
+	last    uint64
+	entries map[uint64]*PacketChannelTuple
+
+	// Ids skipped because an older request still held them
+	collisions uint64
+}
+
+// Ids are handed out starting after last
+func NewInFlightTable(last uint64) *InFlightTable {
+	return &InFlightTable{
+		last:    last,
+		entries: make(map[uint64]*PacketChannelTuple),
+	}
+}
+
+// Records req under the next free id and returns that id
+func (t *InFlightTable) Add(req *PacketChannelTuple) (uint64, error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Zero is never used so that a packet without an id stands out
+	if uint64(len(t.entries)) == ^uint64(0) {
+		return 0, ErrIdsExhausted
+	}
+
+	for {
+		t.last++
+
+		if t.last == 0 {
+			continue
+		}
+
+		if _, ok := t.entries[t.last]; ok {
+			t.collisions++
+			continue
+		}
+
+		t.entries[t.last] = req
+		return t.last, nil
+	}
+}
+
+// Removes the request waiting on id, false if there is none which happens
+// when it was already failed
+func (t *InFlightTable) Pop(id uint64) (*PacketChannelTuple, bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.entries[id]
+
+	if ok {
+		delete(t.entries, id)
+	}
+
+	return req, ok
+}
+
+// Removes and returns every request still waiting
+func (t *InFlightTable) Drain() []*PacketChannelTuple {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reqs := make([]*PacketChannelTuple, 0, len(t.entries))
+
+	for id, req := range t.entries {
+		reqs = append(reqs, req)
+		delete(t.entries, id)
+	}
+
+	return reqs
+}
+
+func (t *InFlightTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.entries)
+}
+
+func (t *InFlightTable) Collisions() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.collisions
+}
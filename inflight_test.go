@@ -0,0 +1,97 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"github.com/chemistry-sourabh/ifs"
+	"testing"
+)
+
+func TestInFlightTable_Add(t *testing.T) {
+
+	table := ifs.NewInFlightTable(0)
+
+	for want := uint64(1); want <= 3; want++ {
+		id, err := table.Add(&ifs.PacketChannelTuple{})
+		Ok(t, err)
+		Compare(t, id, want)
+	}
+
+	Compare(t, table.Len(), 3)
+}
+
+func TestInFlightTable_Wraparound(t *testing.T) {
+
+	table := ifs.NewInFlightTable(^uint64(0) - 1)
+
+	id, err := table.Add(&ifs.PacketChannelTuple{})
+	Ok(t, err)
+	Compare(t, id, ^uint64(0))
+
+	// Zero is skipped when the ids wrap
+	id, err = table.Add(&ifs.PacketChannelTuple{})
+	Ok(t, err)
+	Compare(t, id, uint64(1))
+}
+
+func TestInFlightTable_Collision(t *testing.T) {
+
+	table := ifs.NewInFlightTable(0)
+
+	table.Add(&ifs.PacketChannelTuple{})
+	table.Add(&ifs.PacketChannelTuple{})
+	table.SetLast(0)
+
+	// Ids 1 and 2 are still waiting on responses
+	id, err := table.Add(&ifs.PacketChannelTuple{})
+	Ok(t, err)
+	Compare(t, id, uint64(3))
+	Compare(t, table.Collisions(), uint64(2))
+}
+
+func TestInFlightTable_Pop(t *testing.T) {
+
+	table := ifs.NewInFlightTable(0)
+
+	req := &ifs.PacketChannelTuple{}
+	id, err := table.Add(req)
+	Ok(t, err)
+
+	got, ok := table.Pop(id)
+	Compare(t, ok, true)
+
+	if got != req {
+		PrintTestError(t, "requests dont match", got, req)
+	}
+
+	// A second response for the same id finds nothing
+	_, ok = table.Pop(id)
+	Compare(t, ok, false)
+}
+
+func TestInFlightTable_Drain(t *testing.T) {
+
+	table := ifs.NewInFlightTable(0)
+
+	table.Add(&ifs.PacketChannelTuple{})
+	table.Add(&ifs.PacketChannelTuple{})
+
+	Compare(t, len(table.Drain()), 2)
+	Compare(t, table.Len(), 0)
+}
@@ -18,9 +18,19 @@ package ifs
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/vmihailenco/msgpack"
-	"go.uber.org/zap"
+)
+
+// Id, Op, ConnId and Flags come before the payload
+const PacketHeaderLength = 11
+
+var (
+	// The frame ends before its header does, nothing in it can be trusted
+	ErrShortPacket = errors.New("packet shorter than its header")
+
+	// The header was read but the op is not one this build knows
+	ErrUnknownOp = errors.New("unknown op code")
 )
 
 type Payload interface {
@@ -29,19 +39,49 @@ type Payload interface {
 type Packet struct {
 	ConnId uint8
 	Flags  uint8
-	Id     uint64 // TODO What if this overflows ?
+	Id     uint64 // Unique among the requests waiting on its connection
 	Op     uint8
 	Data   Payload
 }
 
 func (pkt *Packet) Marshal() ([]byte, error) {
-	header := make([]byte, 11)
+	return pkt.Encode(MsgpackCodec)
+}
+
+// Decodes data with the default codec
+func (pkt *Packet) Unmarshal(data []byte) error {
+	return pkt.Decode(MsgpackCodec, data)
+}
+
+// Hellos are always msgpack, the codec is not agreed on before them
+func isHello(op uint8) bool {
+	return op == HelloRequest || op == HelloResponse
+}
+
+func (pkt *Packet) Encode(codec Codec) ([]byte, error) {
+	header := make([]byte, PacketHeaderLength)
 	binary.BigEndian.PutUint64(header, pkt.Id)
 	header[8] = pkt.Op
 	header[9] = pkt.ConnId
 	header[10] = pkt.Flags
 
-	data, err := msgpack.Marshal(pkt.Data)
+	if isHello(pkt.Op) {
+		codec = MsgpackCodec
+	}
+
+	var payload interface{} = pkt.Data
+
+	if b, ok := pkt.Data.(*Batch); ok {
+		wire, err := b.encode(codec)
+
+		if err != nil {
+			return nil, err
+		}
+
+		payload = wire
+	}
+
+	data, err := codec.Marshal(payload)
 
 	if err != nil {
 		return nil, err
@@ -52,13 +92,20 @@ func (pkt *Packet) Marshal() ([]byte, error) {
 	return data, nil
 }
 
-func (pkt *Packet) Unmarshal(data []byte) {
+// Decodes a frame read off a connection. The header is filled in whenever
+// err is not ErrShortPacket so that the sender can still be answered
+func (pkt *Packet) Decode(codec Codec, data []byte) (err error) {
+
+	if len(data) < PacketHeaderLength {
+		return ErrShortPacket
+	}
+
 	pkt.Id = binary.BigEndian.Uint64(data)
 	pkt.Op = data[8]
 	pkt.ConnId = data[9]
 	pkt.Flags = data[10]
 
-	payload := data[11:]
+	payload := data[PacketHeaderLength:]
 
 	var struc Payload
 
@@ -87,6 +134,16 @@ func (pkt *Packet) Unmarshal(data []byte) {
 		struc = &OpenInfo{}
 	case CloseRequest:
 		struc = &CloseInfo{}
+	case CopyRequest:
+		struc = &CopyInfo{}
+	case AllocateRequest:
+		struc = &AllocateInfo{}
+	case StatfsRequest:
+		struc = &RemotePath{}
+	case HelloRequest:
+		struc = &Hello{}
+	case BatchRequest:
+		struc = &batchFrames{}
 
 	case StatResponse:
 		struc = &Stat{}
@@ -98,23 +155,60 @@ func (pkt *Packet) Unmarshal(data []byte) {
 		struc = &WriteResult{}
 	case ErrorResponse:
 		struc = &Error{}
+	case FsStatResponse:
+		struc = &FsStat{}
+	case HelloResponse:
+		struc = &Hello{}
+	case BatchResponse:
+		struc = &batchFrames{}
+	default:
+		return ErrUnknownOp
+	}
+
+	// A peer must not be able to take the process down with a bad payload
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoding %s payload panicked, %v", ConvertOpCodeToString(pkt.Op), r)
+		}
+	}()
+
+	if isHello(pkt.Op) {
+		codec = MsgpackCodec
 	}
 
-	err := msgpack.Unmarshal(payload, struc)
+	err = codec.Unmarshal(payload, struc)
+
 	if err != nil {
-		zap.L().Fatal("Unmarshalling Packet Failed",
-			zap.Error(err),
-		)
+		return fmt.Errorf("decoding %s payload failed, %s", ConvertOpCodeToString(pkt.Op), err)
+	}
+
+	if wire, ok := struc.(*batchFrames); ok {
+		if struc, err = wire.decode(codec); err != nil {
+			return err
+		}
 	}
 
 	pkt.Data = struc
 
+	return nil
 }
 
 func (pkt *Packet) String() string {
 	return fmt.Sprintf("Id = %d Op = %s Data = %s", pkt.Id, ConvertOpCodeToString(pkt.Op), pkt.Data)
 }
 
+// Returns the error sent back by the agent, nil if the request succeeded
+func (pkt *Packet) Err() error {
+	switch e := pkt.Data.(type) {
+	case *Error:
+		return e.Err
+	case Error:
+		return e.Err
+	}
+
+	return nil
+}
+
 func (pkt *Packet) IsRequest() bool {
 	if pkt.Flags == 0 {
 		return true
@@ -23,6 +23,9 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/vmihailenco/msgpack"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
 	"testing"
 )
 
@@ -141,3 +144,170 @@ func TestPacket_Marshal3(t *testing.T) {
 //func TestPacket_Marshal4(t *testing.T) {
 //	t.Skip()
 //}
+
+func TestPacket_Err(t *testing.T) {
+
+	pkt := CreatePacket(ifs.ErrorResponse, &ifs.Error{
+		Err: io.EOF,
+	})
+
+	if pkt.Err() != io.EOF {
+		PrintTestError(t, "errors dont match", pkt.Err(), io.EOF)
+	}
+
+	pkt = CreatePacket(ifs.ErrorResponse, &ifs.Error{})
+
+	Ok(t, pkt.Err())
+
+	pkt = CreatePacket(ifs.StatResponse, &ifs.Stat{})
+
+	Ok(t, pkt.Err())
+}
+
+func TestPacket_UnmarshalHello(t *testing.T) {
+
+	pkt := CreatePacket(ifs.HelloRequest, ifs.LocalHello())
+	data, err := pkt.Marshal()
+	Ok(t, err)
+
+	got := &ifs.Packet{}
+	Ok(t, got.Unmarshal(data))
+
+	Compare(t, got.Data, ifs.LocalHello())
+}
+
+func TestPacket_UnmarshalUnknownOp(t *testing.T) {
+
+	pkt := CreatePacket(ifs.StatResponse, &ifs.Stat{})
+	data, err := pkt.Marshal()
+	Ok(t, err)
+
+	// An op from a newer peer keeps its header so that it can be answered
+	data[8] = 200
+
+	got := &ifs.Packet{}
+
+	if err := got.Unmarshal(data); err != ifs.ErrUnknownOp {
+		PrintTestError(t, "errors dont match", err, ifs.ErrUnknownOp)
+	}
+
+	Compare(t, got.Id, pkt.Id)
+	Compare(t, got.Op, uint8(200))
+	Compare(t, got.Data, nil)
+}
+
+func TestPacket_UnmarshalShort(t *testing.T) {
+
+	for i := 0; i < ifs.PacketHeaderLength; i++ {
+		got := &ifs.Packet{}
+
+		if err := got.Unmarshal(make([]byte, i)); err != ifs.ErrShortPacket {
+			PrintTestError(t, "errors dont match", err, ifs.ErrShortPacket)
+		}
+	}
+}
+
+func TestPacket_UnmarshalBadPayload(t *testing.T) {
+
+	pkt := CreatePacket(ifs.WriteFileRequest, &ifs.WriteInfo{
+		Data: []byte("hello"),
+	})
+	data, err := pkt.Marshal()
+	Ok(t, err)
+
+	got := &ifs.Packet{}
+	Err(t, got.Unmarshal(data[:len(data)-3]))
+
+	Compare(t, got.Op, uint8(ifs.WriteFileRequest))
+	Compare(t, got.Data, nil)
+}
+
+// Replays the fuzz corpus along with every truncation of it, none of which
+// may panic
+func TestPacket_UnmarshalCorpus(t *testing.T) {
+
+	files, err := filepath.Glob("testdata/fuzz/packet/corpus/*")
+	Ok(t, err)
+
+	if len(files) == 0 {
+		t.Fatal("fuzz corpus is empty")
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		Ok(t, err)
+
+		for i := 0; i <= len(data); i++ {
+			for _, name := range []string{ifs.CodecMsgpack, ifs.CodecCBOR} {
+				codec, _ := ifs.GetCodec(name)
+
+				got := &ifs.Packet{}
+				got.Decode(codec, data[:i])
+			}
+		}
+	}
+}
+
+func TestPacket_EncodeCBOR(t *testing.T) {
+
+	codec, ok := ifs.GetCodec(ifs.CodecCBOR)
+	Compare(t, ok, true)
+
+	payloads := map[uint8]ifs.Payload{
+		ifs.ReadFileRequest:  &ifs.ReadInfo{Path: "/tmp/file1", FileDescriptor: 3, Offset: 4096, Size: 10},
+		ifs.StatsResponse:    &ifs.DirInfo{Stats: []*ifs.Stat{{Name: "a", Size: 1}, {Name: "b", IsDir: true}}},
+		ifs.FileDataResponse: &ifs.FileChunk{Chunk: []byte("hello"), Size: 5},
+	}
+
+	for op, payload := range payloads {
+		data, err := CreatePacket(op, payload).Encode(codec)
+		Ok(t, err)
+
+		got := &ifs.Packet{}
+		Ok(t, got.Decode(codec, data))
+
+		Compare(t, got.Data, payload)
+	}
+}
+
+func TestPacket_EncodeCBORError(t *testing.T) {
+
+	codec, _ := ifs.GetCodec(ifs.CodecCBOR)
+
+	data, err := CreatePacket(ifs.ErrorResponse, &ifs.Error{Err: syscall.ENOENT}).Encode(codec)
+	Ok(t, err)
+
+	got := &ifs.Packet{}
+	Ok(t, got.Decode(codec, data))
+
+	Compare(t, got.Err().Error(), syscall.ENOENT.Error())
+}
+
+// Keys are fixed by the cbor tags, other clients depend on them
+func TestPacket_EncodeCBORSchema(t *testing.T) {
+
+	codec, _ := ifs.GetCodec(ifs.CodecCBOR)
+
+	data, err := CreatePacket(ifs.AttrRequest, &ifs.RemotePath{
+		Hostname: "h",
+		Port:     1,
+		Path:     "/",
+	}).Encode(codec)
+	Ok(t, err)
+
+	Compare(t, data[ifs.PacketHeaderLength:], []byte{0xa3, 0x01, 0x61, 'h', 0x02, 0x01, 0x03, 0x61, '/'})
+}
+
+func TestPacket_EncodeHello(t *testing.T) {
+
+	codec, _ := ifs.GetCodec(ifs.CodecCBOR)
+
+	// Hellos stay msgpack whatever the connection agreed on
+	data, err := CreatePacket(ifs.HelloRequest, ifs.LocalHello()).Encode(codec)
+	Ok(t, err)
+
+	got := &ifs.Packet{}
+	Ok(t, got.Unmarshal(data))
+
+	Compare(t, got.Data, ifs.LocalHello())
+}
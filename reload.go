@@ -0,0 +1,394 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// Outcome of a reload, changes that cannot be applied live are listed in
+// RestartRequired and left alone
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+	Errors          []string `json:"errors"`
+}
+
+func (r *ReloadResult) applied(format string, args ...interface{}) {
+	r.Applied = append(r.Applied, fmt.Sprintf(format, args...))
+}
+
+func (r *ReloadResult) restart(format string, args ...interface{}) {
+	r.RestartRequired = append(r.RestartRequired, fmt.Sprintf(format, args...))
+}
+
+func (r *ReloadResult) failed(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *ReloadResult) log() {
+	zap.L().Info("Config Reloaded",
+		zap.Strings("applied", r.Applied),
+		zap.Strings("restart_required", r.RestartRequired),
+		zap.Strings("errors", r.Errors),
+	)
+}
+
+var (
+	reloadMu sync.Mutex
+
+	fsConfig       *FsConfig
+	fsConfigLoader func() (*FsConfig, error)
+
+	agentConfig       *AgentConfig
+	agentConfigLoader func() (*AgentConfig, error)
+)
+
+// Sets how a reload reads the fs config again, usually the same way the
+// CLI loaded it at mount time
+func SetConfigLoader(loader func() (*FsConfig, error)) {
+	fsConfigLoader = loader
+}
+
+// Sets how a reload reads the agent config again
+func SetAgentConfigLoader(loader func() (*AgentConfig, error)) {
+	agentConfigLoader = loader
+}
+
+// Calls reload every time the process gets a SIGHUP
+func reloadOnHangup(reload func() (*ReloadResult, error)) {
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			result, err := reload()
+
+			if err != nil {
+				zap.L().Warn("Config Reload Failed",
+					zap.Error(err),
+				)
+			} else {
+				result.log()
+			}
+		}
+	}()
+}
+
+// Reads the fs config again and applies what can change while mounted
+func ReloadConfig() (*ReloadResult, error) {
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if fsConfigLoader == nil || fsConfig == nil {
+		return nil, errors.New("mount was not started from a config")
+	}
+
+	cfg, err := fsConfigLoader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReloadResult{}
+	old := fsConfig
+
+	// Becomes the config the mount runs with, what failed or waits for a
+	// restart keeps its old value so the next reload tries or reports it
+	// again
+	running := *cfg
+
+	if !reflect.DeepEqual(old.Log, cfg.Log) {
+		SetupLogger(cfg.Log)
+		result.applied("log")
+	}
+
+	if old.CrossHostRename != cfg.CrossHostRename {
+		FileHandler().SetCrossHostRename(cfg.CrossHostRename)
+		result.applied("cross_host_rename")
+	}
+
+	if old.CAFile != cfg.CAFile {
+		if err := Talker().LoadCA(cfg.CAFile); err != nil {
+			result.failed("ca_file %s", err)
+			running.CAFile = old.CAFile
+		} else {
+			result.applied("ca_file, used by new connections")
+		}
+	}
+
+	if old.Codec != cfg.Codec {
+		Talker().SetCodec(cfg.Codec)
+		result.applied("codec, used by new connections")
+	}
+
+	if old.Compression != cfg.Compression {
+		Talker().SetCompression(cfg.Compression)
+		result.applied("compression, used by new connections")
+	}
+
+	if old.ConnWindow != cfg.ConnWindow || old.MemoryLimit != cfg.MemoryLimit {
+		Talker().SetFlowLimits(cfg.ConnWindow, cfg.MemoryLimit)
+		result.applied("connection_window and memory_limit")
+	}
+
+	if old.MountPoint != cfg.MountPoint {
+		result.restart("mount_point")
+		running.MountPoint = old.MountPoint
+	}
+
+	if old.CacheLocation != cfg.CacheLocation {
+		result.restart("cache_location")
+		running.CacheLocation = old.CacheLocation
+	}
+
+	// The hoarder only takes its size when it starts up
+	if old.CacheSize != cfg.CacheSize {
+		result.restart("cache_size")
+		running.CacheSize = old.CacheSize
+	}
+
+	if old.ConnCount != cfg.ConnCount {
+		result.restart("connection_count")
+		running.ConnCount = old.ConnCount
+	}
+
+	if old.ControlSocket != cfg.ControlSocket {
+		result.restart("control_socket")
+		running.ControlSocket = old.ControlSocket
+	}
+
+	if !reflect.DeepEqual(old.Unions, cfg.Unions) {
+		result.restart("unions")
+		running.Unions = old.Unions
+	}
+
+	if !reflect.DeepEqual(old.Replicas, cfg.Replicas) {
+		result.restart("replicas")
+		running.Replicas = old.Replicas
+	}
+
+	running.RemoteRoots = reloadRemoteRoots(old.RemoteRoots, cfg.RemoteRoots, result)
+
+	fsConfig = &running
+
+	return result, nil
+}
+
+// Mounts added paths and unmounts removed ones, agents whose directory or
+// TLS setting changed keep their paths until a restart. Returns the remote
+// roots as they are mounted afterwards.
+func reloadRemoteRoots(oldRoots []*RemoteRoot, newRoots []*RemoteRoot, result *ReloadResult) []*RemoteRoot {
+
+	oldHosts := make(map[string]*RemoteRoot)
+	for _, remoteRoot := range oldRoots {
+		oldHosts[remoteRoot.Address()] = remoteRoot
+	}
+
+	newHosts := make(map[string]*RemoteRoot)
+	for _, remoteRoot := range newRoots {
+		newHosts[remoteRoot.Address()] = remoteRoot
+	}
+
+	changed := func(a *RemoteRoot, b *RemoteRoot) bool {
+		return a.DirName() != b.DirName() || a.TLS != b.TLS || a.Transport != b.Transport || a.Socket != b.Socket
+	}
+
+	// Paths of each agent still mounted
+	mounted := make(map[string][]string)
+
+	for address, oldRoot := range oldHosts {
+
+		newRoot, ok := newHosts[address]
+
+		if ok && changed(oldRoot, newRoot) {
+			result.restart("remote_roots %s name, tls or transport", address)
+			mounted[address] = oldRoot.Paths
+			continue
+		}
+
+		var keep []string
+		if ok {
+			keep = newRoot.Paths
+		}
+
+		for j, remotePath := range oldRoot.RemotePaths() {
+			if containsString(keep, oldRoot.Paths[j]) {
+				mounted[address] = append(mounted[address], oldRoot.Paths[j])
+				continue
+			}
+
+			if err := Ifs().Remove(remotePath); err != nil {
+				result.failed("removing %s %s", remotePath, err)
+				mounted[address] = append(mounted[address], oldRoot.Paths[j])
+			} else {
+				result.applied("removed %s", remotePath)
+			}
+		}
+	}
+
+	for address, newRoot := range newHosts {
+
+		oldRoot, ok := oldHosts[address]
+
+		if ok && changed(oldRoot, newRoot) {
+			continue
+		}
+
+		var existing []string
+		if ok {
+			existing = oldRoot.Paths
+		}
+
+		for j, entry := range newRoot.Paths {
+			if containsString(existing, entry) {
+				continue
+			}
+
+			// Everything but the paths, how the host is reached included
+			added := *newRoot
+			added.Name = newRoot.DirName()
+			added.Paths = []string{entry}
+
+			err := Ifs().Add(&added)
+
+			if err != nil {
+				result.failed("adding %s %s", newRoot.RemotePaths()[j], err)
+			} else {
+				result.applied("added %s", newRoot.RemotePaths()[j])
+				mounted[address] = append(mounted[address], entry)
+			}
+		}
+	}
+
+	var remoteRoots []*RemoteRoot
+
+	// In the order of the new config, agents waiting for a restart keep how
+	// they are reached and named
+	for _, newRoot := range newRoots {
+
+		address := newRoot.Address()
+		remoteRoot := *newRoot
+
+		if oldRoot, ok := oldHosts[address]; ok && changed(oldRoot, newRoot) {
+			remoteRoot = *oldRoot
+		}
+
+		paths, ok := mounted[address]
+		delete(mounted, address)
+
+		// A root without paths only connects, it is kept as it was given
+		if ok || len(newRoot.Paths) == 0 {
+			remoteRoot.Paths = paths
+			remoteRoots = append(remoteRoots, &remoteRoot)
+		}
+	}
+
+	// Agents dropped from the config with paths that failed to unmount
+	for _, oldRoot := range oldRoots {
+		if paths, ok := mounted[oldRoot.Address()]; ok {
+			remoteRoot := *oldRoot
+			remoteRoot.Paths = paths
+			remoteRoots = append(remoteRoots, &remoteRoot)
+		}
+	}
+
+	return remoteRoots
+}
+
+// Reads the agent config again and applies what can change while serving
+func ReloadAgentConfig() (*ReloadResult, error) {
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if agentConfigLoader == nil || agentConfig == nil {
+		return nil, errors.New("agent was not started from a config")
+	}
+
+	cfg, err := agentConfigLoader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReloadResult{}
+	old := agentConfig
+
+	if !reflect.DeepEqual(old.Log, cfg.Log) {
+		SetupLogger(cfg.Log)
+		result.applied("log")
+	}
+
+	if !reflect.DeepEqual(old.Exports, cfg.Exports) {
+		Agent().SetExports(cfg.Exports)
+		result.applied("exports")
+	}
+
+	if old.MemoryLimit != cfg.MemoryLimit {
+		Agent().SetMemoryLimit(cfg.MemoryLimit)
+		result.applied("memory_limit")
+	}
+
+	// Same as for the fs config, only what took effect is kept
+	running := *cfg
+
+	if old.Address != cfg.Address || old.Port != cfg.Port || old.Transport != cfg.Transport || old.Socket != cfg.Socket {
+		result.restart("address, port and transport")
+		running.Address = old.Address
+		running.Port = old.Port
+		running.Transport = old.Transport
+		running.Socket = old.Socket
+	}
+
+	if (old.TLS == nil) != (cfg.TLS == nil) {
+		result.restart("enabling or disabling tls")
+		running.TLS = old.TLS
+	} else if cfg.TLS != nil {
+		// Files are read again even if unchanged so rotated certificates
+		// are picked up
+		if err := AgentTalker().LoadCertificate(cfg.TLS); err != nil {
+			result.failed("tls %s", err)
+			running.TLS = old.TLS
+		} else {
+			result.applied("tls certificate, used by new connections")
+		}
+	}
+
+	agentConfig = &running
+
+	return result, nil
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+
+	return false
+}
@@ -26,6 +26,7 @@ import (
 	"os/user"
 	"path"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -34,10 +35,13 @@ type RemoteNode struct {
 
 	IsDir    bool
 	IsCached bool
+	Inode    uint64
 	Size     uint64
 	Mode     os.FileMode
+	Atime    time.Time
 	Mtime    time.Time
-	// TODO Add Atime also
+	Ctime    time.Time
+	Crtime   time.Time
 
 	// Children
 	RemoteNodes *cmap.ConcurrentMap
@@ -55,10 +59,10 @@ func (rn *RemoteNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 	if !rn.IsCached {
 
 		var resp *Packet
-		resp = Talker().sendRequest(AttrRequest, rn.RemotePath.Hostname, rn.RemotePath)
+		resp = Talker().sendRequest(AttrRequest, rn.RemotePath.Address(), rn.RemotePath)
 
-		var err error = nil
-		if respErr, ok := resp.Data.(Error); !ok {
+		err := resp.Err()
+		if err == nil {
 
 			s := resp.Data.(*Stat)
 
@@ -71,13 +75,9 @@ func (rn *RemoteNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 				zap.Time("mtime", time.Unix(0, s.ModTime)),
 			)
 
-			rn.Size = uint64(s.Size)
-			rn.Mode = s.Mode
-			rn.Mtime = time.Unix(0, s.ModTime)
-			rn.IsCached = true
+			rn.setStat(s)
 
 		} else {
-			err = respErr.Err
 
 			zap.L().Warn("Attr Error Response",
 				zap.String("op", "attr"),
@@ -98,11 +98,15 @@ func (rn *RemoteNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 	curGroup, _ := user.LookupGroup("staff")
 	gid, _ := strconv.ParseUint(curGroup.Gid, 10, 64)
 
+	attr.Inode = rn.Inode
 	attr.Uid = uint32(uid)
 	attr.Gid = uint32(gid)
 	attr.Size = rn.Size
 	attr.Mode = rn.Mode
+	attr.Atime = rn.Atime
 	attr.Mtime = rn.Mtime
+	attr.Ctime = rn.Ctime
+	attr.Crtime = rn.Crtime
 	attr.Valid = time.Duration(-1)
 
 	zap.L().Debug("Attr Response",
@@ -117,37 +121,120 @@ func (rn *RemoteNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 	return nil
 }
 
+// Takes the attributes of rn from a stat the agent sent
+func (rn *RemoteNode) setStat(s *Stat) {
+	rn.Inode = GenerateInode(rn.RemotePath.Address(), s.Dev, s.Ino)
+	rn.Size = uint64(s.Size)
+	rn.Mode = s.Mode
+	rn.setTimes(s)
+	rn.IsCached = true
+}
+
+func (rn *RemoteNode) setTimes(s *Stat) {
+	rn.Atime = time.Unix(0, s.ATime)
+	rn.Mtime = time.Unix(0, s.ModTime)
+	rn.Ctime = time.Unix(0, s.CTime)
+
+	if s.CrTime != 0 {
+		rn.Crtime = time.Unix(0, s.CrTime)
+	}
+}
+
+func (rn *RemoteNode) childPath(name string) *RemotePath {
+	return &RemotePath{
+		Hostname: rn.RemotePath.Hostname,
+		Port:     rn.RemotePath.Port,
+		Path:     path.Join(rn.RemotePath.Path, name),
+	}
+}
+
+// Child called name, asking the agent for the one name when it has not been
+// seen since listing a large directory on every miss would be slow
+func (rn *RemoteNode) lookupChild(name string) (*RemoteNode, bool) {
+
+	if val, ok := rn.RemoteNodes.Get(name); ok {
+		return val.(*RemoteNode), true
+	}
+
+	resp := Talker().sendRequest(AttrRequest, rn.RemotePath.Address(), rn.childPath(name))
+
+	return rn.addChild(name, resp)
+}
+
+// Adds the child name from the response to an attr request for it, false
+// when the agent does not have it
+func (rn *RemoteNode) addChild(name string, resp *Packet) (*RemoteNode, bool) {
+
+	if err := resp.Err(); err != nil {
+
+		// Errors arrive as their message, a missing name is not worth a warning
+		if err.Error() != syscall.ENOENT.Error() {
+			zap.L().Warn("Attr Error Response",
+				zap.String("op", "attr"),
+				zap.String("address", rn.RemotePath.Address()),
+				zap.String("path", path.Join(rn.RemotePath.Path, name)),
+				zap.Error(err),
+			)
+		}
+
+		return nil, false
+	}
+
+	s := resp.Data.(*Stat)
+
+	child := rn.generateChildRemoteNode(name, s.IsDir)
+	child.setStat(s)
+
+	// Another lookup may have added it first, the first one stays
+	if !rn.RemoteNodes.SetIfAbsent(name, child) {
+		val, _ := rn.RemoteNodes.Get(name)
+		return val.(*RemoteNode), true
+	}
+
+	return child, true
+}
+
 // TODO Should be Helper
 func (rn *RemoteNode) generateChildRemoteNode(name string, isDir bool) *RemoteNode {
 
 	cm := cmap.New()
 
 	return &RemoteNode{
-		IsDir:    isDir,
-		IsCached: false,
-		RemotePath: &RemotePath{
-			Hostname: rn.RemotePath.Hostname,
-			Port:     rn.RemotePath.Port,
-			Path:     path.Join(rn.RemotePath.Path, name),
-		},
+		IsDir:       isDir,
+		IsCached:    false,
+		RemotePath:  rn.childPath(name),
 		RemoteNodes: &cm,
 	}
 }
 
-func (rn *RemoteNode) updateChildrenRemoteNodes() {
-	resp := Talker().sendRequest(ReadDirAllRequest, rn.RemotePath.Hostname, rn.RemotePath)
+// Lists every directory in rns, one batch for those on the same host
+func updateChildren(rns []*RemoteNode) {
 
-	zap.L().Debug("ReaddirAll FS Request",
-		zap.String("op", "readdirall"),
-		zap.String("address", rn.RemotePath.Address()),
-		zap.String("path", rn.RemotePath.Path),
-	)
+	remotePaths := make([]*RemotePath, 0, len(rns))
+
+	for _, rn := range rns {
+		zap.L().Debug("ReaddirAll FS Request",
+			zap.String("op", "readdirall"),
+			zap.String("address", rn.RemotePath.Address()),
+			zap.String("path", rn.RemotePath.Path),
+		)
 
+		remotePaths = append(remotePaths, rn.RemotePath)
+	}
+
+	for i, resp := range Talker().sendBatched(ReadDirAllRequest, remotePaths) {
+		rns[i].applyListing(resp)
+	}
+}
+
+// Replaces the children of rn with those in a listing of it, they come with
+// their attributes so none needs an attr request of its own
+func (rn *RemoteNode) applyListing(resp *Packet) {
 	newRns := cmap.New()
 	//rn.RemoteNodes = make(map[string]*RemoteNode)
 
-	var err error
-	if respError, ok := resp.Data.(Error); !ok {
+	err := resp.Err()
+	if err == nil {
 
 		files := resp.Data.(*DirInfo).Stats
 
@@ -176,7 +263,11 @@ func (rn *RemoteNode) updateChildrenRemoteNodes() {
 			var newRn *RemoteNode
 			if !ok {
 				newRn = rn.generateChildRemoteNode(s.Name, s.IsDir)
-				FuseServer().InvalidateNodeData(newRn)
+
+				// There is no server to tell until the file system is mounted
+				if FuseServer() != nil {
+					FuseServer().InvalidateNodeData(newRn)
+				}
 			} else {
 				newRn = val.(*RemoteNode)
 			}
@@ -187,10 +278,7 @@ func (rn *RemoteNode) updateChildrenRemoteNodes() {
 				Hoarder().CacheFetch(rn.RemotePath)
 			}
 
-			newRn.Size = uint64(s.Size)
-			newRn.Mode = s.Mode
-			newRn.IsCached = true
-			newRn.Mtime = mtime
+			newRn.setStat(s)
 			newRns.Set(s.Name, newRn)
 			//rn.RemoteNodes[s.Name] = newRn
 		}
@@ -198,7 +286,6 @@ func (rn *RemoteNode) updateChildrenRemoteNodes() {
 		rn.RemoteNodes = &newRns
 
 	} else {
-		err = respError.Err
 
 		zap.L().Warn("ReadDirAll Error Response",
 			zap.String("op", "readdirall"),
@@ -219,13 +306,7 @@ func (rn *RemoteNode) Lookup(ctx context.Context, name string) (fs.Node, error)
 		zap.String("name", name),
 	)
 
-	val, ok := rn.RemoteNodes.Get(name)
-
-	if !ok {
-		rn.updateChildrenRemoteNodes()
-	}
-
-	val, ok = rn.RemoteNodes.Get(name)
+	child, ok := rn.lookupChild(name)
 
 	zap.L().Debug("Lookup Response",
 		zap.String("op", "lookup"),
@@ -236,7 +317,7 @@ func (rn *RemoteNode) Lookup(ctx context.Context, name string) (fs.Node, error)
 	)
 
 	if ok {
-		return val.(fs.Node), nil
+		return child, nil
 	} else {
 		return nil, fuse.ENOENT
 	}
@@ -279,7 +360,6 @@ func (rn *RemoteNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fus
 }
 
 func (rn *RemoteNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	// TODO Add other attributes
 
 	zap.L().Debug("SetAttr FS Request",
 		zap.String("op", "setattr"),
@@ -304,25 +384,36 @@ func (rn *RemoteNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, res
 	var err error
 	if req.Valid.Size() {
 		err = FileHandler().Truncate(rn.RemotePath, attrInfo)
+	} else {
+		resp := Talker().sendRequest(SetAttrRequest, rn.RemotePath.Address(), attrInfo)
+		err = resp.Err()
+	}
 
-		if err == nil {
+	if err == nil {
+		now := time.Now()
+
+		if req.Valid.Size() {
 			rn.Size = req.Size
+			rn.Mtime = now
 		}
 
-	} else {
-		resp := Talker().sendRequest(SetAttrRequest, rn.RemotePath.Hostname, attrInfo)
-		if respErr, ok := resp.Data.(Error); ok {
-			err = respErr.Err
+		if req.Valid.Mode() {
+			rn.Mode = req.Mode
 		}
 
-		if err == nil {
+		if req.Valid.Atime() {
+			rn.Atime = req.Atime
+		}
 
-			if req.Valid.Mode() {
-				rn.Mode = req.Mode
-			} else if req.Valid.Mtime() {
-				rn.Mtime = req.Mtime
-			}
+		if req.Valid.Mtime() {
+			rn.Mtime = req.Mtime
+		}
 
+		rn.Ctime = now
+
+		// Agent used its own clock, fetch the times it picked
+		if req.Valid.AtimeNow() || req.Valid.MtimeNow() {
+			rn.IsCached = false
 		}
 	}
 
@@ -459,22 +550,35 @@ func (rn *RemoteNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDi
 		zap.String("path", rn.RemotePath.Path),
 		zap.String("old_name", req.OldName),
 		zap.String("new_name", req.NewName),
-		zap.String("new_dir", newDir.(*RemoteNode).RemotePath.Path),
 	)
 
-	rnDestDir := newDir.(*RemoteNode)
-	val, ok := rn.RemoteNodes.Get(req.OldName)
+	// Virtual directories only exist on this machine
+	rnDestDir := renameTarget(newDir, rn.RemotePath.Address())
+	if rnDestDir == nil {
+		return fuse.Errno(syscall.EXDEV)
+	}
 
-	var curRn *RemoteNode
-	if ok {
-		curRn = val.(*RemoteNode)
-	} else {
-		// TODO Error
+	curRn, ok := rn.lookupChild(req.OldName)
+
+	if !ok {
+		return fuse.ENOENT
 	}
 
-	destPath := path.Join(rnDestDir.RemotePath.Path, req.NewName)
+	destPath := &RemotePath{
+		Hostname: rnDestDir.RemotePath.Hostname,
+		Port:     rnDestDir.RemotePath.Port,
+		Path:     path.Join(rnDestDir.RemotePath.Path, req.NewName),
+	}
 
-	err := FileHandler().Rename(curRn.RemotePath, destPath)
+	var err error
+	if destPath.Address() == rn.RemotePath.Address() {
+		err = FileHandler().Rename(curRn.RemotePath, destPath.Path)
+	} else if FileHandler().CrossHostRename() && !curRn.IsDir {
+		err = FileHandler().Move(curRn.RemotePath, destPath, rn.logMoveProgress(curRn.RemotePath, destPath))
+	} else {
+		// Tools like mv fall back to copy and delete on their own
+		err = fuse.Errno(syscall.EXDEV)
+	}
 	// Check If destination exists (actual move should do it)
 	// Do Move at Remote
 	// Update Cache Map
@@ -483,7 +587,7 @@ func (rn *RemoteNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDi
 	// Add RemoteNode in newDir's list (if doesnt exist)
 
 	if err == nil {
-		curRn.RemotePath.Path = destPath
+		curRn.RemotePath = destPath
 		rn.RemoteNodes.Remove(req.OldName)
 		rnDestDir.RemoteNodes.Set(req.NewName, curRn)
 	} else {
@@ -494,7 +598,7 @@ func (rn *RemoteNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDi
 			zap.String("path", rn.RemotePath.Path),
 			zap.String("old_name", req.OldName),
 			zap.String("new_name", req.NewName),
-			zap.String("new_dir", newDir.(*RemoteNode).RemotePath.Path),
+			zap.String("dest_path", destPath.String()),
 			zap.Error(err),
 		)
 
@@ -502,3 +606,28 @@ func (rn *RemoteNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDi
 
 	return err
 }
+
+func (rn *RemoteNode) logMoveProgress(remotePath *RemotePath, destPath *RemotePath) func(int64, int64) {
+	lastPercent := int64(0)
+	reported := false
+
+	return func(done int64, total int64) {
+		percent := done * 100 / total
+
+		// Only log the first chunk and then every 10%
+		if reported && percent/10 == lastPercent/10 {
+			return
+		}
+
+		lastPercent = percent
+		reported = true
+
+		zap.L().Info("Move Progress",
+			zap.String("op", "rename"),
+			zap.String("path", remotePath.String()),
+			zap.String("dest_path", destPath.String()),
+			zap.Int64("done", done),
+			zap.Int64("total", total),
+		)
+	}
+}
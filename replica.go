@@ -0,0 +1,274 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"github.com/orcaman/concurrent-map"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Agents serving identical copies of a tree. Nodes below the group use its
+// name behind ReplicaHostnamePrefix as hostname with port 0, the talker
+// hands their requests to the set which sends reads to the healthiest
+// replica and writes to the primary.
+type ReplicaSet struct {
+	Name     string
+	Replicas []string
+
+	// Empty when the group is read only
+	Primary string
+
+	// Replica holding each descriptor opened through the set, keyed by the
+	// descriptor
+	handles cmap.ConcurrentMap
+}
+
+type replicaHandle struct {
+	address string
+
+	// Request that opened a read only descriptor, replayed on another
+	// replica when this one goes down
+	open *OpenInfo
+}
+
+func newReplicaSet(cfg *ReplicaConfig) *ReplicaSet {
+	return &ReplicaSet{
+		Name:     cfg.Name,
+		Replicas: cfg.Replicas,
+		Primary:  cfg.Primary,
+		handles:  cmap.New(),
+	}
+}
+
+func (rs *ReplicaSet) Address() string {
+	return (&RemotePath{Hostname: ReplicaHostnamePrefix + rs.Name}).Address()
+}
+
+func (rs *ReplicaSet) send(opCode uint8, payload Payload, cost int64) *Packet {
+
+	if isWriteRequest(opCode, payload) {
+
+		if rs.Primary == "" {
+			return errorPacket(syscall.EROFS)
+		}
+
+		resp := Talker().sendSized(opCode, rs.Primary, payload, cost)
+		rs.track(opCode, payload, rs.Primary, nil, resp)
+
+		return resp
+	}
+
+	if fd, ok := descriptorOf(payload); ok && opCode != OpenRequest {
+		if val, ok := rs.handles.Get(strconv.FormatUint(fd, 10)); ok {
+			return rs.sendHandle(fd, val.(*replicaHandle), opCode, payload, cost)
+		}
+	}
+
+	var resp *Packet
+
+	for _, address := range rs.ranked() {
+
+		resp = Talker().sendSized(opCode, address, payload, cost)
+
+		if !isHostDown(resp) {
+			open, _ := payload.(*OpenInfo)
+			rs.track(opCode, payload, address, open, resp)
+			return resp
+		}
+
+		zap.L().Warn("Replica Down, Failing Over",
+			zap.String("replica", rs.Name),
+			zap.String("address", address),
+			zap.String("op", ConvertOpCodeToString(opCode)),
+		)
+	}
+
+	return resp
+}
+
+// Sends a request on an open descriptor to the replica holding it, a read
+// only descriptor is reopened on another replica if that one is down
+func (rs *ReplicaSet) sendHandle(fd uint64, handle *replicaHandle, opCode uint8, payload Payload, cost int64) *Packet {
+
+	key := strconv.FormatUint(fd, 10)
+	resp := Talker().sendSized(opCode, handle.address, payload, cost)
+
+	if opCode == CloseRequest {
+		rs.handles.Remove(key)
+	}
+
+	if !isHostDown(resp) || handle.open == nil || opCode == CloseRequest {
+		return resp
+	}
+
+	for _, address := range rs.ranked() {
+
+		if address == handle.address {
+			continue
+		}
+
+		if Talker().sendRequest(OpenRequest, address, handle.open).Err() != nil {
+			continue
+		}
+
+		zap.L().Warn("Replica Down, Reopened Descriptor",
+			zap.String("replica", rs.Name),
+			zap.String("from", handle.address),
+			zap.String("to", address),
+			zap.Uint64("fd", fd),
+		)
+
+		rs.handles.Set(key, &replicaHandle{address: address, open: handle.open})
+		return Talker().sendSized(opCode, address, payload, cost)
+	}
+
+	return resp
+}
+
+// Remembers where descriptors were opened so later requests follow them
+func (rs *ReplicaSet) track(opCode uint8, payload Payload, address string, open *OpenInfo, resp *Packet) {
+
+	fd, ok := descriptorOf(payload)
+
+	if !ok {
+		return
+	}
+
+	key := strconv.FormatUint(fd, 10)
+
+	switch opCode {
+	case OpenRequest, CreateRequest:
+		if resp.Err() == nil {
+			rs.handles.Set(key, &replicaHandle{address: address, open: open})
+		}
+	case CloseRequest:
+		rs.handles.Remove(key)
+	}
+}
+
+// Replicas that are up ordered by latency, then the ones that are down
+func (rs *ReplicaSet) ranked() []string {
+
+	type candidate struct {
+		address string
+		up      bool
+		latency time.Duration
+	}
+
+	var candidates []candidate
+
+	for _, address := range rs.Replicas {
+
+		c := candidate{address: address}
+
+		if val, ok := Talker().Pools.Get(address); ok {
+			pool := val.(*FsConnectionPool)
+			c.up = pool.IsUp()
+			c.latency = pool.Latency()
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	// Replicas not timed yet go after the ones that were
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		if a.up != b.up {
+			return a.up
+		}
+
+		if (a.latency == 0) != (b.latency == 0) {
+			return b.latency == 0
+		}
+
+		return a.latency < b.latency
+	})
+
+	var addresses []string
+	for _, c := range candidates {
+		addresses = append(addresses, c.address)
+	}
+
+	return addresses
+}
+
+// Health of the group, up while any replica is
+func (rs *ReplicaSet) status() *HostStatus {
+
+	status := &HostStatus{}
+
+	for _, address := range rs.Replicas {
+
+		replica, ok := Talker().HostStatus(address)
+
+		if !ok {
+			continue
+		}
+
+		if replica.Up && (!status.Up || replica.Latency < status.Latency) {
+			status.Latency = replica.Latency
+		}
+
+		status.Up = status.Up || replica.Up
+		status.InFlight += replica.InFlight
+		status.Connections = append(status.Connections, replica.Connections...)
+	}
+
+	return status
+}
+
+func isHostDown(resp *Packet) bool {
+	return resp.Err() == syscall.EHOSTDOWN
+}
+
+func isWriteRequest(opCode uint8, payload Payload) bool {
+	switch opCode {
+	case WriteFileRequest, SetAttrRequest, CreateRequest, RemoveRequest, RenameRequest, CopyRequest, AllocateRequest:
+		return true
+	case OpenRequest:
+		return !payload.(*OpenInfo).Flags.IsReadOnly()
+	}
+
+	return false
+}
+
+// Descriptor a request works on, false if it does not use one
+func descriptorOf(payload Payload) (uint64, bool) {
+	switch info := payload.(type) {
+	case *OpenInfo:
+		return info.FileDescriptor, true
+	case *CreateInfo:
+		return info.FileDescriptor, info.FileDescriptor != 0
+	case *ReadInfo:
+		return info.FileDescriptor, true
+	case *ReadDirInfo:
+		return info.FileDescriptor, true
+	case *WriteInfo:
+		return info.FileDescriptor, true
+	case *AllocateInfo:
+		return info.FileDescriptor, true
+	case *CloseInfo:
+		return info.FileDescriptor, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,97 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"bazil.org/fuse"
+	"github.com/chemistry-sourabh/ifs"
+	"path"
+	"syscall"
+	"testing"
+)
+
+// A replica that goes down is skipped, the next one in rank serves the group
+func TestReplicaSet_Failover(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "mirror-a", "mirror-b")
+	defer cleanup()
+
+	dir := remotePaths[0].Path
+	WriteDummyDataToPath(path.Join(dir, "file"), 4)
+
+	cfg := &ifs.ReplicaConfig{Name: "failover", Path: dir, Replicas: []string{remotePaths[0].Address(), remotePaths[1].Address()}}
+	ifs.Talker().AddReplicaSet(cfg)
+
+	file := &ifs.RemotePath{Hostname: cfg.RemotePath().Hostname, Path: path.Join(dir, "file")}
+	address := cfg.RemotePath().Address()
+
+	for _, replica := range cfg.Replicas {
+
+		resp := ifs.Talker().SendRequest(ifs.AttrRequest, address, file)
+		Ok(t, resp.Err())
+		Compare(t, resp.Data.(*ifs.Stat).Size, int64(4))
+
+		ifs.Talker().FailHost(replica)
+	}
+
+	resp := ifs.Talker().SendRequest(ifs.AttrRequest, address, file)
+	Compare(t, resp.Err(), syscall.EHOSTDOWN)
+}
+
+// A read only descriptor on a replica that goes down is reopened on another
+// one and the request that found it down is sent there
+func TestReplicaSet_ReopenHandle(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "reopen-a", "reopen-b")
+	defer cleanup()
+
+	dir := remotePaths[0].Path
+	data := WriteDummyDataToPath(path.Join(dir, "file"), 4)
+
+	cfg := &ifs.ReplicaConfig{Name: "reopen", Path: dir, Replicas: []string{remotePaths[0].Address(), remotePaths[1].Address()}}
+	ifs.Talker().AddReplicaSet(cfg)
+
+	address := cfg.RemotePath().Address()
+	name := path.Join(dir, "file")
+
+	resp := ifs.Talker().SendRequest(ifs.OpenRequest, address, &ifs.OpenInfo{Path: name, FileDescriptor: 7, Flags: fuse.OpenReadOnly})
+	Ok(t, resp.Err())
+
+	opened := ifs.Talker().ReplicaHandle(cfg, 7)
+
+	if opened == "" {
+		t.Fatal("descriptor was not tracked")
+	}
+
+	ifs.Talker().FailHost(opened)
+
+	resp = ifs.Talker().SendRequest(ifs.ReadFileRequest, address, &ifs.ReadInfo{Path: name, FileDescriptor: 7, Size: 4})
+	Ok(t, resp.Err())
+	Compare(t, resp.Data.(*ifs.FileChunk).Chunk, data)
+
+	reopened := ifs.Talker().ReplicaHandle(cfg, 7)
+
+	if reopened == "" || reopened == opened {
+		PrintTestError(t, "descriptor not reopened on another replica", reopened, "the other replica")
+	}
+
+	resp = ifs.Talker().SendRequest(ifs.CloseRequest, address, &ifs.CloseInfo{Path: name, FileDescriptor: 7})
+	Ok(t, resp.Err())
+	Compare(t, ifs.Talker().ReplicaHandle(cfg, 7), "")
+}
@@ -22,64 +22,80 @@ import (
 )
 
 type ReadDirInfo struct {
-	Path           string
-	FileDescriptor uint64
+	Path           string `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"2,keyasint,omitempty"`
 }
 
 type ReadInfo struct {
-	Path           string
-	FileDescriptor uint64
-	Offset         int64
-	Size           int
+	Path           string `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"2,keyasint,omitempty"`
+	Offset         int64  `cbor:"3,keyasint,omitempty"`
+	Size           int    `cbor:"4,keyasint,omitempty"`
 }
 
 type WriteInfo struct {
-	Path           string
-	FileDescriptor uint64
-	Offset         int64
-	Data           []byte
+	Path           string `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"2,keyasint,omitempty"`
+	Offset         int64  `cbor:"3,keyasint,omitempty"`
+	Data           []byte `cbor:"4,keyasint,omitempty"`
+
+	// How Data is compressed, CompressionNone when it is not
+	Compression uint8 `cbor:"5,keyasint,omitempty"`
 }
 
 type AttrInfo struct {
-	Path  string
-	Valid fuse.SetattrValid
-	Size  uint64
-	Mode  os.FileMode
-	ATime int64
-	MTime int64
+	Path  string            `cbor:"1,keyasint,omitempty"`
+	Valid fuse.SetattrValid `cbor:"2,keyasint,omitempty"`
+	Size  uint64            `cbor:"3,keyasint,omitempty"`
+	Mode  os.FileMode       `cbor:"4,keyasint,omitempty"`
+	ATime int64             `cbor:"5,keyasint,omitempty"`
+	MTime int64             `cbor:"6,keyasint,omitempty"`
 }
 
 type CreateInfo struct {
-	BaseDir        string
-	Name           string
-	IsDir          bool
-	FileDescriptor uint64
+	BaseDir        string `cbor:"1,keyasint,omitempty"`
+	Name           string `cbor:"2,keyasint,omitempty"`
+	IsDir          bool   `cbor:"3,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"4,keyasint,omitempty"`
 }
 
 type RenameInfo struct {
-	Path     string
-	DestPath string
+	Path     string `cbor:"1,keyasint,omitempty"`
+	DestPath string `cbor:"2,keyasint,omitempty"`
+}
+
+type CopyInfo struct {
+	Path     string `cbor:"1,keyasint,omitempty"`
+	DestPath string `cbor:"2,keyasint,omitempty"`
+}
+
+type AllocateInfo struct {
+	Path           string `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"2,keyasint,omitempty"`
+	Mode           uint32 `cbor:"3,keyasint,omitempty"`
+	Offset         int64  `cbor:"4,keyasint,omitempty"`
+	Length         int64  `cbor:"5,keyasint,omitempty"`
 }
 
 type OpenInfo struct {
-	Path           string
-	FileDescriptor uint64
-	Flags          fuse.OpenFlags
+	Path           string         `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64         `cbor:"2,keyasint,omitempty"`
+	Flags          fuse.OpenFlags `cbor:"3,keyasint,omitempty"`
 	//Perm           int
 }
 
 type CloseInfo struct {
-	Path           string
-	FileDescriptor uint64
+	Path           string `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"2,keyasint,omitempty"`
 }
 
 type FlushInfo struct {
-	Path           string
-	FileDescriptor uint64
+	Path           string `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64 `cbor:"2,keyasint,omitempty"`
 }
 
 type FetchInfo struct {
-	RemotePath     *RemotePath
-	FileDescriptor uint64
-	Flags          fuse.OpenFlags
+	RemotePath     *RemotePath    `cbor:"1,keyasint,omitempty"`
+	FileDescriptor uint64         `cbor:"2,keyasint,omitempty"`
+	Flags          fuse.OpenFlags `cbor:"3,keyasint,omitempty"`
 }
@@ -21,51 +21,51 @@ import (
 )
 
 type Stat struct {
-	Name    string
-	Size    int64
-	Mode    os.FileMode
-	ModTime int64
-	IsDir   bool
+	Name    string      `cbor:"1,keyasint,omitempty"`
+	Size    int64       `cbor:"2,keyasint,omitempty"`
+	Mode    os.FileMode `cbor:"3,keyasint,omitempty"`
+	ModTime int64       `cbor:"4,keyasint,omitempty"`
+	ATime   int64       `cbor:"5,keyasint,omitempty"`
+	CTime   int64       `cbor:"6,keyasint,omitempty"`
+	CrTime  int64       `cbor:"7,keyasint,omitempty"`
+	IsDir   bool        `cbor:"8,keyasint,omitempty"`
+	Dev     uint64      `cbor:"9,keyasint,omitempty"`
+	Ino     uint64      `cbor:"10,keyasint,omitempty"`
 }
 
 type DirInfo struct {
-	Stats []*Stat
+	Stats []*Stat `cbor:"1,keyasint,omitempty"`
 }
 
-type FileChunk struct {
-	Chunk []byte
-	Size  int
+// A region of a file that holds data
+type Extent struct {
+	Offset int64 `cbor:"1,keyasint,omitempty"`
+	Length int64 `cbor:"2,keyasint,omitempty"`
 }
 
-// TODO Skip compression if file is too small
-//func (fc *FileChunk) Compress() {
-//	var b bytes.Buffer
-//	w := zlib.NewWriter(&b)
-//	defer w.Close()
-//	w.Write(fc.Chunk)
-//	fc.Chunk = b.Bytes()
-//}
-//
-//func (fc *FileChunk) Decompress() {
-//	var b bytes.Buffer
-//	b.Write(fc.Chunk)
-//	r, err := zlib.NewReader(&b)
-//	defer r.Close()
-//
-//	if err != nil && err != io.EOF {
-//		zap.L().Fatal("Decompression Failed",
-//			zap.Error(err),
-//		)
-//	}
-//
-//	var out bytes.Buffer
-//	out.ReadFrom(r)
-//	fc.Chunk = out.Bytes()
-//}
+// When Extents is set the chunk is a sparse file, Chunk holds the data of
+// each extent back to back and Size is the full length of the file
+type FileChunk struct {
+	Chunk   []byte    `cbor:"1,keyasint,omitempty"`
+	Size    int       `cbor:"2,keyasint,omitempty"`
+	Extents []*Extent `cbor:"3,keyasint,omitempty"`
+
+	// How Chunk is compressed, CompressionNone when it is not
+	Compression uint8 `cbor:"4,keyasint,omitempty"`
+}
 
 type WriteResult struct {
-	Size     int
-	FileSize int64
+	Size     int   `cbor:"1,keyasint,omitempty"`
+	FileSize int64 `cbor:"2,keyasint,omitempty"`
+	ModTime  int64 `cbor:"3,keyasint,omitempty"`
+	CTime    int64 `cbor:"4,keyasint,omitempty"`
+}
+
+// Space on the filesystem holding a path, in bytes
+type FsStat struct {
+	Total uint64 `cbor:"1,keyasint,omitempty"`
+	Free  uint64 `cbor:"2,keyasint,omitempty"`
+	Avail uint64 `cbor:"3,keyasint,omitempty"`
 }
 
 type Error struct {
@@ -18,22 +18,38 @@ limitations under the License.
 
 package ifs_test
 
-//func TestFileChunk_Compress_Decompress(t *testing.T) {
-//	t.SkipNow()
-//	str := "hello world!! Bye World!!!"
-//
-//	bytes := []byte(str)
-//
-//	fileChunk := &ifs.FileChunk{
-//		Chunk: bytes,
-//		Size:  len(str),
-//	}
-//
-//	fileChunk.Compress()
-//	fileChunk.Decompress()
-//
-//	decompressed := string(fileChunk.Chunk)
-//	if str != decompressed {
-//		PrintTestError(t, "strings not matching", decompressed, str)
-//	}
-//}
+import (
+	"bytes"
+	"github.com/chemistry-sourabh/ifs"
+	"testing"
+)
+
+func TestFileChunk_Compress_Decompress(t *testing.T) {
+
+	zstd, _ := ifs.GetCompressor(ifs.CompressionZstd)
+
+	chunk := &ifs.FileChunk{
+		Chunk: bytes.Repeat([]byte("hello world!! Bye World!!!"), 4096),
+	}
+	chunk.Size = len(chunk.Chunk)
+
+	pkt := CreatePacket(ifs.FileDataResponse, chunk)
+	saved := pkt.Compress(zstd)
+
+	if saved <= 0 {
+		PrintTestError(t, "nothing saved", saved, "more than 0")
+	}
+
+	got := pkt.Data.(*ifs.FileChunk)
+	Compare(t, got.Compression, ifs.CompressionZstdId)
+	Compare(t, int64(len(got.Chunk)), int64(chunk.Size)-saved)
+
+	// The chunk handed in is left as it was
+	Compare(t, chunk.Compression, ifs.CompressionNone)
+
+	restored, err := pkt.Decompress()
+	Ok(t, err)
+
+	Compare(t, restored, saved)
+	Compare(t, pkt.Data, chunk)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Finds the regions of a file that hold data by walking it with
+// SEEK_DATA and SEEK_HOLE
+func dataExtents(f *os.File, size int64) ([]*Extent, error) {
+
+	var extents []*Extent
+
+	for offset := int64(0); offset < size; {
+
+		start, err := f.Seek(offset, seekData)
+
+		// No data after offset
+		if ConvertErr(err) == syscall.ENXIO {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		end, err := f.Seek(start, seekHole)
+
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, &Extent{
+			Offset: start,
+			Length: end - start,
+		})
+
+		offset = end
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+
+	return extents, err
+}
+
+// Reads a file keeping holes out of the chunk, returns a plain chunk when the
+// file has no holes or the filesystem cannot report them
+func readSparse(f *os.File, size int64) (*FileChunk, error) {
+
+	extents, err := dataExtents(f, size)
+
+	if err != nil || (len(extents) == 1 && extents[0].Length == size) {
+		data := make([]byte, size)
+		n, err := io.ReadFull(f, data)
+
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+
+		return &FileChunk{
+			Chunk: data[:n],
+			Size:  n,
+		}, err
+	}
+
+	var data []byte
+
+	// A file that is all hole still has to be told apart from a plain chunk
+	if extents == nil {
+		extents = []*Extent{}
+	}
+
+	for _, extent := range extents {
+		b := make([]byte, extent.Length)
+		n, err := f.ReadAt(b, extent.Offset)
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		extent.Length = int64(n)
+		data = append(data, b[:n]...)
+	}
+
+	return &FileChunk{
+		Chunk:   data,
+		Size:    int(size),
+		Extents: extents,
+	}, nil
+}
+
+// Writes a chunk to disk recreating the holes of a sparse chunk. The file
+// always takes the size of the chunk, empty extents travel as none so an all
+// hole file arrives looking like a plain chunk with no data.
+func writeSparse(filePath string, fileChunk *FileChunk) error {
+
+	extents := fileChunk.Extents
+
+	if extents == nil && len(fileChunk.Chunk) > 0 {
+		extents = []*Extent{{Offset: 0, Length: int64(len(fileChunk.Chunk))}}
+	}
+
+	size := int64(fileChunk.Size)
+
+	if size < int64(len(fileChunk.Chunk)) && fileChunk.Extents == nil {
+		size = int64(len(fileChunk.Chunk))
+	}
+
+	if fileChunk.Size < 0 || !validExtents(extents, size, int64(len(fileChunk.Chunk))) {
+		return syscall.EIO
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(size)
+
+	start := int64(0)
+	for _, extent := range extents {
+
+		if err != nil {
+			break
+		}
+
+		_, err = f.WriteAt(fileChunk.Chunk[start:start+extent.Length], extent.Offset)
+		start += extent.Length
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Checks that extents are in order, do not overlap, fit in a file of size
+// and hold exactly dataLen bytes of data between them
+func validExtents(extents []*Extent, size int64, dataLen int64) bool {
+
+	end := int64(0)
+	total := int64(0)
+
+	for _, extent := range extents {
+
+		if extent.Offset < end || extent.Length < 0 || extent.Length > size-extent.Offset {
+			return false
+		}
+
+		end = extent.Offset + extent.Length
+		total += extent.Length
+	}
+
+	return total == dataLen
+}
@@ -0,0 +1,29 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"os"
+	"syscall"
+)
+
+const seekData = 3
+const seekHole = 4
+
+func fallocate(f *os.File, mode uint32, offset int64, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), mode, offset, length)
+}
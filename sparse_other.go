@@ -0,0 +1,52 @@
+// +build !linux
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+var seekData, seekHole = seekFlags()
+
+func seekFlags() (int, int) {
+	// Darwin numbers them the other way around
+	if runtime.GOOS == "darwin" {
+		return 4, 3
+	}
+
+	return 3, 4
+}
+
+// Only plain allocation can be emulated, by growing the file
+func fallocate(f *os.File, mode uint32, offset int64, length int64) error {
+
+	if mode != 0 {
+		return syscall.ENOTSUP
+	}
+
+	info, err := f.Stat()
+
+	if err == nil && info.Size() < offset+length {
+		err = f.Truncate(offset + length)
+	}
+
+	return err
+}
@@ -19,8 +19,16 @@ package ifs
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -33,6 +41,14 @@ func FuseServer() *fs.Server {
 
 func SetupLogger(cfg *LogConfig) {
 
+	// Log to the console when the config has no log section
+	if cfg == nil {
+		cfg = &LogConfig{
+			Logging: true,
+			Console: true,
+		}
+	}
+
 	loggerCfg := zap.NewDevelopmentConfig()
 
 	if !cfg.Logging {
@@ -58,22 +74,22 @@ func SetupLogger(cfg *LogConfig) {
 
 func MountRemoteRoots(cfg *FsConfig) {
 
-	//sigChan := make(chan os.Signal, 1)
-	//signal.Notify(sigChan, os.Interrupt)
-	//
-	//go func() {
-	//	for range sigChan {
-	//		err := fuse.Unmount(cfg.MountPoint)
-	//
-	//		if err == nil {
-	//			zap.L().Info("Unmounted Successfully")
-	//		} else {
-	//			zap.L().Warn("Unmount Failed",
-	//				zap.Error(err),
-	//			)
-	//		}
-	//	}
-	//}()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for range sigChan {
+			err := Unmount(cfg.MountPoint, false, false)
+
+			if err == nil {
+				zap.L().Info("Unmounted Successfully")
+			} else {
+				zap.L().Warn("Unmount Failed, Mount is Busy",
+					zap.Error(err),
+				)
+			}
+		}
+	}()
 
 	// TODO Figure out more options to add
 	options := []fuse.MountOption{
@@ -93,11 +109,36 @@ func MountRemoteRoots(cfg *FsConfig) {
 
 	fuseServerInstance = fs.New(c, nil)
 
+	if err := Talker().LoadCA(cfg.CAFile); err != nil {
+		zap.L().Fatal("Loading CA Failed",
+			zap.Error(err),
+		)
+	}
+
+	Talker().SetFlowLimits(cfg.ConnWindow, cfg.MemoryLimit)
+	Talker().SetCodec(cfg.Codec)
+	Talker().SetCompression(cfg.Compression)
+
 	Ifs().Startup(cfg.RemoteRoots)
-	Talker().Startup(cfg.RemoteRoots, cfg.ConnCount)
-	Hoarder().Startup(cfg.CacheLocation, 100)
-	FileHandler().StartUp()
+	Ifs().StartupUnions(cfg.Unions)
+	Ifs().StartupReplicas(cfg.Replicas)
+	Talker().Startup(cfg.HostRoots(), cfg.ConnCount)
+	Talker().StartupReplicas(cfg.Replicas)
+	Hoarder().Startup(cfg.CacheLocation, cfg.CacheSize)
+	FileHandler().StartUp(cfg.CrossHostRename)
 
+	fsConfig = cfg
+	reloadOnHangup(ReloadConfig)
+
+	listener, err := serveControl(cfg.ControlSocketPath(), cfg.MountPoint)
+
+	if err != nil {
+		zap.L().Warn("Control Socket Failed, Runtime Changes Disabled",
+			zap.Error(err),
+		)
+	}
+
+	// Returns once the kernel has unmounted the filesystem
 	FuseServer().Serve(Ifs())
 
 	<-c.Ready
@@ -107,5 +148,84 @@ func MountRemoteRoots(cfg *FsConfig) {
 		)
 	}
 
+	if listener != nil {
+		listener.Close()
+	}
+
+	shutdown(DrainTimeout)
+
 	zap.L().Core().Sync()
 }
+
+// Waits up to drainTimeout for requests in flight, then closes the files
+// left open and the connections to the agents
+func shutdown(drainTimeout time.Duration) {
+
+	zap.L().Info("Shutting Down")
+
+	if !Talker().Drain(drainTimeout) {
+		zap.L().Warn("Requests Still Pending After Drain Timeout")
+	}
+
+	// Cache writes go through to the agent first so there is nothing dirty
+	// left to push, only descriptors to close
+	FileHandler().CloseAll()
+	Talker().Shutdown()
+}
+
+// Unmounts the filesystem, the mount process notices and shuts down. A lazy
+// unmount detaches a busy mount right away and a forced one also aborts the
+// files still open on it.
+func Unmount(mountPoint string, lazy bool, force bool) error {
+
+	var cmd *exec.Cmd
+
+	switch {
+	case !lazy && !force:
+		return fuse.Unmount(mountPoint)
+	case runtime.GOOS == "linux" && !force:
+		cmd = exec.Command("fusermount", "-u", "-z", mountPoint)
+	default:
+		cmd = exec.Command("umount", "-f", mountPoint)
+	}
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil && len(output) > 0 {
+		err = fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return err
+}
+
+// Copies a file on a remote host without streaming it through this machine.
+// A host that cfg names is reached the way the mount reaches it, any other
+// is dialed over the default transport.
+func CopyRemotePath(cfg *FsConfig, src *RemotePath, dest *RemotePath) error {
+
+	if src.Address() != dest.Address() {
+		return syscall.EXDEV
+	}
+
+	remoteRoot := &RemoteRoot{
+		Hostname: src.Hostname,
+		Port:     src.Port,
+	}
+
+	if cfg != nil {
+		if err := Talker().LoadCA(cfg.CAFile); err != nil {
+			return err
+		}
+
+		Talker().SetCodec(cfg.Codec)
+		Talker().SetCompression(cfg.Compression)
+
+		if hostRoot := cfg.HostRoot(src.Address()); hostRoot != nil {
+			remoteRoot = hostRoot
+		}
+	}
+
+	Talker().Startup([]*RemoteRoot{remoteRoot}, 1)
+
+	return FileHandler().Copy(src, dest)
+}
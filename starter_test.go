@@ -0,0 +1,118 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"bazil.org/fuse"
+	"github.com/chemistry-sourabh/ifs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A host the config names is dialed with its own transport, not websocket
+func TestCopyRemotePath(t *testing.T) {
+
+	dir := path.Join(os.TempDir(), "ifs_copy_"+strconv.Itoa(os.Getpid()))
+	Ok(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	socket := dir + ".sock"
+	defer os.Remove(socket)
+
+	transport, _ := ifs.GetTransport(ifs.TransportUnix)
+
+	listener, err := transport.Listen(socket, nil)
+	Ok(t, err)
+	defer listener.Close()
+
+	go ifs.AgentTalker().Serve(listener)
+
+	cfg := &ifs.FsConfig{
+		MountPoint: "/tmp/ifs",
+		RemoteRoots: []*ifs.RemoteRoot{
+			{Hostname: "copy-agent", Transport: ifs.TransportUnix, Socket: socket, Paths: []string{dir}},
+		},
+	}
+
+	Ok(t, ioutil.WriteFile(path.Join(dir, "src"), []byte("data"), 0644))
+
+	src := &ifs.RemotePath{Hostname: "copy-agent", Path: path.Join(dir, "src")}
+	dest := &ifs.RemotePath{Hostname: "copy-agent", Path: path.Join(dir, "dest")}
+
+	Ok(t, ifs.CopyRemotePath(cfg, src, dest))
+
+	data, err := ioutil.ReadFile(dest.Path)
+	Ok(t, err)
+	Compare(t, string(data), "data")
+}
+
+// Shutting down lets requests in flight finish, then closes the descriptors
+// still open on the agents and refuses anything sent afterwards
+func TestShutdown(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "shutdown")
+	defer cleanup()
+	defer ifs.Talker().Reopen()
+
+	fd, err := ifs.FileHandler().OpenFile(remotePaths[0], fuse.OpenReadOnly, true)
+	Ok(t, err)
+
+	key := strconv.FormatUint(fd, 10)
+	Compare(t, ifs.AgentFileHandler().Opened.Has(key), true)
+
+	ifs.Talker().SetFlowLimits(64, 1)
+	defer ifs.Talker().SetFlowLimits(0, 0)
+
+	// A fetch waits for room until the drain has started
+	held := ifs.Talker().Memory().Acquire(1024 * 1024)
+
+	file := &ifs.RemotePath{Hostname: remotePaths[0].Hostname, Path: path.Join(remotePaths[0].Path, "file")}
+	WriteDummyDataToPath(file.Path, 1)
+
+	fetched := make(chan *ifs.Packet, 1)
+	go func() {
+		fetched <- ifs.Talker().SendRequest(ifs.FetchFileRequest, file.Address(), file)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		ifs.Talker().Memory().Release(held)
+	})
+
+	ifs.ShutdownMount(5 * time.Second)
+
+	select {
+	case resp := <-fetched:
+		Ok(t, resp.Err())
+	default:
+		t.Fatal("shutdown did not wait for the fetch")
+	}
+
+	Compare(t, ifs.AgentFileHandler().Opened.Has(key), false)
+	Compare(t, ifs.FileHandler().OpenHandles(remotePaths[0]), 0)
+
+	resp := ifs.Talker().SendRequest(ifs.AttrRequest, file.Address(), file)
+	Compare(t, resp.Err(), syscall.ESHUTDOWN)
+}
@@ -17,17 +17,36 @@ limitations under the License.
 package ifs
 
 import (
+	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"github.com/orcaman/concurrent-map"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Errors queueing a response on a connection of an agent
+var ErrConnGone = errors.New("connection is gone")
+var ErrConnStalled = errors.New("connection stopped reading")
+
 type AgentConnectionPool struct {
+	// Slots change owner under the write lock, which is never held while
+	// waiting on a queue
+	mu sync.RWMutex
+
 	Connections      cmap.ConcurrentMap
 	ReceivedChannels cmap.ConcurrentMap
 	SendingChannels  cmap.ConcurrentMap
+
+	// Closed when a slot is freed, sending channels are never closed so a
+	// late response cannot panic on one
+	done cmap.ConcurrentMap
+
+	// What each connection agreed on in its hello
+	Peers cmap.ConcurrentMap
 }
 
 func NewAgentConnectionPool() *AgentConnectionPool {
@@ -35,50 +54,341 @@ func NewAgentConnectionPool() *AgentConnectionPool {
 		Connections:      cmap.New(),
 		ReceivedChannels: cmap.New(),
 		SendingChannels:  cmap.New(),
+		Peers:            cmap.New(),
+		done:             cmap.New(),
 	}
 }
 
-func (p *AgentConnectionPool) Set(index uint8, conn *websocket.Conn) {
-	p.Connections.Set(strconv.FormatUint(uint64(index), 10), conn)
-	p.ReceivedChannels.Set(strconv.FormatUint(uint64(index), 10), make(chan *Packet, ChannelLength))
-	p.SendingChannels.Set(strconv.FormatUint(uint64(index), 10), make(chan *Packet, ChannelLength))
+func (p *AgentConnectionPool) peer(index uint8) (*Hello, bool) {
+	val, ok := p.Peers.Get(strconv.FormatUint(uint64(index), 10))
+
+	if !ok {
+		return nil, false
+	}
+
+	return val.(*Hello), true
+}
+
+// Codec of the connection at index, msgpack until its hello is done
+func (p *AgentConnectionPool) Codec(index uint8) Codec {
+	if peer, ok := p.peer(index); ok {
+		return peer.Codec()
+	}
+
+	return MsgpackCodec
+}
+
+// Compressor for file data sent on index, nil until its hello is done
+func (p *AgentConnectionPool) Compressor(index uint8) Compressor {
+	if peer, ok := p.peer(index); ok {
+		return peer.Compressor()
+	}
+
+	return nil
+}
+
+func (p *AgentConnectionPool) SetPeer(index uint8, common *Hello) {
+	p.Peers.Set(strconv.FormatUint(uint64(index), 10), common)
 }
 
+// Stores conn in the first free slot, responses go back through the slot
+// a request arrived on so an index is never shared by two connections.
+// False when every slot is taken.
+func (p *AgentConnectionPool) Add(conn Conn) (uint8, bool) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < MaxConnCount; i++ {
+
+		key := strconv.FormatUint(uint64(i), 10)
+
+		if p.Connections.SetIfAbsent(key, conn) {
+			p.ReceivedChannels.Set(key, make(chan *Packet, ChannelLength))
+			p.SendingChannels.Set(key, make(chan *Packet, ChannelLength))
+			p.done.Set(key, make(chan struct{}))
+			return uint8(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// Frees the slot index, the writer of the connection and any response
+// waiting for room in its queue stop
 func (p *AgentConnectionPool) Remove(index uint8) {
-	p.Connections.Remove(strconv.FormatUint(uint64(index), 10))
-	p.SendingChannels.Remove(strconv.FormatUint(uint64(index), 10))
-	p.ReceivedChannels.Remove(strconv.FormatUint(uint64(index), 10))
+
+	key := strconv.FormatUint(uint64(index), 10)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if val, ok := p.done.Get(key); ok {
+		close(val.(chan struct{}))
+	}
+
+	p.done.Remove(key)
+	p.SendingChannels.Remove(key)
+	p.ReceivedChannels.Remove(key)
+	p.Peers.Remove(key)
+
+	// Last, the slot is free to take once this is gone
+	p.Connections.Remove(key)
+}
+
+// Queues pkt on the slot index while it still holds conn. ErrConnGone when
+// conn is gone and the slot may belong to another client by now, a client
+// whose queue stays full for SendQueueTimeout is closed with ErrConnStalled.
+func (p *AgentConnectionPool) Send(index uint8, conn Conn, pkt *Packet) error {
+
+	pktChan, done, ok := p.channels(index, conn)
+
+	if !ok {
+		return ErrConnGone
+	}
+
+	timer := time.NewTimer(SendQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case pktChan <- pkt:
+		return nil
+	case <-done:
+		return ErrConnGone
+	case <-timer.C:
+		conn.Close()
+		return ErrConnStalled
+	}
+}
+
+// Queue and done channel of the slot index while it holds conn
+func (p *AgentConnectionPool) channels(index uint8, conn Conn) (chan *Packet, chan struct{}, bool) {
+
+	key := strconv.FormatUint(uint64(index), 10)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if val, ok := p.Connections.Get(key); !ok || val != conn {
+		return nil, nil, false
+	}
+
+	pktChan, _ := p.SendingChannels.Get(key)
+	done, _ := p.done.Get(key)
+
+	return pktChan.(chan *Packet), done.(chan struct{}), true
+}
+
+// Done channel of the slot index, closed once the slot is freed
+func (p *AgentConnectionPool) Done(index uint8) chan struct{} {
+	val, _ := p.done.Get(strconv.FormatUint(uint64(index), 10))
+	return val.(chan struct{})
 }
 
 type FsConnectionPool struct {
-	Connections      []*websocket.Conn
+	Connections      []Conn
 	ReceivedChannels []chan *PacketChannelTuple
 	SendingChannels  []chan *PacketChannelTuple
+	States           []*ConnState
+
+	// What the agent and this side have in common, set by the handshake
+	Peer *Hello
+
+	// Smoothed round trip time in nanoseconds
+	latency int64
+
+	// Rotates where ties between connections are broken
+	next uint32
+
+	// Bytes of file data each connection may have in flight
+	window int64
+
+	// Bytes compression kept off the wire in both directions
+	bytesSaved int64
 }
 
-func newFsConnectionPool() *FsConnectionPool {
-	return &FsConnectionPool{}
+func newFsConnectionPool(window int64) *FsConnectionPool {
+	return &FsConnectionPool{
+		window: window,
+	}
 }
 
-func (p *FsConnectionPool) Append(conn *websocket.Conn) {
+func (p *FsConnectionPool) Append(conn Conn) {
 	p.Connections = append(p.Connections, conn)
 	p.ReceivedChannels = append(p.ReceivedChannels, make(chan *PacketChannelTuple, ChannelLength))
 	p.SendingChannels = append(p.SendingChannels, make(chan *PacketChannelTuple, ChannelLength))
+	p.States = append(p.States, newConnState(p.window))
+}
+
+// Codec the agent agreed on, msgpack before the handshake
+func (p *FsConnectionPool) Codec() Codec {
+	if p.Peer == nil {
+		return MsgpackCodec
+	}
+
+	return p.Peer.Codec()
+}
+
+// Compressor for file data sent to the agent, nil when there is none
+func (p *FsConnectionPool) Compressor() Compressor {
+	if p.Peer == nil {
+		return nil
+	}
+
+	return p.Peer.Compressor()
+}
+
+func (p *FsConnectionPool) BytesSaved() int64 {
+	return atomic.LoadInt64(&p.bytesSaved)
 }
 
 func (p *FsConnectionPool) Len() int {
 	return len(p.Connections)
 }
 
+// Connection for a request, the one with the fewest requests outstanding
+// in the lane of opCode. With more than one connection the first is kept
+// for metadata so that it never waits behind file data. -1 if all are down.
+func (p *FsConnectionPool) pick(opCode uint8) int {
+
+	first, last := 0, p.Len()
+
+	if p.Len() > 1 && isDataOp(opCode) {
+		first = 1
+	} else if p.Len() > 1 {
+		last = 1
+	}
+
+	if index := p.leastOutstanding(first, last); index >= 0 {
+		return index
+	}
+
+	// The lane is down, borrow whatever is still up
+	return p.leastOutstanding(0, p.Len())
+}
+
+func (p *FsConnectionPool) leastOutstanding(first int, last int) int {
+
+	best := -1
+	count := last - first
+
+	if count <= 0 {
+		return best
+	}
+
+	start := int(atomic.AddUint32(&p.next, 1))
+
+	for i := 0; i < count; i++ {
+
+		index := first + (start+i)%count
+		state := p.States[index]
+
+		if state.IsUp() && (best < 0 || state.InFlight() < p.States[best].InFlight()) {
+			best = index
+		}
+	}
+
+	return best
+}
+
+func (p *FsConnectionPool) IsUp() bool {
+	return p.leastOutstanding(0, p.Len()) >= 0
+}
+
+// Ops that carry file contents, the rest are small and use the metadata lane
+func isDataOp(opCode uint8) bool {
+	switch opCode {
+	case FetchFileRequest, ReadFileRequest, WriteFileRequest:
+		return true
+	}
+
+	return false
+}
+
+// Folds a round trip sample into the smoothed latency
+func (p *FsConnectionPool) observe(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&p.latency)
+		updated := int64(rtt)
+
+		if old != 0 {
+			updated = old + (int64(rtt)-old)/8
+		}
+
+		if atomic.CompareAndSwapInt64(&p.latency, old, updated) {
+			return
+		}
+	}
+}
+
+func (p *FsConnectionPool) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.latency))
+}
+
+// Health of a single connection in a pool
+type ConnState struct {
+	inFlight int64
+	lastSeen int64
+	failed   int32
+
+	// Credits for file data, nil when unlimited
+	window *byteLimiter
+
+	// Requests written on the connection that wait for a response
+	pending *InFlightTable
+}
+
+func newConnState(window int64) *ConnState {
+	state := &ConnState{
+		lastSeen: time.Now().UnixNano(),
+		pending:  NewInFlightTable(0),
+	}
+
+	if window > 0 {
+		state.window = newByteLimiter(window)
+	}
+
+	return state
+}
+
+// Records that the agent answered on this connection
+func (s *ConnState) seen() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+func (s *ConnState) fail() {
+	atomic.StoreInt32(&s.failed, 1)
+}
+
+// A connection is up until it fails or misses two pings in a row
+func (s *ConnState) IsUp() bool {
+	lastSeen := time.Unix(0, atomic.LoadInt64(&s.lastSeen))
+	return atomic.LoadInt32(&s.failed) == 0 && time.Since(lastSeen) < 2*PingInterval
+}
+
+func (s *ConnState) IsFailed() bool {
+	return atomic.LoadInt32(&s.failed) == 1
+}
+
+func (s *ConnState) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+// Bytes of file data waiting on this connection
+func (s *ConnState) BytesInFlight() int64 {
+	return s.window.Used()
+}
+
 type PacketChannelTuple struct {
 	Packet  *Packet
 	Channel chan *Packet
+	Sent    time.Time
 }
 
 type RemotePath struct {
-	Hostname string
-	Port     uint16
-	Path     string
+	Hostname string `cbor:"1,keyasint,omitempty"`
+	Port     uint16 `cbor:"2,keyasint,omitempty"`
+	Path     string `cbor:"3,keyasint,omitempty"`
 }
 
 func (rp *RemotePath) String() string {
@@ -94,6 +404,41 @@ func (rp *RemotePath) Convert(str string) {
 	rp.Path = parts[1]
 }
 
+// Parses a string of the form hostname:port@/path
+func ParseRemotePath(str string) (*RemotePath, error) {
+	at := strings.Index(str, "@")
+	colon := strings.LastIndex(str[:at+1], ":")
+
+	if at < 0 || colon < 0 {
+		return nil, errors.New("remote path must be of the form hostname:port@/path")
+	}
+
+	port, err := strconv.ParseUint(str[colon+1:at], 10, 16)
+
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port in remote path %s", str)
+	}
+
+	if colon == 0 || !path.IsAbs(str[at+1:]) {
+		return nil, fmt.Errorf("remote path %s needs a hostname and an absolute path", str)
+	}
+
+	return &RemotePath{
+		Hostname: str[:colon],
+		Port:     uint16(port),
+		Path:     path.Clean(str[at+1:]),
+	}, nil
+}
+
 func (rp *RemotePath) Address() string {
 	return fmt.Sprintf("%s:%d", rp.Hostname, rp.Port)
 }
+
+// Checks if other is rp itself or lies below it on the same host
+func (rp *RemotePath) Contains(other *RemotePath) bool {
+	if rp.Address() != other.Address() {
+		return false
+	}
+
+	return other.Path == rp.Path || strings.HasPrefix(other.Path, strings.TrimSuffix(rp.Path, "/")+"/")
+}
@@ -20,7 +20,9 @@ package ifs_test
 
 import (
 	"github.com/chemistry-sourabh/ifs"
+	"strconv"
 	"testing"
+	"time"
 )
 
 const remotePath = "localhost:1121@/tmp/"
@@ -48,3 +50,127 @@ func TestRemotePath_Address(t *testing.T) {
 
 	Compare(t, got, "localhost:1121")
 }
+
+func TestParseRemotePath(t *testing.T) {
+	rp, err := ifs.ParseRemotePath(remotePath)
+
+	Ok(t, err)
+	Compare(t, *rp, ifs.RemotePath{
+		Hostname: "localhost",
+		Port:     1121,
+		Path:     "/tmp",
+	})
+
+	_, err = ifs.ParseRemotePath("localhost@/tmp")
+	Err(t, err)
+
+	_, err = ifs.ParseRemotePath("localhost:1121@tmp")
+	Err(t, err)
+
+	_, err = ifs.ParseRemotePath("localhost:port@/tmp")
+	Err(t, err)
+}
+
+func TestRemotePath_Contains(t *testing.T) {
+	root := &ifs.RemotePath{Hostname: "localhost", Port: 1121, Path: "/tmp"}
+
+	Compare(t, root.Contains(&ifs.RemotePath{Hostname: "localhost", Port: 1121, Path: "/tmp"}), true)
+	Compare(t, root.Contains(&ifs.RemotePath{Hostname: "localhost", Port: 1121, Path: "/tmp/a/b"}), true)
+	Compare(t, root.Contains(&ifs.RemotePath{Hostname: "localhost", Port: 1121, Path: "/tmpfile"}), false)
+	Compare(t, root.Contains(&ifs.RemotePath{Hostname: "localhost", Port: 1122, Path: "/tmp/a"}), false)
+}
+
+func TestAgentConnectionPool_Add(t *testing.T) {
+
+	pool := ifs.NewAgentConnectionPool()
+
+	i, ok := pool.Add(nil)
+	Compare(t, ok, true)
+	Compare(t, i, uint8(0))
+
+	i, _ = pool.Add(nil)
+	Compare(t, i, uint8(1))
+
+	// A freed slot is reused instead of clashing with a live one
+	pool.Remove(0)
+
+	i, _ = pool.Add(nil)
+	Compare(t, i, uint8(0))
+
+	i, _ = pool.Add(nil)
+	Compare(t, i, uint8(2))
+}
+
+// Stands in for a connection, only its identity matters
+type slotConn struct {
+	ifs.Conn
+	name string
+}
+
+// A response for a connection that is gone is dropped, not handed to the
+// connection that took over its slot
+func TestAgentConnectionPool_Send(t *testing.T) {
+
+	pool := ifs.NewAgentConnectionPool()
+
+	old := &slotConn{name: "old"}
+	i, _ := pool.Add(old)
+
+	Ok(t, pool.Send(i, old, &ifs.Packet{Id: 1}))
+
+	pool.Remove(i)
+
+	Compare(t, pool.Send(i, old, &ifs.Packet{Id: 2}) == ifs.ErrConnGone, true)
+
+	current := &slotConn{name: "current"}
+	j, _ := pool.Add(current)
+	Compare(t, j, i)
+
+	Compare(t, pool.Send(j, old, &ifs.Packet{Id: 3}) == ifs.ErrConnGone, true)
+	Ok(t, pool.Send(j, current, &ifs.Packet{Id: 4}))
+
+	val, _ := pool.SendingChannels.Get(strconv.Itoa(int(j)))
+	pkt := <-val.(chan *ifs.Packet)
+	Compare(t, pkt.Id, uint64(4))
+}
+
+// A client that stopped reading only holds up its own responses, slots
+// still change hands and freeing its slot releases the waiting sender
+func TestAgentConnectionPool_SendFull(t *testing.T) {
+
+	pool := ifs.NewAgentConnectionPool()
+
+	stuck := &slotConn{name: "stuck"}
+	i, _ := pool.Add(stuck)
+
+	for n := 0; n < ifs.ChannelLength; n++ {
+		Ok(t, pool.Send(i, stuck, &ifs.Packet{Id: uint64(n)}))
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- pool.Send(i, stuck, &ifs.Packet{Id: ifs.ChannelLength})
+	}()
+
+	added := make(chan uint8, 1)
+	go func() {
+		j, _ := pool.Add(&slotConn{name: "other"})
+		added <- j
+	}()
+
+	select {
+	case j := <-added:
+		Compare(t, j, i+1)
+	case <-time.After(time.Second):
+		t.Fatal("add waited behind a full queue")
+	}
+
+	pool.Remove(i)
+
+	select {
+	case err := <-sent:
+		Compare(t, err == ifs.ErrConnGone, true)
+	case <-time.After(time.Second):
+		t.Fatal("send still waiting after its slot was freed")
+	}
+}
@@ -17,22 +17,40 @@ limitations under the License.
 package ifs
 
 import (
-	"github.com/gorilla/websocket"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"github.com/orcaman/concurrent-map"
 	"go.uber.org/zap"
-	"net/url"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type talker struct {
-	// Should be map of hostname and port
-	IdCounters    cmap.ConcurrentMap
-	Pools         cmap.ConcurrentMap
-	RequestBuffer cmap.ConcurrentMap
+	// Keyed by the address of each agent
+	Pools cmap.ConcurrentMap
+
+	// Replica groups keyed by the address their nodes use
+	Replicas cmap.ConcurrentMap
+
+	inFlight  int64
+	closing   int32
+	connCount int
+
+	// Bytes of file data in flight per connection and across all pools
+	connWindow int64
+	memory     *byteLimiter
+	connectMu  sync.Mutex
+	tlsConfig  *tls.Config
+
+	// Only codec and compressor offered to agents, empty offers all of them
+	codec       string
+	compression string
 }
 
 var (
@@ -43,9 +61,8 @@ var (
 func Talker() *talker {
 	talkerOnce.Do(func() {
 		talkerInstance = &talker{
-			IdCounters:    cmap.New(),
-			Pools:         cmap.New(),
-			RequestBuffer: cmap.New(),
+			Pools:    cmap.New(),
+			Replicas: cmap.New(),
 		}
 	})
 
@@ -53,27 +70,153 @@ func Talker() *talker {
 
 }
 
-func (t talker) getPool(hostname string) *FsConnectionPool {
-	val, _ := t.Pools.Get(hostname)
+func (t *talker) getPool(address string) *FsConnectionPool {
+	val, _ := t.Pools.Get(address)
 	return val.(*FsConnectionPool)
 }
 
-func (t *talker) getIdCounter(hostname string) *uint64 {
-	val, _ := t.IdCounters.Get(hostname)
-	return val.(*uint64)
-}
-
 func (t *talker) Startup(remoteRoots []*RemoteRoot, poolCount int) {
 
+	t.connCount = poolCount
+
 	for _, remoteRoot := range remoteRoots {
 
-		idCounter := uint64(0)
-		t.IdCounters.Set(remoteRoot.Hostname, &idCounter)
-		t.Pools.Set(remoteRoot.Hostname, newFsConnectionPool())
-		t.mountRemoteRoot(remoteRoot, poolCount)
+		err := t.Connect(remoteRoot)
+
+		if err != nil {
+			zap.L().Fatal("Connection Handshake Failed",
+				zap.Error(err),
+			)
+		}
+	}
+
+	go t.setupPing(time.Tick(PingInterval))
+}
+
+// Restricts new connections to the codec called name, an empty name lets
+// the handshake pick
+func (t *talker) SetCodec(name string) {
+	t.connectMu.Lock()
+	defer t.connectMu.Unlock()
+
+	t.codec = name
+}
+
+// Restricts new connections to the compressor called name, off sends file
+// data as it is and an empty name lets the handshake pick
+func (t *talker) SetCompression(name string) {
+	t.connectMu.Lock()
+	defer t.connectMu.Unlock()
+
+	t.compression = name
+}
+
+func (t *talker) localHello() *Hello {
+	hello := LocalHello()
+
+	if t.codec != "" {
+		hello.Codecs = []string{t.codec}
+	}
+
+	if t.compression == CompressionOff {
+		hello.Compressors = nil
+	} else if t.compression != "" {
+		hello.Compressors = []string{t.compression}
+	}
+
+	return hello
+}
+
+// Limits the file data in flight in megabytes, per connection and for the
+// whole mount. Call before Startup, later calls resize the existing limits.
+func (t *talker) SetFlowLimits(connWindow uint64, memoryLimit uint64) {
+
+	t.connectMu.Lock()
+	defer t.connectMu.Unlock()
+
+	t.connWindow = megabytes(connWindow)
+
+	if t.memory == nil {
+		t.memory = newByteLimiter(megabytes(memoryLimit))
+	} else {
+		t.memory.setLimit(megabytes(memoryLimit))
+	}
+
+	for tup := range t.Pools.IterBuffered() {
+		for _, state := range tup.Val.(*FsConnectionPool).States {
+			state.window.setLimit(t.connWindow)
+		}
+	}
+}
+
+// Connects to every replica, a replica that cannot be reached is skipped so
+// that the group is served by the others. Call after Startup, a replica a
+// remote root names keeps the connection made with that root's transport.
+func (t *talker) StartupReplicas(replicas []*ReplicaConfig) {
+
+	for _, replica := range replicas {
+
+		for _, remoteRoot := range replica.RemoteRoots() {
+
+			err := t.Connect(remoteRoot)
+
+			if err != nil {
+				zap.L().Warn("Replica Connection Failed",
+					zap.String("replica", replica.Name),
+					zap.String("address", remoteRoot.Address()),
+					zap.Error(err),
+				)
+			}
+		}
+
+		rs := newReplicaSet(replica)
+		t.Replicas.Set(rs.Address(), rs)
+	}
+}
+
+// Trusts the certificates in caFile for agents using TLS, the system roots
+// are used when it is empty. Connections opened later pick it up.
+func (t *talker) LoadCA(caFile string) error {
+
+	var tlsConfig *tls.Config
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+
+		tlsConfig = &tls.Config{
+			RootCAs: pool,
+		}
+	}
+
+	// Dialing reads it under the same lock
+	t.connectMu.Lock()
+	t.tlsConfig = tlsConfig
+	t.connectMu.Unlock()
+
+	return nil
+}
+
+// Opens a connection pool to the host of remoteRoot unless one exists
+func (t *talker) Connect(remoteRoot *RemoteRoot) error {
+
+	t.connectMu.Lock()
+	defer t.connectMu.Unlock()
+
+	if t.Pools.Has(remoteRoot.Address()) {
+		return nil
 	}
 
-	go t.setupPing(time.Tick(30 * time.Second))
+	return t.mountRemoteRoot(remoteRoot, t.connCount)
 }
 
 func (t *talker) setupPing(ch <-chan time.Time) {
@@ -81,21 +224,28 @@ func (t *talker) setupPing(ch <-chan time.Time) {
 
 		for tup := range t.Pools.IterBuffered() {
 
-			hostname := tup.Key
+			address := tup.Key
 			pool := tup.Val.(*FsConnectionPool)
 
+			if t.isClosing() {
+				return
+			}
+
 			for index, conn := range pool.Connections {
 
-				err := conn.WriteMessage(websocket.PingMessage, []byte("ping"))
+				// The payload comes back in the pong to time the round trip
+				payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+				err := conn.Ping(payload)
 
 				zap.L().Debug("Ping Sent",
-					zap.String("hostname", hostname),
+					zap.String("address", address),
 					zap.Int("index", index),
 				)
 
 				if err != nil {
+					pool.States[index].fail()
 					zap.L().Warn("Ping Failed",
-						zap.String("hostname", hostname),
+						zap.String("address", address),
 						zap.Int("index", index),
 						zap.Error(err),
 					)
@@ -105,89 +255,317 @@ func (t *talker) setupPing(ch <-chan time.Time) {
 	}
 }
 
-func (t *talker) mountRemoteRoot(remoteRoot *RemoteRoot, poolCount int) {
+// Called with connectMu held
+func (t *talker) mountRemoteRoot(remoteRoot *RemoteRoot, poolCount int) error {
+
+	transport, ok := GetTransport(remoteRoot.Transport)
+
+	if !ok {
+		return fmt.Errorf("unknown transport %s", remoteRoot.Transport)
+	}
+
+	var tlsConfig *tls.Config
+
+	if remoteRoot.TLS {
+		tlsConfig = t.tlsConfig
+	}
+
+	pool := newFsConnectionPool(t.connWindow)
 
-	u := url.URL{Scheme: "ws", Host: remoteRoot.Address(), Path: "/"}
-	websocket.DefaultDialer.EnableCompression = true
 	for i := 0; i < poolCount; i++ {
-		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		c, err := transport.Dial(remoteRoot.DialAddress(), tlsConfig)
+
+		if err == nil {
+			pool.Peer, err = sendHello(c, t.localHello())
+
+			if err != nil {
+				c.Close()
+			}
+		}
+
 		if err != nil {
-			zap.L().Fatal("Connection Handshake Failed",
-				zap.Error(err),
-			)
+			for _, conn := range pool.Connections {
+				conn.Close()
+			}
+
+			return err
 		}
 
-		t.getPool(remoteRoot.Hostname).Append(c)
+		pool.Append(c)
+	}
+
+	// Readers and writers are only started once the whole pool is up
+	t.Pools.Set(remoteRoot.Address(), pool)
+
+	for index, conn := range pool.Connections {
+		conn.SetPongHandler(pongHandler(pool, uint8(index)))
+
+		go t.processSendingChannel(remoteRoot.Address(), uint8(index))
+		go t.processIncomingMessages(remoteRoot.Address(), uint8(index))
+	}
 
-		index := uint8(t.getPool(remoteRoot.Hostname).Len() - 1)
+	return nil
+}
 
-		go t.processSendingChannel(remoteRoot.Hostname, index)
-		go t.processIncomingMessages(remoteRoot.Hostname, index)
+func pongHandler(pool *FsConnectionPool, index uint8) func([]byte) {
+	return func(payload []byte) {
+		pool.States[index].seen()
 
+		if sent, err := strconv.ParseInt(string(payload), 10, 64); err == nil {
+			pool.observe(time.Since(time.Unix(0, sent)))
+		}
 	}
+}
 
+func (t *talker) sendRequest(opCode uint8, address string, payload Payload) *Packet {
+	return t.sendSized(opCode, address, payload, requestBytes(opCode, payload))
 }
 
-func (t *talker) sendRequest(opCode uint8, hostname string, payload Payload) *Packet {
+// Sends a request holding cost bytes of the flow limits until it is
+// answered, for callers that know more about the response than its payload
+func (t *talker) sendSized(opCode uint8, address string, payload Payload, cost int64) *Packet {
+
+	if t.isClosing() {
+		return shutdownPacket()
+	}
+
+	if val, ok := t.Replicas.Get(address); ok {
+		return val.(*ReplicaSet).send(opCode, payload, cost)
+	}
+
+	val, ok := t.Pools.Get(address)
 
-	respChannel := make(chan *Packet)
+	if !ok {
+		return errorPacket(syscall.EHOSTDOWN)
+	}
+
+	pool := val.(*FsConnectionPool)
+
+	if pool.Peer != nil && !pool.Peer.Supports(opCode) {
+		return errorPacket(syscall.ENOSYS)
+	}
+
+	index := pool.pick(opCode)
+
+	if index < 0 {
+		return errorPacket(syscall.EHOSTDOWN)
+	}
+
+	atomic.AddInt64(&t.inFlight, 1)
+	defer atomic.AddInt64(&t.inFlight, -1)
+
+	respChannel := make(chan *Packet, 1)
 
 	req := &Packet{
 		Op:   opCode,
 		Data: payload,
 	}
 
-	t.getPool(hostname).SendingChannels[GetRandomIndex(t.getPool(hostname).Len())] <- &PacketChannelTuple{
-		req,
-		respChannel,
+	atomic.AddInt64(&pool.States[index].inFlight, 1)
+	defer atomic.AddInt64(&pool.States[index].inFlight, -1)
+
+	// File data waits for credits on its connection and under the ceiling
+	// of the mount, metadata goes straight through
+	taken := t.memory.acquire(cost)
+	defer t.memory.release(taken)
+
+	credits := pool.States[index].window.acquire(cost)
+	defer pool.States[index].window.release(credits)
+
+	pool.SendingChannels[index] <- &PacketChannelTuple{
+		Packet:  req,
+		Channel: respChannel,
 	}
 
 	return <-respChannel
 }
 
-func GetMapKey(hostname string, connId uint8, id uint64) string {
-	return strings.Join([]string{hostname, strconv.FormatInt(int64(connId), 10), strconv.FormatInt(int64(id), 10)}, "_")
+// Sends reqs to the agent at address in as few round trips as it allows and
+// returns the responses in the same order. Agents that do not take batches
+// and replica groups get the requests one by one, all at once.
+func (t *talker) sendBatch(address string, reqs []*Packet) []*Packet {
+
+	resps := make([]*Packet, len(reqs))
+
+	val, ok := t.Pools.Get(address)
+	batched := ok && val.(*FsConnectionPool).Peer != nil && val.(*FsConnectionPool).Peer.Supports(BatchRequest)
+
+	var wg sync.WaitGroup
+
+	for first := 0; first < len(reqs); {
+
+		last := first + 1
+
+		if batched {
+			last = first + BatchMaxOps
+
+			if last > len(reqs) {
+				last = len(reqs)
+			}
+		}
+
+		wg.Add(1)
+
+		go func(first int, last int) {
+			defer wg.Done()
+
+			if !batched {
+				resps[first] = t.sendRequest(reqs[first].Op, address, reqs[first].Data)
+				return
+			}
+
+			t.sendChunk(address, reqs[first:last], resps[first:last])
+		}(first, last)
+
+		first = last
+	}
+
+	wg.Wait()
+
+	return resps
 }
 
-func (t *talker) processSendingChannel(hostname string, index uint8) {
+// Sends reqs in a single batch and fills resps, every item gets the error
+// when the batch as a whole fails
+func (t *talker) sendChunk(address string, reqs []*Packet, resps []*Packet) {
+
+	for i, req := range reqs {
+		req.Id = uint64(i)
+	}
+
+	resp := t.sendRequest(BatchRequest, address, &Batch{Packets: reqs})
+	b, ok := resp.Data.(*Batch)
+
+	if resp.Err() == nil && (!ok || len(b.Packets) != len(reqs)) {
+		resp = errorPacket(syscall.EPROTO)
+	}
+
+	for i := range resps {
+		if resp.Err() != nil {
+			resps[i] = resp
+		} else {
+			resps[i] = b.Packets[i]
+		}
+	}
+}
+
+// Sends a request of opCode for every path, a batch to each host they are
+// on, and returns the responses in the order of paths
+func (t *talker) sendBatched(opCode uint8, remotePaths []*RemotePath) []*Packet {
+
+	resps := make([]*Packet, len(remotePaths))
+
+	// Positions in remotePaths of the requests going to each host
+	reqs := make(map[string][]*Packet)
+	positions := make(map[string][]int)
+
+	for i, remotePath := range remotePaths {
+		address := remotePath.Address()
+
+		reqs[address] = append(reqs[address], &Packet{
+			Op:   opCode,
+			Data: remotePath,
+		})
+		positions[address] = append(positions[address], i)
+	}
+
+	var wg sync.WaitGroup
+
+	for address := range reqs {
+		wg.Add(1)
+
+		go func(address string) {
+			defer wg.Done()
+
+			for i, resp := range t.sendBatch(address, reqs[address]) {
+				resps[positions[address][i]] = resp
+			}
+		}(address)
+	}
+
+	wg.Wait()
+
+	return resps
+}
+
+func (t *talker) processSendingChannel(address string, index uint8) {
 
 	zap.L().Info("Starting Egress Channel Processor",
-		zap.String("hostname", hostname),
+		zap.String("address", address),
 		zap.Uint8("index", index),
 	)
 
-	for req := range t.getPool(hostname).SendingChannels[index] {
+	for req := range t.getPool(address).SendingChannels[index] {
+
+		pkt := req.Packet
+		state := t.getPool(address).States[index]
+
+		req.Sent = time.Now()
+		id, err := state.pending.Add(req)
 
-		pkt, _ := req.Packet, req.Channel
+		if err != nil {
+			zap.L().Warn("Request Id Unavailable",
+				zap.String("address", address),
+				zap.Uint8("index", index),
+				zap.Error(err),
+			)
+
+			req.Channel <- errorPacket(syscall.EAGAIN)
+			close(req.Channel)
+			continue
+		}
 
 		pkt.ConnId = index
-		pkt.Id = atomic.AddUint64(t.getIdCounter(hostname), 1)
+		pkt.Id = id
 
 		zap.L().Debug("Sending Packet",
-			zap.String("hostname", hostname),
+			zap.String("address", address),
 			zap.Uint8("index", index),
 			zap.String("op", strings.ToLower(ConvertOpCodeToString(pkt.Op))),
 			zap.Uint8("conn_id", pkt.ConnId),
 			zap.Uint64("id", pkt.Id),
 		)
 
-		t.RequestBuffer.Set(GetMapKey(hostname, pkt.ConnId, pkt.Id), req)
+		pool := t.getPool(address)
+		atomic.AddInt64(&pool.bytesSaved, pkt.Compress(pool.Compressor()))
+
+		data, _ := pkt.Encode(pool.Codec())
+		err = t.getPool(address).Connections[index].WriteFrame(data)
+
+		// Nothing was written, only this request fails
+		if err == ErrFrameTooLarge {
+			if req, ok := state.pending.Pop(id); ok {
+				req.Channel <- errorPacket(syscall.EFBIG)
+				close(req.Channel)
+			}
+
+			continue
+		}
 
-		data, _ := pkt.Marshal()
-		err := t.getPool(hostname).Connections[index].WriteMessage(websocket.BinaryMessage, data)
 		if err != nil {
-			zap.L().Fatal("Write Message Failed",
-				zap.Error(err),
-			)
+			state.fail()
+
+			if !t.isClosing() {
+				zap.L().Warn("Write Message Failed",
+					zap.String("address", address),
+					zap.Uint8("index", index),
+					zap.Error(err),
+				)
+			}
 		}
 
+		// The reader fails pending requests when the connection drops, one
+		// written after that would never be answered
+		if state.IsFailed() {
+			t.failRequest(state, id)
+		}
 	}
 }
 
-func (t *talker) processIncomingMessages(hostname string, index uint8) {
+func (t *talker) processIncomingMessages(address string, index uint8) {
 
 	zap.L().Info("Starting Ingress Message Processor",
-		zap.String("hostname", hostname),
+		zap.String("address", address),
 		zap.Uint8("index", index),
 	)
 
@@ -196,23 +574,48 @@ func (t *talker) processIncomingMessages(hostname string, index uint8) {
 		packet := &Packet{}
 
 		zap.L().Debug("Listening For Packet",
-			zap.String("hostname", hostname),
+			zap.String("address", address),
 			zap.Uint8("index", index),
 		)
 
-		_, data, err := t.getPool(hostname).Connections[index].ReadMessage()
+		data, err := t.getPool(address).Connections[index].ReadFrame()
 
 		if err != nil {
-			zap.L().Fatal("Read Message Failed",
-				zap.Error(err),
-			)
+			t.getPool(address).States[index].fail()
+
+			if t.isClosing() {
+				zap.L().Info("Connection Closed",
+					zap.String("address", address),
+					zap.Uint8("index", index),
+				)
+			} else {
+				zap.L().Warn("Connection Lost",
+					zap.String("address", address),
+					zap.Uint8("index", index),
+					zap.Error(err),
+				)
+			}
+
+			t.failPending(address, index)
 			break
 		}
 
-		packet.Unmarshal(data)
+		err = packet.Decode(t.getPool(address).Codec(), data)
+		t.getPool(address).States[index].seen()
+
+		if err == nil {
+			var saved int64
+			saved, err = packet.Decompress()
+			atomic.AddInt64(&t.getPool(address).bytesSaved, saved)
+		}
+
+		if err != nil {
+			t.rejectPacket(address, index, packet, err)
+			continue
+		}
 
 		zap.L().Debug("Received Packet",
-			zap.String("hostname", hostname),
+			zap.String("address", address),
 			zap.Uint8("index", index),
 			zap.String("op", strings.ToLower(ConvertOpCodeToString(packet.Op))),
 			zap.Uint8("conn_id", packet.ConnId),
@@ -222,23 +625,195 @@ func (t *talker) processIncomingMessages(hostname string, index uint8) {
 
 		if !packet.IsRequest() {
 
-			var ch chan *Packet
-
-			req, _ := t.RequestBuffer.Get(GetMapKey(hostname, packet.ConnId, packet.Id))
+			// Missing when the request was already failed
+			req, ok := t.getPool(address).States[index].pending.Pop(packet.Id)
 
-			ch = req.(*PacketChannelTuple).Channel
+			if !ok {
+				zap.L().Debug("Response Without Request",
+					zap.String("address", address),
+					zap.Uint8("index", index),
+					zap.Uint64("id", packet.Id),
+				)
+				continue
+			}
 
-			ch <- packet
-			close(ch)
+			t.getPool(address).observe(time.Since(req.Sent))
 
-			t.RequestBuffer.Remove(GetMapKey(hostname, packet.ConnId, packet.Id))
+			req.Channel <- packet
+			close(req.Channel)
 
 		} else {
-			go t.processRequest(hostname, packet)
+			go t.processRequest(address, packet)
 		}
 	}
 }
 
-func (t *talker) processRequest(hostname string, packet *Packet) {
+func (t *talker) isClosing() bool {
+	return atomic.LoadInt32(&t.closing) == 1
+}
+
+// Drops a packet that could not be decoded, a request waiting on it is
+// failed with EPROTO instead of hanging
+func (t *talker) rejectPacket(address string, index uint8, packet *Packet, err error) {
+
+	zap.L().Warn("Dropping Packet",
+		zap.String("address", address),
+		zap.Uint8("index", index),
+		zap.Uint64("id", packet.Id),
+		zap.Uint8("op", packet.Op),
+		zap.Error(err),
+	)
+
+	if err == ErrShortPacket || packet.IsRequest() {
+		return
+	}
+
+	req, ok := t.getPool(address).States[index].pending.Pop(packet.Id)
+
+	if !ok {
+		return
+	}
+
+	req.Channel <- errorPacket(syscall.EPROTO)
+	close(req.Channel)
+}
+
+// Answers a request that will not get a response from the agent
+func (t *talker) failRequest(state *ConnState, id uint64) {
+
+	req, ok := state.pending.Pop(id)
+
+	if ok {
+		t.answerFailed(req)
+	}
+}
+
+// Fails the requests waiting on a connection that went away
+func (t *talker) failPending(address string, index uint8) {
+
+	for _, req := range t.getPool(address).States[index].pending.Drain() {
+		t.answerFailed(req)
+	}
+}
+
+func (t *talker) answerFailed(req *PacketChannelTuple) {
+
+	resp := errorPacket(syscall.EHOSTDOWN)
+
+	if t.isClosing() {
+		resp = shutdownPacket()
+	}
+
+	req.Channel <- resp
+	close(req.Channel)
+}
+
+func errorPacket(err error) *Packet {
+	return &Packet{
+		Op:    ErrorResponse,
+		Flags: 1,
+		Data: &Error{
+			Err: err,
+		},
+	}
+}
+
+func shutdownPacket() *Packet {
+	return errorPacket(syscall.ESHUTDOWN)
+}
+
+// Waits for requests that were already sent to be answered, returns false if
+// some were still pending after timeout
+func (t *talker) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for atomic.LoadInt64(&t.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// Closes every connection with a close frame so agents can clean up
+func (t *talker) Shutdown() {
+
+	atomic.StoreInt32(&t.closing, 1)
+
+	for tup := range t.Pools.IterBuffered() {
+
+		address := tup.Key
+		pool := tup.Val.(*FsConnectionPool)
+
+		for index, conn := range pool.Connections {
+
+			err := conn.Close()
+
+			if err != nil {
+				zap.L().Warn("Close Failed",
+					zap.String("address", address),
+					zap.Int("index", index),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// Health of the connections to address, false if it was never connected
+func (t *talker) HostStatus(address string) (*HostStatus, bool) {
+
+	if val, ok := t.Replicas.Get(address); ok {
+		return val.(*ReplicaSet).status(), true
+	}
+
+	val, ok := t.Pools.Get(address)
+
+	if !ok {
+		return nil, false
+	}
+
+	pool := val.(*FsConnectionPool)
+	status := &HostStatus{
+		Latency: pool.Latency(),
+	}
+
+	if pool.Peer != nil {
+		status.Version = pool.Peer.Version
+		status.Features = pool.Peer.Features
+		status.Codec = pool.Codec().Name()
+	}
+
+	if compressor := pool.Compressor(); compressor != nil {
+		status.Compression = compressor.Name()
+	}
+
+	status.BytesSaved = pool.BytesSaved()
+
+	for index, state := range pool.States {
+		conn := &ConnStatus{
+			Index:    index,
+			Up:       state.IsUp(),
+			InFlight: state.InFlight(),
+
+			BytesInFlight: state.BytesInFlight(),
+			IdCollisions:  state.pending.Collisions(),
+		}
+
+		if conn.Up {
+			status.Up = true
+		}
+
+		status.InFlight += conn.InFlight
+		status.Connections = append(status.Connections, conn)
+	}
+
+	return status, true
+}
+
+func (t *talker) processRequest(address string, packet *Packet) {
 	// Just in case Agent needs to send messages back
 }
@@ -20,14 +20,72 @@ package ifs_test
 
 import (
 	"github.com/chemistry-sourabh/ifs"
+	"path"
+	"syscall"
 	"testing"
+	"time"
 )
 
-func TestGetMapKey(t *testing.T) {
+func TestTalker_ReplicasDown(t *testing.T) {
 
-	str := ifs.GetMapKey("host1", 0, 10)
+	// Nothing listens on port 1 so every replica is down
+	ifs.Talker().StartupReplicas([]*ifs.ReplicaConfig{
+		{Name: "mirror", Path: "/tmp", Replicas: []string{"localhost:1", "127.0.0.1:1"}},
+	})
 
-	if str != "host1_0_10" {
-		PrintTestError(t, "strings not matching", str, "0_10")
+	remotePath := &ifs.ReplicaConfig{Name: "mirror", Path: "/tmp"}
+
+	err := ifs.FileHandler().Mkdir(remotePath.RemotePath(), "dir")
+	Compare(t, err, syscall.EROFS)
+
+	_, err = ifs.FileHandler().Statfs(remotePath.RemotePath())
+	Compare(t, err, syscall.EHOSTDOWN)
+
+	status, ok := ifs.Talker().HostStatus(remotePath.RemotePath().Address())
+	Compare(t, ok, true)
+	Compare(t, status.Up, false)
+}
+
+// Draining waits for requests already sent and gives up after the timeout
+func TestTalker_Drain(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "drain")
+	defer cleanup()
+
+	ifs.Talker().SetFlowLimits(64, 1)
+	defer ifs.Talker().SetFlowLimits(0, 0)
+
+	// Keeps a fetch waiting for room under the ceiling of the mount
+	held := ifs.Talker().Memory().Acquire(1024 * 1024)
+
+	file := &ifs.RemotePath{Hostname: remotePaths[0].Hostname, Path: path.Join(remotePaths[0].Path, "file")}
+	WriteDummyDataToPath(file.Path, 1)
+
+	fetched := make(chan *ifs.Packet, 1)
+	go func() {
+		fetched <- ifs.Talker().SendRequest(ifs.FetchFileRequest, file.Address(), file)
+	}()
+
+	// Long enough for the fetch to be counted as in flight
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	Compare(t, ifs.Talker().Drain(100*time.Millisecond), false)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		PrintTestError(t, "drain overran its timeout", elapsed, "about 100ms")
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		ifs.Talker().Memory().Release(held)
+	})
+
+	Compare(t, ifs.Talker().Drain(5*time.Second), true)
+
+	select {
+	case resp := <-fetched:
+		Ok(t, resp.Err())
+	default:
+		t.Fatal("drain returned before the fetch was answered")
 	}
 }
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// A connection that carries whole packets between the fs and an agent
+type Conn interface {
+	WriteFrame(data []byte) error
+
+	// Blocks until the next packet, pings are answered and pongs handed to
+	// the pong handler while waiting
+	ReadFrame() ([]byte, error)
+
+	// The peer echoes payload back in a pong
+	Ping(payload []byte) error
+	SetPongHandler(handler func(payload []byte))
+
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+
+	// Tells the peer the connection is going away before closing it
+	Close() error
+}
+
+type Listener interface {
+	Accept() (Conn, error)
+	Addr() net.Addr
+	Close() error
+}
+
+// How packets get to an agent, tlsConfig is nil for plain connections
+type Transport interface {
+	Name() string
+	Dial(address string, tlsConfig *tls.Config) (Conn, error)
+	Listen(address string, tlsConfig *tls.Config) (Listener, error)
+}
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// Returned by WriteFrame for data over MaxFrameSize, nothing was written and
+// the connection stays usable
+var ErrFrameTooLarge = errors.New("frame is over the size limit")
+
+var transports = []Transport{
+	websocketTransport{},
+	streamTransport{network: TransportTCP},
+	streamTransport{network: TransportUnix},
+}
+
+// The transport called name, websocket when name is empty
+func GetTransport(name string) (Transport, bool) {
+
+	if name == "" {
+		name = TransportWebsocket
+	}
+
+	for _, transport := range transports {
+		if transport.Name() == name {
+			return transport, true
+		}
+	}
+
+	return nil, false
+}
+
+func transportNames() []string {
+	names := make([]string, 0, len(transports))
+
+	for _, transport := range transports {
+		names = append(names, transport.Name())
+	}
+
+	return names
+}
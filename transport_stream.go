@@ -0,0 +1,244 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Kinds of frame on a stream, a frame is a big endian uint32 length
+// followed by the kind and its payload, the length counts both
+const (
+	frameData uint8 = iota
+	framePing
+	framePong
+	frameClose
+)
+
+const frameHeaderLength = 5
+
+// Length prefixed frames over TCP or a unix socket, a unix socket ignores
+// tlsConfig since it never leaves the host
+type streamTransport struct {
+	network string
+}
+
+func (t streamTransport) Name() string {
+	return t.network
+}
+
+func (t streamTransport) Dial(address string, tlsConfig *tls.Config) (Conn, error) {
+
+	var conn net.Conn
+	var err error
+
+	if tlsConfig != nil && t.network == TransportTCP {
+		conn, err = tls.Dial(t.network, address, tlsConfig)
+	} else {
+		conn, err = net.Dial(t.network, address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamConn(conn), nil
+}
+
+func (t streamTransport) Listen(address string, tlsConfig *tls.Config) (Listener, error) {
+
+	ln, err := net.Listen(t.network, address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil && t.network == TransportTCP {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	return &streamListener{ln: ln}, nil
+}
+
+type streamListener struct {
+	ln net.Listener
+}
+
+func (l *streamListener) Accept() (Conn, error) {
+	conn, err := l.ln.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamConn(conn), nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *streamListener) Close() error {
+	return l.ln.Close()
+}
+
+type streamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Pongs are written by the reader while packets are being written
+	writeMu sync.Mutex
+
+	pongMu sync.Mutex
+	pong   func(payload []byte)
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// A zero deadline lets the write take as long as it needs
+func (c *streamConn) writeFrame(kind uint8, payload []byte, deadline time.Time) error {
+
+	header := make([]byte, frameHeaderLength)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = kind
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if !deadline.IsZero() {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(c.conn)
+
+	return err
+}
+
+func (c *streamConn) WriteFrame(data []byte) error {
+
+	if len(data)+1 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	return c.writeFrame(frameData, data, time.Time{})
+}
+
+func (c *streamConn) ReadFrame() ([]byte, error) {
+
+	header := make([]byte, frameHeaderLength)
+
+	for {
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+
+		length := binary.BigEndian.Uint32(header)
+
+		// A length this large means the stream is out of step
+		if length == 0 || length > MaxFrameSize {
+			return nil, fmt.Errorf("frame length %d is out of range", length)
+		}
+
+		// The buffer grows with the bytes that actually arrive, a length
+		// alone from a peer that sent no hello yet must not cost memory
+		var buf bytes.Buffer
+
+		if _, err := io.CopyN(&buf, c.reader, int64(length-1)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return nil, err
+		}
+
+		payload := buf.Bytes()
+
+		switch header[4] {
+		case frameData:
+			return payload, nil
+		case framePing:
+			if err := c.writeFrame(framePong, payload, time.Now().Add(PingWriteTimeout)); err != nil {
+				return nil, err
+			}
+		case framePong:
+			c.pongMu.Lock()
+			handler := c.pong
+			c.pongMu.Unlock()
+
+			if handler != nil {
+				handler(payload)
+			}
+		case frameClose:
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("unknown frame kind %d", header[4])
+		}
+	}
+}
+
+func (c *streamConn) Ping(payload []byte) error {
+	return c.writeFrame(framePing, payload, time.Now().Add(PingWriteTimeout))
+}
+
+func (c *streamConn) SetPongHandler(handler func(payload []byte)) {
+	c.pongMu.Lock()
+	defer c.pongMu.Unlock()
+
+	c.pong = handler
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *streamConn) Close() error {
+
+	// A writer stuck on a large frame holds the lock, when the close frame
+	// cannot go out in time the connection is closed under it
+	sent := make(chan struct{})
+
+	go func() {
+		c.writeFrame(frameClose, nil, time.Now().Add(CloseWriteTimeout))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(CloseWriteTimeout):
+	}
+
+	return c.conn.Close()
+}
@@ -0,0 +1,344 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"encoding/binary"
+	"github.com/chemistry-sourabh/ifs"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGetTransport(t *testing.T) {
+
+	transport, ok := ifs.GetTransport("")
+	Compare(t, ok, true)
+	Compare(t, transport.Name(), ifs.TransportWebsocket)
+
+	_, ok = ifs.GetTransport("quic")
+	Compare(t, ok, false)
+}
+
+func TestTransport_Frames(t *testing.T) {
+
+	socket := path.Join(os.TempDir(), "ifs_transport_"+strconv.Itoa(os.Getpid())+".sock")
+	defer os.Remove(socket)
+
+	addresses := map[string]string{
+		ifs.TransportWebsocket: "127.0.0.1:0",
+		ifs.TransportTCP:       "127.0.0.1:0",
+		ifs.TransportUnix:      socket,
+	}
+
+	for name, address := range addresses {
+
+		transport, _ := ifs.GetTransport(name)
+
+		listener, err := transport.Listen(address, nil)
+		Ok(t, err)
+
+		// Echoes a single frame then waits for the client to go away
+		done := make(chan error, 1)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			if err == nil {
+				var data []byte
+				data, err = conn.ReadFrame()
+
+				if err == nil {
+					err = conn.WriteFrame(data)
+				}
+
+				if err == nil {
+					_, err = conn.ReadFrame()
+				}
+
+				conn.Close()
+			}
+
+			done <- err
+		}()
+
+		conn, err := transport.Dial(listener.Addr().String(), nil)
+		Ok(t, err)
+
+		pongs := make(chan string, 1)
+		conn.SetPongHandler(func(payload []byte) {
+			pongs <- string(payload)
+		})
+
+		Ok(t, conn.Ping([]byte("ping")))
+		Ok(t, conn.WriteFrame([]byte("hello")))
+
+		data, err := conn.ReadFrame()
+		Ok(t, err)
+		Compare(t, string(data), "hello")
+
+		select {
+		case payload := <-pongs:
+			Compare(t, payload, "ping")
+		case <-time.After(time.Second):
+			t.Errorf("%s: no pong", name)
+		}
+
+		conn.Close()
+
+		// The server sees the close as the end of the connection
+		if err := <-done; err == nil {
+			t.Errorf("%s: read after close succeeded", name)
+		}
+
+		listener.Close()
+	}
+}
+
+func TestTransport_FrameTooLarge(t *testing.T) {
+
+	transport, _ := ifs.GetTransport(ifs.TransportTCP)
+
+	listener, err := transport.Listen("127.0.0.1:0", nil)
+	Ok(t, err)
+	defer listener.Close()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	Ok(t, err)
+	defer raw.Close()
+
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, 0xffffffff)
+	raw.Write(header)
+
+	conn, err := listener.Accept()
+	Ok(t, err)
+
+	_, err = conn.ReadFrame()
+	Err(t, err)
+
+	if err == io.EOF {
+		PrintTestError(t, "length was not checked", err, "out of range")
+	}
+}
+
+// A header claiming a huge frame costs no more than the bytes that follow it
+func TestTransport_FrameLengthNotTrusted(t *testing.T) {
+
+	transport, _ := ifs.GetTransport(ifs.TransportTCP)
+
+	listener, err := transport.Listen("127.0.0.1:0", nil)
+	Ok(t, err)
+	defer listener.Close()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	Ok(t, err)
+
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, ifs.MaxFrameSize)
+	raw.Write(header)
+	raw.Write([]byte("short"))
+	raw.Close()
+
+	conn, err := listener.Accept()
+	Ok(t, err)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err = conn.ReadFrame()
+	Compare(t, err == io.ErrUnexpectedEOF, true)
+
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		PrintTestError(t, "frame length was allocated up front", allocated, "under a megabyte")
+	}
+}
+
+// A connection whose frames are limited to limit bytes, requests are read
+// from in and written frames go to out
+type limitedConn struct {
+	limit int
+	in    chan []byte
+	out   chan []byte
+}
+
+func (c *limitedConn) WriteFrame(data []byte) error {
+	if len(data) > c.limit {
+		return ifs.ErrFrameTooLarge
+	}
+
+	c.out <- data
+	return nil
+}
+
+func (c *limitedConn) ReadFrame() ([]byte, error) {
+	data, ok := <-c.in
+
+	if !ok {
+		return nil, io.EOF
+	}
+
+	return data, nil
+}
+
+func (c *limitedConn) Ping(payload []byte) error                   { return nil }
+func (c *limitedConn) SetPongHandler(handler func(payload []byte)) {}
+func (c *limitedConn) SetReadDeadline(t time.Time) error           { return nil }
+func (c *limitedConn) RemoteAddr() net.Addr                        { return &net.UnixAddr{Name: "limited"} }
+func (c *limitedConn) Close() error                                { return nil }
+
+// An answer too big for a frame comes back as EFBIG instead of never
+func TestAgentTalker_ResponseTooLarge(t *testing.T) {
+
+	name := path.Join(os.TempDir(), "ifs_large_"+strconv.Itoa(os.Getpid()))
+	WriteDummyDataToPath(name, 4096)
+	defer os.Remove(name)
+
+	conn := &limitedConn{limit: 1024, in: make(chan []byte, 1), out: make(chan []byte, 1)}
+	defer close(conn.in)
+
+	ifs.AgentTalker().HandleConn(conn)
+
+	req := &ifs.Packet{Id: 9, Op: ifs.FetchFileRequest, Data: &ifs.RemotePath{Path: name}}
+	data, _ := req.Encode(ifs.MsgpackCodec)
+	conn.in <- data
+
+	select {
+	case data = <-conn.out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer to a response that did not fit")
+	}
+
+	resp := &ifs.Packet{}
+	Ok(t, resp.Decode(ifs.MsgpackCodec, data))
+	Compare(t, resp.Id, uint64(9))
+	Compare(t, resp.Err().Error(), syscall.EFBIG.Error())
+}
+
+// Closing does not wait on a writer stuck behind a peer that stopped reading
+func TestTransport_CloseStuckWriter(t *testing.T) {
+
+	transport, _ := ifs.GetTransport(ifs.TransportTCP)
+
+	listener, err := transport.Listen("127.0.0.1:0", nil)
+	Ok(t, err)
+	defer listener.Close()
+
+	conn, err := transport.Dial(listener.Addr().String(), nil)
+	Ok(t, err)
+
+	peer, err := listener.Accept()
+	Ok(t, err)
+	defer peer.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.WriteFrame(make([]byte, 64*1024*1024))
+	}()
+
+	// Long enough for the socket buffers to fill
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- conn.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close hung behind a stuck writer")
+	}
+
+	select {
+	case err := <-written:
+		Err(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck write did not fail once the connection closed")
+	}
+}
+
+// A mount and an agent talking over a unix socket without HTTP
+func TestTransport_UnixAgent(t *testing.T) {
+
+	socket := path.Join(os.TempDir(), "ifs_agent_"+strconv.Itoa(os.Getpid())+".sock")
+	defer os.Remove(socket)
+
+	transport, _ := ifs.GetTransport(ifs.TransportUnix)
+
+	listener, err := transport.Listen(socket, nil)
+	Ok(t, err)
+	defer listener.Close()
+
+	go ifs.AgentTalker().Serve(listener)
+
+	remoteRoot := &ifs.RemoteRoot{
+		Hostname:  "local",
+		Transport: ifs.TransportUnix,
+		Socket:    socket,
+	}
+
+	ifs.Talker().Startup([]*ifs.RemoteRoot{remoteRoot}, 1)
+
+	stat, err := ifs.FileHandler().Statfs(&ifs.RemotePath{
+		Hostname: "local",
+		Path:     os.TempDir(),
+	})
+	Ok(t, err)
+
+	if stat.Total == 0 {
+		PrintTestError(t, "statfs returned nothing", stat, "sizes")
+	}
+}
+
+// Only a socket is cleared out of the way of a unix listener
+func TestRemoveStaleSocket(t *testing.T) {
+
+	socket := path.Join(os.TempDir(), "ifs_stale_"+strconv.Itoa(os.Getpid())+".sock")
+	defer os.Remove(socket)
+
+	Ok(t, ifs.RemoveStaleSocket(socket))
+
+	// Bound and never cleaned up, the way a crashed agent leaves it
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	Ok(t, err)
+	Ok(t, syscall.Bind(fd, &syscall.SockaddrUnix{Name: socket}))
+	syscall.Close(fd)
+
+	Ok(t, ifs.RemoveStaleSocket(socket))
+
+	_, err = os.Lstat(socket)
+	Compare(t, os.IsNotExist(err), true)
+
+	// A file put there by a mistyped config survives
+	Ok(t, ioutil.WriteFile(socket, []byte("config"), 0644))
+	Err(t, ifs.RemoveStaleSocket(socket))
+
+	_, err = os.Lstat(socket)
+	Ok(t, err)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Packets as binary messages of a websocket served over HTTP
+type websocketTransport struct{}
+
+func (websocketTransport) Name() string {
+	return TransportWebsocket
+}
+
+func (websocketTransport) Dial(address string, tlsConfig *tls.Config) (Conn, error) {
+
+	u := url.URL{Scheme: "ws", Host: address, Path: "/"}
+	dialer := *websocket.DefaultDialer
+
+	if tlsConfig != nil {
+		u.Scheme = "wss"
+		dialer.TLSClientConfig = tlsConfig
+	}
+
+	conn, _, err := dialer.Dial(u.String(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn}, nil
+}
+
+func (websocketTransport) Listen(address string, tlsConfig *tls.Config) (Listener, error) {
+
+	ln, err := net.Listen("tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	l := &websocketListener{
+		ln:    ln,
+		conns: make(chan Conn),
+		done:  make(chan struct{}),
+	}
+
+	l.server = &http.Server{
+		Handler: http.HandlerFunc(l.upgrade),
+	}
+
+	go l.server.Serve(ln)
+
+	return l, nil
+}
+
+type websocketListener struct {
+	ln     net.Listener
+	server *http.Server
+	conns  chan Conn
+	done   chan struct{}
+}
+
+func (l *websocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		zap.L().Warn("Websocket Upgrade Failed",
+			zap.String("address", r.RemoteAddr),
+			zap.Error(err),
+		)
+		return
+	}
+
+	select {
+	case l.conns <- &websocketConn{conn: conn}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *websocketListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *websocketListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *websocketListener) Close() error {
+	close(l.done)
+	return l.server.Close()
+}
+
+type websocketConn struct {
+	conn *websocket.Conn
+}
+
+func (c *websocketConn) WriteFrame(data []byte) error {
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *websocketConn) ReadFrame() ([]byte, error) {
+	for {
+		typ, data, err := c.conn.ReadMessage()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+// WriteControl is safe to call while a packet is being written
+func (c *websocketConn) Ping(payload []byte) error {
+	return c.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(PingWriteTimeout))
+}
+
+func (c *websocketConn) SetPongHandler(handler func(payload []byte)) {
+	c.conn.SetPongHandler(func(appData string) error {
+		handler([]byte(appData))
+		return nil
+	})
+}
+
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *websocketConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(CloseWriteTimeout))
+
+	return c.conn.Close()
+}
@@ -0,0 +1,477 @@
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/orcaman/concurrent-map"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A directory merging the listings of remote directories on several hosts,
+// Members are in precedence order and the first one holding a name owns it
+type UnionNode struct {
+	// Round robin counter, first to keep it aligned for atomic access
+	next uint64
+
+	Inode   uint64
+	Members []*RemoteNode
+	Policy  string
+
+	// Directories found in more than one member, kept so that lookups
+	// return the same node
+	Unions cmap.ConcurrentMap
+}
+
+func (un *UnionNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+
+	zap.L().Debug("Attr FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "attr"),
+	)
+
+	curUser, _ := user.Current()
+	uid, _ := strconv.ParseUint(curUser.Uid, 10, 64)
+
+	// Not every system has a staff group
+	gidStr := curUser.Gid
+	if curGroup, err := user.LookupGroup("staff"); err == nil {
+		gidStr = curGroup.Gid
+	}
+
+	gid, _ := strconv.ParseUint(gidStr, 10, 64)
+
+	attr.Inode = un.Inode
+	attr.Uid = uint32(uid)
+	attr.Gid = uint32(gid)
+	attr.Mode = os.FileMode(os.ModeDir | 0755)
+	attr.Valid = time.Duration(-1)
+
+	zap.L().Debug("Attr Response",
+		zap.Bool("un", true),
+		zap.String("op", "attr"),
+	)
+
+	return nil
+}
+
+func (un *UnionNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+
+	zap.L().Debug("ReadDir FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "readdir"),
+		zap.Int("members", len(un.Members)),
+	)
+
+	var children []fuse.Dirent
+	seen := make(map[string]bool)
+
+	// A member that cannot be reached keeps its last listing
+	updateChildren(un.Members)
+
+	for _, member := range un.Members {
+
+		names := member.RemoteNodes.Keys()
+		sort.Strings(names)
+
+		for _, name := range names {
+
+			if seen[name] {
+				continue
+			}
+
+			val, ok := member.RemoteNodes.Get(name)
+
+			if !ok {
+				continue
+			}
+
+			seen[name] = true
+			rn := val.(*RemoteNode)
+
+			child := fuse.Dirent{Inode: rn.Inode, Type: fuse.DT_File, Name: name}
+			if rn.IsDir {
+				child.Type = fuse.DT_Dir
+			}
+
+			children = append(children, child)
+		}
+	}
+
+	zap.L().Debug("ReadDir Response",
+		zap.Bool("un", true),
+		zap.String("op", "readdir"),
+		zap.Int("size", len(children)),
+	)
+
+	return children, nil
+}
+
+// Children named name in every member, in precedence order. Members that
+// have not seen name are asked for it together, one batch per host.
+func (un *UnionNode) lookupMembers(name string) []*RemoteNode {
+
+	found := make([]*RemoteNode, len(un.Members))
+
+	var missing []int
+	var remotePaths []*RemotePath
+
+	for i, member := range un.Members {
+
+		if val, ok := member.RemoteNodes.Get(name); ok {
+			found[i] = val.(*RemoteNode)
+			continue
+		}
+
+		missing = append(missing, i)
+		remotePaths = append(remotePaths, member.childPath(name))
+	}
+
+	if len(missing) > 0 {
+		for j, resp := range Talker().sendBatched(AttrRequest, remotePaths) {
+			found[missing[j]], _ = un.Members[missing[j]].addChild(name, resp)
+		}
+	}
+
+	var matches []*RemoteNode
+
+	for _, rn := range found {
+		if rn != nil {
+			matches = append(matches, rn)
+		}
+	}
+
+	return matches
+}
+
+// The first match owns name, unless it is a directory that other members
+// also hold in which case their directories are merged
+func (un *UnionNode) resolve(name string, matches []*RemoteNode) fs.Node {
+
+	first := matches[0]
+	dirs := mergedDirs(matches)
+
+	if len(dirs) < 2 {
+		un.Unions.Remove(name)
+		return first
+	}
+
+	if val, ok := un.Unions.Get(name); ok && sameMembers(val.(*UnionNode).Members, dirs) {
+		return val.(*UnionNode)
+	}
+
+	child := &UnionNode{
+		Inode:   first.Inode,
+		Members: dirs,
+		Policy:  un.Policy,
+		Unions:  cmap.New(),
+	}
+
+	un.Unions.Set(name, child)
+	return child
+}
+
+// Directories among matches when the owning match is one
+func mergedDirs(matches []*RemoteNode) []*RemoteNode {
+
+	var dirs []*RemoteNode
+
+	if !matches[0].IsDir {
+		return nil
+	}
+
+	for _, match := range matches {
+		if match.IsDir {
+			dirs = append(dirs, match)
+		}
+	}
+
+	return dirs
+}
+
+func sameMembers(a []*RemoteNode, b []*RemoteNode) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (un *UnionNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+
+	zap.L().Debug("Lookup FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "lookup"),
+		zap.String("name", name),
+	)
+
+	matches := un.lookupMembers(name)
+
+	zap.L().Debug("Lookup Response",
+		zap.Bool("un", true),
+		zap.String("op", "lookup"),
+		zap.String("name", name),
+		zap.Int("matches", len(matches)),
+	)
+
+	if len(matches) == 0 {
+		return nil, fuse.ENOENT
+	}
+
+	return un.resolve(name, matches), nil
+}
+
+// Member that new files and directories go to
+func (un *UnionNode) target() *RemoteNode {
+
+	switch un.Policy {
+
+	case CreatePolicyRoundRobin:
+		i := atomic.AddUint64(&un.next, 1) - 1
+		return un.Members[i%uint64(len(un.Members))]
+
+	case CreatePolicyMostFree:
+		var best *RemoteNode
+		var avail uint64
+
+		for _, member := range un.Members {
+
+			st, err := FileHandler().Statfs(member.RemotePath)
+
+			if err != nil {
+				zap.L().Warn("Statfs Error Response",
+					zap.String("op", "statfs"),
+					zap.String("address", member.RemotePath.Address()),
+					zap.String("path", member.RemotePath.Path),
+					zap.Error(err),
+				)
+
+				continue
+			}
+
+			if best == nil || st.Avail > avail {
+				best = member
+				avail = st.Avail
+			}
+		}
+
+		if best != nil {
+			return best
+		}
+	}
+
+	return un.Members[0]
+}
+
+func (un *UnionNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+
+	rn := un.target()
+
+	zap.L().Debug("Create FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "create"),
+		zap.String("name", req.Name),
+		zap.String("policy", un.Policy),
+		zap.String("address", rn.RemotePath.Address()),
+	)
+
+	return rn.Create(ctx, req, resp)
+}
+
+func (un *UnionNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+
+	rn := un.target()
+
+	zap.L().Debug("Mkdir FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "mkdir"),
+		zap.String("name", req.Name),
+		zap.String("policy", un.Policy),
+		zap.String("address", rn.RemotePath.Address()),
+	)
+
+	return rn.Mkdir(ctx, req)
+}
+
+// Removes name from every member holding it, lower members would show
+// through otherwise
+func (un *UnionNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+
+	zap.L().Debug("Remove FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "remove"),
+		zap.String("name", req.Name),
+	)
+
+	matches := un.lookupMembers(req.Name)
+
+	if len(matches) == 0 {
+		return fuse.ENOENT
+	}
+
+	un.Unions.Remove(req.Name)
+
+	var err error
+	for _, member := range un.Members {
+		if _, ok := member.RemoteNodes.Get(req.Name); !ok {
+			continue
+		}
+
+		if memberErr := member.Remove(ctx, req); memberErr != nil && err == nil {
+			err = memberErr
+		}
+	}
+
+	return err
+}
+
+// Renames the owner of the old name, or every directory merged under it.
+// Lower entries a rename would uncover and merged directories that cannot
+// all move on their own hosts make it fail with EXDEV before anything is
+// renamed, tools like mv then copy and remove instead.
+func (un *UnionNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+
+	zap.L().Debug("Rename FS Request",
+		zap.Bool("un", true),
+		zap.String("op", "rename"),
+		zap.String("old_name", req.OldName),
+		zap.String("new_name", req.NewName),
+	)
+
+	matches := un.lookupMembers(req.OldName)
+
+	if len(matches) == 0 {
+		return fuse.ENOENT
+	}
+
+	// Members holding the old name, in precedence order like matches
+	var owners []*RemoteNode
+	for _, member := range un.Members {
+		if _, ok := member.RemoteNodes.Get(req.OldName); ok {
+			owners = append(owners, member)
+		}
+	}
+
+	if len(owners) > 1 && len(mergedDirs(matches)) != len(owners) {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	if len(owners) == 1 {
+		dest := renameTarget(newDir, owners[0].RemotePath.Address())
+
+		if dest == nil {
+			return fuse.Errno(syscall.EXDEV)
+		}
+
+		un.Unions.Remove(req.OldName)
+		return owners[0].Rename(ctx, req, dest)
+	}
+
+	targets, ok := mergedTargets(owners, newDir)
+
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	un.Unions.Remove(req.OldName)
+
+	for i, owner := range owners {
+
+		err := owner.Rename(ctx, req, targets[i])
+
+		if err == nil {
+			continue
+		}
+
+		// Put back the ones already moved so the union stays whole
+		back := &fuse.RenameRequest{OldName: req.NewName, NewName: req.OldName}
+
+		for j := i - 1; j >= 0; j-- {
+			if undoErr := targets[j].Rename(ctx, back, owners[j]); undoErr != nil {
+				zap.L().Warn("Rename Rollback Failed",
+					zap.String("op", "rename"),
+					zap.String("address", owners[j].RemotePath.Address()),
+					zap.String("path", owners[j].RemotePath.Path),
+					zap.String("name", req.NewName),
+					zap.Error(undoErr),
+				)
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Directory on its own host each of owners moves into, false unless every
+// one of them has a different one
+func mergedTargets(owners []*RemoteNode, newDir fs.Node) ([]*RemoteNode, bool) {
+
+	var targets []*RemoteNode
+	used := make(map[*RemoteNode]bool)
+
+	for _, owner := range owners {
+
+		dest := renameTarget(newDir, owner.RemotePath.Address())
+
+		if dest == nil || used[dest] || dest.RemotePath.Address() != owner.RemotePath.Address() {
+			return nil, false
+		}
+
+		used[dest] = true
+		targets = append(targets, dest)
+	}
+
+	return targets, true
+}
+
+// Remote directory a rename into newDir lands in, a union picks its member
+// on the same host so that the rename stays local when it can
+func renameTarget(newDir fs.Node, address string) *RemoteNode {
+
+	switch n := newDir.(type) {
+	case *RemoteNode:
+		return n
+	case *UnionNode:
+		for _, member := range n.Members {
+			if member.RemotePath.Address() == address {
+				return member
+			}
+		}
+
+		return n.target()
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+// +build unit
+
+/*
+Copyright 2018 Sourabh Bollapragada
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ifs_test
+
+import (
+	"bazil.org/fuse"
+	"github.com/chemistry-sourabh/ifs"
+	"golang.org/x/net/context"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// Calls to startAgents so far, the talker keeps its connections to an
+// address so every call gets hostnames of its own
+var agentRuns int
+
+// Serves one directory per host from this process, each behind its own unix
+// socket, and returns the directories with a function removing them
+func startAgents(t *testing.T, hostnames ...string) ([]*ifs.RemotePath, func()) {
+
+	transport, _ := ifs.GetTransport(ifs.TransportUnix)
+	agentRuns++
+
+	var roots []*ifs.RemoteRoot
+	var remotePaths []*ifs.RemotePath
+	var cleanups []func()
+
+	for _, hostname := range hostnames {
+
+		hostname += "-" + strconv.Itoa(agentRuns)
+		dir := path.Join(os.TempDir(), "ifs_"+hostname+"_"+strconv.Itoa(os.Getpid()))
+		Ok(t, os.MkdirAll(dir, 0755))
+
+		socket := dir + ".sock"
+
+		listener, err := transport.Listen(socket, nil)
+		Ok(t, err)
+
+		go ifs.AgentTalker().Serve(listener)
+
+		cleanups = append(cleanups, func() {
+			listener.Close()
+			os.Remove(socket)
+			os.RemoveAll(dir)
+		})
+
+		roots = append(roots, &ifs.RemoteRoot{
+			Hostname:  hostname,
+			Transport: ifs.TransportUnix,
+			Socket:    socket,
+		})
+
+		remotePaths = append(remotePaths, &ifs.RemotePath{Hostname: hostname, Path: dir})
+	}
+
+	ifs.Talker().Startup(roots, 1)
+
+	return remotePaths, func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// Names come from the first member holding them, members in order and each
+// member's names sorted
+func TestUnionNode_ReadDirAll(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "union-a", "union-b")
+	defer cleanup()
+
+	a, b := remotePaths[0].Path, remotePaths[1].Path
+
+	WriteDummyDataToPath(path.Join(a, "shared"), 1)
+	WriteDummyDataToPath(path.Join(a, "only-a"), 1)
+	WriteDummyDataToPath(path.Join(b, "shared"), 2)
+	Ok(t, os.Mkdir(path.Join(b, "only-b"), 0755))
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst, remotePaths...)
+
+	children, err := un.ReadDirAll(context.Background())
+	Ok(t, err)
+
+	var names []string
+	for _, child := range children {
+		names = append(names, child.Name)
+	}
+
+	Compare(t, names, []string{"only-a", "shared", "only-b"})
+	Compare(t, children[2].Type, fuse.DT_Dir)
+
+	val, _ := un.Members[0].RemoteNodes.Get("shared")
+	Compare(t, children[1].Inode, val.(*ifs.RemoteNode).Inode)
+}
+
+// A name resolves to the first member holding it, directories held by
+// several members are merged into one union
+func TestUnionNode_Lookup(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "union-a", "union-b")
+	defer cleanup()
+
+	a, b := remotePaths[0].Path, remotePaths[1].Path
+
+	WriteDummyDataToPath(path.Join(a, "shared"), 1)
+	WriteDummyDataToPath(path.Join(b, "shared"), 2)
+	WriteDummyDataToPath(path.Join(b, "only-b"), 1)
+	WriteDummyDataToPath(path.Join(a, "mixed"), 1)
+	Ok(t, os.Mkdir(path.Join(b, "mixed"), 0755))
+	Ok(t, os.Mkdir(path.Join(a, "dir"), 0755))
+	Ok(t, os.Mkdir(path.Join(b, "dir"), 0755))
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst, remotePaths...)
+	ctx := context.Background()
+
+	node, err := un.Lookup(ctx, "shared")
+	Ok(t, err)
+	Compare(t, node.(*ifs.RemoteNode).RemotePath.Hostname, remotePaths[0].Hostname)
+
+	node, err = un.Lookup(ctx, "only-b")
+	Ok(t, err)
+	Compare(t, node.(*ifs.RemoteNode).RemotePath.Hostname, remotePaths[1].Hostname)
+
+	// A file owns the name, the directory below it is not merged
+	node, err = un.Lookup(ctx, "mixed")
+	Ok(t, err)
+	Compare(t, node.(*ifs.RemoteNode).IsDir, false)
+
+	node, err = un.Lookup(ctx, "dir")
+	Ok(t, err)
+
+	merged := node.(*ifs.UnionNode)
+	Compare(t, len(merged.Members), 2)
+	Compare(t, merged.Members[0].RemotePath.Hostname, remotePaths[0].Hostname)
+	Compare(t, merged.Members[1].RemotePath.Hostname, remotePaths[1].Hostname)
+
+	again, _ := un.Lookup(ctx, "dir")
+	Compare(t, again == node, true)
+
+	_, err = un.Lookup(ctx, "missing")
+	Compare(t, err, fuse.ENOENT)
+}
+
+// Removing a name removes it from every member so no lower copy shows up
+func TestUnionNode_Remove(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "union-a", "union-b")
+	defer cleanup()
+
+	a, b := remotePaths[0].Path, remotePaths[1].Path
+
+	WriteDummyDataToPath(path.Join(a, "shared"), 1)
+	WriteDummyDataToPath(path.Join(b, "shared"), 2)
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst, remotePaths...)
+	ctx := context.Background()
+
+	Ok(t, un.Remove(ctx, &fuse.RemoveRequest{Name: "shared"}))
+
+	Compare(t, exists(path.Join(a, "shared")), false)
+	Compare(t, exists(path.Join(b, "shared")), false)
+
+	_, err := un.Lookup(ctx, "shared")
+	Compare(t, err, fuse.ENOENT)
+
+	Compare(t, un.Remove(ctx, &fuse.RemoveRequest{Name: "shared"}), fuse.ENOENT)
+}
+
+// A name only the top member holds is renamed, one a lower member also
+// holds is refused as it would show through under the old name
+func TestUnionNode_Rename(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "union-a", "union-b")
+	defer cleanup()
+
+	a, b := remotePaths[0].Path, remotePaths[1].Path
+
+	WriteDummyDataToPath(path.Join(a, "only-a"), 1)
+	WriteDummyDataToPath(path.Join(a, "shared"), 1)
+	WriteDummyDataToPath(path.Join(b, "shared"), 2)
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst, remotePaths...)
+	ctx := context.Background()
+
+	Ok(t, un.Rename(ctx, &fuse.RenameRequest{OldName: "only-a", NewName: "moved"}, un))
+
+	Compare(t, exists(path.Join(a, "moved")), true)
+	Compare(t, exists(path.Join(a, "only-a")), false)
+
+	node, err := un.Lookup(ctx, "moved")
+	Ok(t, err)
+	Compare(t, node.(*ifs.RemoteNode).RemotePath.Hostname, remotePaths[0].Hostname)
+
+	err = un.Rename(ctx, &fuse.RenameRequest{OldName: "shared", NewName: "other"}, un)
+	Compare(t, err, fuse.Errno(syscall.EXDEV))
+
+	Compare(t, exists(path.Join(a, "shared")), true)
+	Compare(t, exists(path.Join(b, "shared")), true)
+	Compare(t, exists(path.Join(a, "other")), false)
+}
+
+// Merged directories move together on their own hosts, or not at all
+func TestUnionNode_RenameMerged(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "union-a", "union-b")
+	defer cleanup()
+
+	a, b := remotePaths[0].Path, remotePaths[1].Path
+
+	Ok(t, os.Mkdir(path.Join(a, "dir"), 0755))
+	Ok(t, os.Mkdir(path.Join(b, "dir"), 0755))
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst, remotePaths...)
+	ctx := context.Background()
+
+	// Only the directory on the first host could move into a plain one there
+	err := un.Rename(ctx, &fuse.RenameRequest{OldName: "dir", NewName: "moved"}, un.Members[0])
+	Compare(t, err, fuse.Errno(syscall.EXDEV))
+
+	Compare(t, exists(path.Join(a, "dir")), true)
+	Compare(t, exists(path.Join(b, "dir")), true)
+
+	Ok(t, un.Rename(ctx, &fuse.RenameRequest{OldName: "dir", NewName: "moved"}, un))
+
+	Compare(t, exists(path.Join(a, "moved")), true)
+	Compare(t, exists(path.Join(b, "moved")), true)
+
+	node, err := un.Lookup(ctx, "moved")
+	Ok(t, err)
+	Compare(t, len(node.(*ifs.UnionNode).Members), 2)
+
+	_, err = un.Lookup(ctx, "dir")
+	Compare(t, err, fuse.ENOENT)
+}
+
+// A directory stats without a staff group on the system
+func TestUnionNode_Attr(t *testing.T) {
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst)
+
+	attr := &fuse.Attr{}
+	Ok(t, un.Attr(context.Background(), attr))
+	Compare(t, attr.Mode.IsDir(), true)
+}
+
+// New directories go to the first member or rotate through all of them
+func TestUnionNode_CreatePolicy(t *testing.T) {
+
+	remotePaths, cleanup := startAgents(t, "union-a", "union-b")
+	defer cleanup()
+
+	a, b := remotePaths[0].Path, remotePaths[1].Path
+	ctx := context.Background()
+
+	un := ifs.NewUnionNode(ifs.CreatePolicyFirst, remotePaths...)
+
+	for _, name := range []string{"first-0", "first-1"} {
+		_, err := un.Mkdir(ctx, &fuse.MkdirRequest{Name: name, Mode: 0755})
+		Ok(t, err)
+		Compare(t, exists(path.Join(a, name)), true)
+	}
+
+	un = ifs.NewUnionNode(ifs.CreatePolicyRoundRobin, remotePaths...)
+
+	for i, dir := range []string{a, b, a} {
+		name := "rr-" + strconv.Itoa(i)
+
+		_, err := un.Mkdir(ctx, &fuse.MkdirRequest{Name: name, Mode: 0755})
+		Ok(t, err)
+		Compare(t, exists(path.Join(dir, name)), true)
+	}
+
+	// Both members share a file system, the one with most space is one of them
+	un = ifs.NewUnionNode(ifs.CreatePolicyMostFree, remotePaths...)
+
+	_, err := un.Mkdir(ctx, &fuse.MkdirRequest{Name: "free", Mode: 0755})
+	Ok(t, err)
+	Compare(t, exists(path.Join(a, "free")) != exists(path.Join(b, "free")), true)
+}
@@ -29,7 +29,25 @@ import (
 )
 
 type VirtualNode struct {
+	Inode uint64
 	Nodes cmap.ConcurrentMap
+
+	// Agent served below a top level directory, empty deeper in the tree
+	Address string
+}
+
+// Inode of a child in a virtual directory, 0 lets bazil pick one
+func childInode(node interface{}) uint64 {
+	switch n := node.(type) {
+	case *VirtualNode:
+		return n.Inode
+	case *RemoteNode:
+		return n.Inode
+	case *UnionNode:
+		return n.Inode
+	}
+
+	return 0
 }
 
 func (vn *VirtualNode) Attr(ctx context.Context, attr *fuse.Attr) error {
@@ -45,6 +63,7 @@ func (vn *VirtualNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 	curGroup, _ := user.LookupGroup("staff")
 	gid, _ := strconv.ParseUint(curGroup.Gid, 10, 64)
 
+	attr.Inode = vn.Inode
 	attr.Uid = uint32(uid)
 	attr.Gid = uint32(gid)
 	//attr.Size = uint64(10)
@@ -68,8 +87,10 @@ func (vn *VirtualNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 	var children []fuse.Dirent
 
+	vn.fetchAttrs()
+
 	for dirName := range vn.Nodes.IterBuffered() {
-		child := fuse.Dirent{Type: fuse.DT_Dir, Name: dirName.Key}
+		child := fuse.Dirent{Inode: childInode(dirName.Val), Type: fuse.DT_Dir, Name: dirName.Key}
 		children = append(children, child)
 	}
 
@@ -82,6 +103,32 @@ func (vn *VirtualNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return children, nil
 }
 
+// Fetches the attributes of remote children not seen yet in one batch per
+// host, a listing would otherwise be followed by an attr request for each
+func (vn *VirtualNode) fetchAttrs() {
+
+	var rns []*RemoteNode
+	var remotePaths []*RemotePath
+
+	for tup := range vn.Nodes.IterBuffered() {
+		if rn, ok := tup.Val.(*RemoteNode); ok && !rn.IsCached {
+			rns = append(rns, rn)
+			remotePaths = append(remotePaths, rn.RemotePath)
+		}
+	}
+
+	if len(rns) == 0 {
+		return
+	}
+
+	// Children that failed are asked again when they are looked at
+	for i, resp := range Talker().sendBatched(AttrRequest, remotePaths) {
+		if resp.Err() == nil {
+			rns[i].setStat(resp.Data.(*Stat))
+		}
+	}
+}
+
 func (vn *VirtualNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 	zap.L().Debug("Lookup FS Request",